@@ -6,48 +6,102 @@ import (
 )
 
 type Configuration struct {
-	Loaded                  bool              `toml:"-"`
-	LoadError               error             `toml:"-"`
-	Bind                    string            `toml:"bind"`
-	AuthToken               string            `toml:"auth-token"`
-	AuthTokenMinimumSize    int               `toml:"auth-token-minimum-size"`
-	DriverReset             bool              `toml:"driver-reset"`
-	PowerMonitoringInterval uint              `toml:"power-monitoring-interval"`
-	PingInterval            uint              `toml:"ping-interval"`
-	SpiSpeed                uint              `toml:"spi-speed"`
-	LogLevel                clog.LogLevel     `toml:"log-level"`
-	CurrentLimit            uint              `toml:"current-limit"`
-	LogTerminal             string            `toml:"log-terminal"`
-	LogFile                 *helpers.FilePath `toml:"log-file"`
-	NodeCache               *helpers.FilePath `toml:"node-cache"`
-	CheckForUpdates         bool              `toml:"check-for-updates"`
-	TerminationResistor     bool              `toml:"termination-resistor"`
-	SigPowerOff             bool              `toml:"sig-power-off"`
+	Loaded                   bool              `toml:"-"`
+	LoadError                error             `toml:"-"`
+	Bind                     string            `toml:"bind"`
+	AuthToken                string            `toml:"auth-token"`
+	AuthTokenMinimumSize     int               `toml:"auth-token-minimum-size"`
+	Driver                   string            `toml:"driver"`
+	DriverReset              bool              `toml:"driver-reset"`
+	CanBitrate               uint              `toml:"can-bitrate"`
+	SerialSpeed              uint              `toml:"serial-speed"`
+	PowerMonitoringInterval  uint              `toml:"power-monitoring-interval"`
+	PingInterval             uint              `toml:"ping-interval"`
+	SpiSpeed                 uint              `toml:"spi-speed"`
+	SpiDevice                string            `toml:"spi-device"`
+	GpioChip                 string            `toml:"gpio-chip"`
+	LogLevel                 clog.LogLevel     `toml:"log-level"`
+	CurrentLimit             uint              `toml:"current-limit"`
+	LogTerminal              string            `toml:"log-terminal"`
+	LogFile                  *helpers.FilePath `toml:"log-file"`
+	NodeCache                *helpers.FilePath `toml:"node-cache"`
+	ChannelCache             *helpers.FilePath `toml:"channel-cache"`
+	RetainedChannels         []string          `toml:"retained-channels"`
+	RetainedRepublish        []string          `toml:"retained-republish"`
+	RetainedFile             *helpers.FilePath `toml:"retained-file"`
+	ChannelHistoryLength     uint              `toml:"channel-history-length"`
+	ChannelHistoryDir        *helpers.FilePath `toml:"channel-history-dir"`
+	ChannelHistoryRetention  uint              `toml:"channel-history-retention"`
+	CheckForUpdates          bool              `toml:"check-for-updates"`
+	TerminationResistor      bool              `toml:"termination-resistor"`
+	SigPowerOff              bool              `toml:"sig-power-off"`
+	SimulatorNodes           uint              `toml:"simulator-nodes"`
+	SimulatorUdids           []string          `toml:"simulator-udids"`
+	SimulatorPublish         uint              `toml:"simulator-publish-interval"`
+	CaptureCandump           *helpers.FilePath `toml:"capture-candump"`
+	CapturePcap              *helpers.FilePath `toml:"capture-pcap"`
+	ReplaySpeed              float64           `toml:"replay-speed"`
+	MonitorFrames            bool              `toml:"monitor-frames"`
+	BusOffResetThreshold     uint              `toml:"bus-off-reset-threshold"`
+	FaultPowerCycleThreshold uint              `toml:"fault-power-cycle-threshold"`
+	MonitorMessages          bool              `toml:"monitor-messages"`
+	NodeQueueDepth           uint              `toml:"node-queue-depth"`
+	NodeQueueOverflow        string            `toml:"node-queue-overflow"`
+	NodeEvictionDelay        uint              `toml:"node-eviction-delay"`
+	NodeDebugLogDir          *helpers.FilePath `toml:"node-debug-log-dir"`
 }
 
 var Settings = Configuration{
-	Loaded:                  true,
-	LoadError:               nil,
-	Bind:                    ":4242",
-	AuthToken:               "password",
-	AuthTokenMinimumSize:    24,
-	DriverReset:             true,
-	PowerMonitoringInterval: 10,
-	PingInterval:            5000,
-	SpiSpeed:                500000,
-	LogLevel:                0,
-	CurrentLimit:            0,
-	LogTerminal:             "plain",
-	LogFile:                 DefaultLogFile,
-	NodeCache:               DefaultNodeCacheFile,
-	CheckForUpdates:         true,
-	TerminationResistor:     true,
-	SigPowerOff:             false,
+	Loaded:                   true,
+	LoadError:                nil,
+	Bind:                     ":4242",
+	AuthToken:                "password",
+	AuthTokenMinimumSize:     24,
+	Driver:                   "pimaster",
+	DriverReset:              true,
+	CanBitrate:               125000,
+	SerialSpeed:              115200,
+	PowerMonitoringInterval:  10,
+	PingInterval:             5000,
+	SpiSpeed:                 500000,
+	SpiDevice:                "/dev/spidev0.0",
+	GpioChip:                 "",
+	LogLevel:                 0,
+	CurrentLimit:             0,
+	LogTerminal:              "plain",
+	LogFile:                  DefaultLogFile,
+	NodeCache:                DefaultNodeCacheFile,
+	ChannelCache:             DefaultChannelCacheFile,
+	RetainedChannels:         nil,
+	RetainedRepublish:        nil,
+	RetainedFile:             DefaultRetainedFile,
+	ChannelHistoryLength:     1024,
+	ChannelHistoryDir:        helpers.NewFilePath(),
+	ChannelHistoryRetention:  168,
+	CheckForUpdates:          true,
+	TerminationResistor:      true,
+	SigPowerOff:              false,
+	SimulatorNodes:           4,
+	SimulatorUdids:           nil,
+	SimulatorPublish:         1000,
+	CaptureCandump:           helpers.NewFilePath(),
+	CapturePcap:              helpers.NewFilePath(),
+	ReplaySpeed:              1.0,
+	MonitorFrames:            true,
+	BusOffResetThreshold:     0,
+	FaultPowerCycleThreshold: 0,
+	MonitorMessages:          true,
+	NodeQueueDepth:           16,
+	NodeQueueOverflow:        "drop-oldest",
+	NodeEvictionDelay:        86400,
+	NodeDebugLogDir:          helpers.NewFilePath(),
 }
 
 var (
 	DefaultNocancConfigFile *helpers.FilePath = helpers.HomeDir().Append(".nocanc.conf")
 	DefaultConfigFile       *helpers.FilePath = helpers.HomeDir().Append(".nocand", "config")
 	DefaultNodeCacheFile    *helpers.FilePath = helpers.HomeDir().Append(".nocand", "cache")
+	DefaultChannelCacheFile *helpers.FilePath = helpers.HomeDir().Append(".nocand", "channels")
+	DefaultRetainedFile     *helpers.FilePath = helpers.HomeDir().Append(".nocand", "retained")
 	DefaultLogFile          *helpers.FilePath = helpers.NewFilePath()
 )
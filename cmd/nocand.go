@@ -9,10 +9,20 @@ import (
 	"github.com/omzlo/nocand/cmd/config"
 	"github.com/omzlo/nocand/controllers"
 	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
 	"github.com/omzlo/nocand/models/helpers"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/models/replay"
+	"github.com/omzlo/nocand/models/rpi"
+	"github.com/omzlo/nocand/models/simulator"
+	"github.com/omzlo/nocand/models/slcan"
+	"github.com/omzlo/nocand/models/socketcan"
+	"github.com/omzlo/nocand/socket"
 	"os"
 	"path"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -36,9 +46,15 @@ func HelpFlagSet(cmd string) *flag.FlagSet {
 func BaseFlagSet(cmd string) *flag.FlagSet {
 	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
 	fs.Var(optConfig, "config", fmt.Sprintf("Config file location, defaults to %s", config.DefaultConfigFile))
+	fs.StringVar(&config.Settings.Driver, "driver", config.Settings.Driver, "CAN bus driver: 'pimaster', 'socketcan:<interface>', 'slcan:<serial device>' or 'replay:<candump file>' (default: pimaster).")
+	fs.UintVar(&config.Settings.CanBitrate, "can-bitrate", config.Settings.CanBitrate, "CAN bus bitrate for slcan adapters (default: 125000).")
+	fs.UintVar(&config.Settings.SerialSpeed, "serial-speed", config.Settings.SerialSpeed, "Serial line speed for slcan adapters (default: 115200).")
+	fs.Float64Var(&config.Settings.ReplaySpeed, "replay-speed", config.Settings.ReplaySpeed, "Replay speed factor for the replay driver (default: 1.0, use 0 to replay without delays).")
 	fs.BoolVar(&config.Settings.DriverReset, "driver-reset", config.Settings.DriverReset, "Reset driver at startup (default: true).")
 	fs.UintVar(&config.Settings.PowerMonitoringInterval, "power-monitoring-interval", config.Settings.PowerMonitoringInterval, "CANbus power monitoring interval in seconds (default: 10, disable with 0).")
 	fs.UintVar(&config.Settings.SpiSpeed, "spi-speed", config.Settings.SpiSpeed, "SPI communication speed in bits per second (use with caution).")
+	fs.StringVar(&config.Settings.SpiDevice, "spi-device", config.Settings.SpiDevice, "SPI device of the PiMaster (default: /dev/spidev0.0).")
+	fs.StringVar(&config.Settings.GpioChip, "gpio-chip", config.Settings.GpioChip, "GPIO character device of the PiMaster RX/TX lines (default: detected automatically).")
 	fs.Var(&config.Settings.LogLevel, "log-level", "Log verbosity level (DEBUGXX, DEBUGX, DEBUG, INFO, WARNING, ERROR or NONE)")
 	fs.UintVar(&config.Settings.CurrentLimit, "current-limit", config.Settings.CurrentLimit, "Current limit level (default=0 -> don't change)")
 	fs.Var(config.Settings.LogFile, "log-file", "Log file name, if empty no log file is created.")
@@ -49,9 +65,40 @@ func BaseFlagSet(cmd string) *flag.FlagSet {
 func ServerFlagSet(cmd string) *flag.FlagSet {
 	fs := BaseFlagSet(cmd)
 	fs.UintVar(&config.Settings.PingInterval, "ping-interval", config.Settings.PingInterval, "Node ping interval in milliseconds (defaults to 5000ms, use 0 to disable).")
+	fs.UintVar(&config.Settings.NodeEvictionDelay, "node-eviction-delay", config.Settings.NodeEvictionDelay, "Seconds an unresponsive node is kept before being unregistered (defaults to 86400s, use 0 to unregister at once).")
 	fs.Var(config.Settings.NodeCache, "node-cache", fmt.Sprintf("Node cache file name, defaults to '%s'. Set it to an empty string to disable node caching.", config.DefaultNodeCacheFile))
+	fs.Var(config.Settings.RetainedFile, "retained-file", fmt.Sprintf("File where the values of the channels selected by retained-channels are kept, defaults to '%s'.", config.DefaultRetainedFile))
+	fs.UintVar(&config.Settings.ChannelHistoryLength, "channel-history-length", config.Settings.ChannelHistoryLength, "Number of values of each channel kept in memory (defaults to 1024, use 0 to disable the channel history).")
+	fs.Var(config.Settings.ChannelHistoryDir, "channel-history-dir", "Directory where the values of all channels are also written, if empty the channel history is only kept in memory.")
+	fs.UintVar(&config.Settings.ChannelHistoryRetention, "channel-history-retention", config.Settings.ChannelHistoryRetention, "Hours the channel history files are kept (defaults to 168, use 0 to keep them forever).")
+	fs.Var(config.Settings.ChannelCache, "channel-cache", fmt.Sprintf("Channel cache file name, defaults to '%s'. Set it to an empty string to disable channel caching.", config.DefaultChannelCacheFile))
 	fs.IntVar(&config.Settings.AuthTokenMinimumSize, "auth-token-minium-size", config.Settings.AuthTokenMinimumSize, "Authentication token minimum size in characters (defaults to 24).")
 	fs.BoolVar(&config.Settings.SigPowerOff, "sig-power-off", config.Settings.SigPowerOff, "Power off the CAN-bus if a SIGINT or SIGTERM is received.")
+	fs.UintVar(&config.Settings.BusOffResetThreshold, "bus-off-reset-threshold", config.Settings.BusOffResetThreshold, "Reset the driver after this number of consecutive bus-off events (default: 0, disabled).")
+	fs.UintVar(&config.Settings.FaultPowerCycleThreshold, "fault-power-cycle-threshold", config.Settings.FaultPowerCycleThreshold, "Power cycle the bus after this number of consecutive electrical fault reports from the driver (default: 0, disabled).")
+	fs.UintVar(&config.Settings.NodeQueueDepth, "node-queue-depth", config.Settings.NodeQueueDepth, "Number of received messages waiting to be processed for each node (default: 16).")
+	fs.StringVar(&config.Settings.NodeQueueOverflow, "node-queue-overflow", config.Settings.NodeQueueOverflow, "Message dropped when the queue of a node is full: 'drop-oldest' or 'drop-newest' (default: drop-oldest).")
+	fs.Var(config.Settings.CaptureCandump, "capture-candump", "Record all CAN frames sent and received in a candump log file, if empty no capture is made.")
+	fs.Var(config.Settings.NodeDebugLogDir, "node-debug-log-dir", "Directory where the debug messages of each node are written, in a file named after its udid. If empty no debug log file is created.")
+	fs.Var(config.Settings.CapturePcap, "capture-pcap", "Record all CAN frames sent and received in a pcapng file for Wireshark, if empty no capture is made.")
+	return fs
+}
+
+func SimulateFlagSet(cmd string) *flag.FlagSet {
+	fs := ServerFlagSet(cmd)
+	fs.UintVar(&config.Settings.SimulatorNodes, "simulator-nodes", config.Settings.SimulatorNodes, "Number of simulated nodes (default: 4, or the number of simulator-udids if greater).")
+	fs.UintVar(&config.Settings.SimulatorPublish, "simulator-publish-interval", config.Settings.SimulatorPublish, "Interval in milliseconds between publications of each simulated node (defaults to 1000ms, use 0 to disable).")
+	return fs
+}
+
+func MonitorFlagSet(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Var(optConfig, "config", fmt.Sprintf("Config file location, defaults to %s", config.DefaultConfigFile))
+	fs.StringVar(&config.Settings.Bind, "bind", config.Settings.Bind, "Address of the nocand server to monitor (defaults to ':4242').")
+	fs.BoolVar(&config.Settings.MonitorFrames, "monitor-frames", config.Settings.MonitorFrames, "Display raw CAN frames (default: true).")
+	fs.BoolVar(&config.Settings.MonitorMessages, "monitor-messages", config.Settings.MonitorMessages, "Display reassembled NoCAN messages (default: true).")
+	fs.Var(&config.Settings.LogLevel, "log-level", "Log verbosity level (DEBUGXX, DEBUGX, DEBUG, INFO, WARNING, ERROR or NONE)")
+	fs.StringVar(&config.Settings.LogTerminal, "log-terminal", config.Settings.LogTerminal, "Log to terminal (choices: 'plain', 'color' or 'none').")
 	return fs
 }
 
@@ -63,9 +110,11 @@ func PowerFlagSet(cmd string) *flag.FlagSet {
 var Commands = helpers.CommandFlagSetList{
 	{"auth-token", auth_token_cmd, VersionFlagSet, "auth-token", "Generate a secure random auth-token value to store in the configuration file."},
 	{"help", nil, HelpFlagSet, "help [command]", "Provide help about a command"},
+	{"monitor", monitor_cmd, MonitorFlagSet, "monitor", "Connect to a running server and display CAN bus traffic"},
 	{"power-on", poweron_cmd, BaseFlagSet, "power-on", "Power on the NoCAN network and start"},
 	{"power-off", poweroff_cmd, BaseFlagSet, "power-off", "Power off the NoCAN network and stop"},
 	{"server", server_cmd, ServerFlagSet, "server", "Launch the NoCAN network manager and event server"},
+	{"simulate", simulate_cmd, SimulateFlagSet, "simulate", "Launch the NoCAN network manager and event server on a bus of simulated nodes"},
 	{"version", version_cmd, VersionFlagSet, "version", "Display the version"},
 }
 
@@ -137,7 +186,37 @@ func init_config() {
 	clog.Info("nocand version %s", NocandVersion)
 }
 
-func init_pimaster() error {
+func create_driver(spec string) (device.Driver, error) {
+	kind := spec
+	arg := ""
+	if idx := strings.IndexByte(spec, ':'); idx >= 0 {
+		kind = spec[:idx]
+		arg = spec[idx+1:]
+	}
+
+	switch kind {
+	case "pimaster":
+		return rpi.NewDriver(config.Settings.SpiDevice, config.Settings.GpioChip, config.Settings.SpiSpeed), nil
+	case "socketcan":
+		if arg == "" {
+			return nil, fmt.Errorf("The socketcan driver requires an interface name, as in 'socketcan:can0'")
+		}
+		return socketcan.NewDriver(arg), nil
+	case "slcan":
+		if arg == "" {
+			return nil, fmt.Errorf("The slcan driver requires a serial device, as in 'slcan:/dev/ttyACM0'")
+		}
+		return slcan.NewDriver(arg, config.Settings.CanBitrate, config.Settings.SerialSpeed), nil
+	case "replay":
+		if arg == "" {
+			return nil, fmt.Errorf("The replay driver requires a candump log file, as in 'replay:capture.log'")
+		}
+		return replay.NewDriver(arg, config.Settings.ReplaySpeed), nil
+	}
+	return nil, fmt.Errorf("Unknown driver '%s', expected 'pimaster', 'socketcan:<interface>', 'slcan:<serial device>' or 'replay:<candump file>'", spec)
+}
+
+func init_driver(driver device.Driver) error {
 	var start_driver bool
 
 	if config.Settings.DriverReset {
@@ -146,10 +225,12 @@ func init_pimaster() error {
 		start_driver = controllers.NO_BUS_RESET
 	}
 
-	if err := controllers.Bus.Initialize(start_driver, config.Settings.SpiSpeed); err != nil {
-		return fmt.Errorf("Failed to connect to PiMaster: %s", err)
+	controllers.Bus = controllers.NewNocanNetworkController(driver)
+
+	if err := controllers.Bus.Initialize(start_driver); err != nil {
+		return fmt.Errorf("Failed to connect to driver %s: %s", config.Settings.Driver, err)
 	}
-	clog.Info("Successfully connected to PiMaster.")
+	clog.Info("Successfully connected to driver %s.", config.Settings.Driver)
 
 	if config.Settings.CurrentLimit > 0 {
 		controllers.Bus.SetCurrentLimit(uint16(config.Settings.CurrentLimit))
@@ -162,14 +243,73 @@ func init_pimaster() error {
 	return nil
 }
 
-func server_cmd(fs *flag.FlagSet) error {
-	init_config()
+func init_configured_driver() error {
+	driver, err := create_driver(config.Settings.Driver)
+	if err != nil {
+		return err
+	}
+	return init_driver(driver)
+}
+
+func init_captures() error {
+	iface := "can0"
+	if strings.HasPrefix(config.Settings.Driver, "socketcan:") {
+		iface = strings.TrimPrefix(config.Settings.Driver, "socketcan:")
+	}
 
+	if !config.Settings.CaptureCandump.IsNull() {
+		writer, err := can.NewCandumpWriter(config.Settings.CaptureCandump.String(), iface)
+		if err != nil {
+			return fmt.Errorf("Could not create capture file '%s': %s", config.Settings.CaptureCandump, err)
+		}
+		controllers.Bus.AddFrameRecorder(writer)
+		clog.Info("CAN frames will be captured in %s", config.Settings.CaptureCandump)
+	}
+
+	if !config.Settings.CapturePcap.IsNull() {
+		writer, err := nocan.NewPcapngWriter(config.Settings.CapturePcap.String(), iface)
+		if err != nil {
+			return fmt.Errorf("Could not create capture file '%s': %s", config.Settings.CapturePcap, err)
+		}
+		controllers.Bus.AddFrameRecorder(writer)
+		clog.Info("CAN frames will be captured in pcapng format in %s", config.Settings.CapturePcap)
+	}
+	return nil
+}
+
+func serve(driver device.Driver) error {
 	if len(config.Settings.AuthToken) < config.Settings.AuthTokenMinimumSize {
 		return fmt.Errorf("The auth-token you have selected is too short (%d characters). Choose a token of 24 characters or more or dissable this check with the -auth-token-limit option.", len(config.Settings.AuthToken))
 	}
 
+	overflow, err := controllers.ParseOverflowPolicy(config.Settings.NodeQueueOverflow)
+	if err != nil {
+		return err
+	}
+
 	models.NodeCacheFile(config.Settings.NodeCache)
+	models.ChannelCacheFile(config.Settings.ChannelCache)
+	// The caches must be loaded before retained channels are restored, so
+	// that these channels get their cached ids back.
+	models.NodeCacheLoad()
+	models.ChannelCacheLoad()
+
+	if len(config.Settings.RetainedChannels) > 0 {
+		retained, err := models.NewRetainedStore(config.Settings.RetainedFile, config.Settings.RetainedChannels, config.Settings.RetainedRepublish)
+		if err != nil {
+			return err
+		}
+		retained.Load()
+		controllers.Channels.Retained = retained
+		if count := controllers.Channels.RestoreRetained(); count > 0 {
+			clog.Info("Restored %d channels with a retained value", count)
+		}
+	}
+
+	if config.Settings.ChannelHistoryLength > 0 {
+		retention := time.Duration(config.Settings.ChannelHistoryRetention) * time.Hour
+		controllers.Channels.History = models.NewChannelHistory(int(config.Settings.ChannelHistoryLength), config.Settings.ChannelHistoryDir.String(), retention)
+	}
 
 	b, _ := time.Now().UTC().MarshalText()
 	controllers.SystemProperties.AddString("started_at", string(b))
@@ -178,7 +318,20 @@ func server_cmd(fs *flag.FlagSet) error {
 		clog.Fatal("Failed to launch server: %s", err)
 	}
 
-	if err := init_pimaster(); err != nil {
+	if err := init_driver(driver); err != nil {
+		return err
+	}
+
+	controllers.Bus.BusOffResetThreshold = config.Settings.BusOffResetThreshold
+	controllers.Bus.FaultPowerCycleThreshold = config.Settings.FaultPowerCycleThreshold
+	controllers.Bus.NodeQueueDepth = int(config.Settings.NodeQueueDepth)
+	controllers.Bus.NodeQueueOverflow = overflow
+	controllers.Bus.NodeEvictionDelay = time.Duration(config.Settings.NodeEvictionDelay) * time.Second
+	if !config.Settings.NodeDebugLogDir.IsNull() {
+		controllers.Bus.NodeDebugLogDir = config.Settings.NodeDebugLogDir.String()
+	}
+
+	if err := init_captures(); err != nil {
 		return err
 	}
 
@@ -188,15 +341,92 @@ func server_cmd(fs *flag.FlagSet) error {
 
 	controllers.Bus.RunPinger(time.Duration(config.Settings.PingInterval) * time.Millisecond)
 
-	controllers.Bus.AutoPowerOffOnTermination(config.Settings.SigPowerOff)
+	controllers.Bus.ShutdownOnTermination(config.Settings.SigPowerOff)
+
+	err = controllers.Bus.Serve()
+	controllers.Bus.Shutdown()
+	return err
+}
+
+func server_cmd(fs *flag.FlagSet) error {
+	init_config()
+
+	driver, err := create_driver(config.Settings.Driver)
+	if err != nil {
+		return err
+	}
+	return serve(driver)
+}
 
-	return controllers.Bus.Serve()
+func simulate_cmd(fs *flag.FlagSet) error {
+	init_config()
+
+	config.Settings.Driver = "simulator"
+	bus := simulator.NewBus()
+
+	count := config.Settings.SimulatorNodes
+	if uint(len(config.Settings.SimulatorUdids)) > count {
+		count = uint(len(config.Settings.SimulatorUdids))
+	}
+	for i := uint(0); i < count; i++ {
+		var udid models.Udid8
+
+		if i < uint(len(config.Settings.SimulatorUdids)) {
+			if err := udid.DecodeString(config.Settings.SimulatorUdids[i]); err != nil {
+				return fmt.Errorf("Invalid simulator udid '%s': %s", config.Settings.SimulatorUdids[i], err)
+			}
+		} else {
+			udid = simulator.GenerateUdid(i + 1)
+		}
+		node := simulator.NewNode(udid)
+		node.Channels = []string{"simulator/$(ID)/counter", "simulator/$(ID)/setpoint"}
+		node.Subscriptions = []string{"simulator/$(ID)/setpoint"}
+		node.PublishInterval = time.Duration(config.Settings.SimulatorPublish) * time.Millisecond
+		node.OnPublish = func(n *simulator.Node, channel string, value []byte) {
+			clog.Info("Simulated node N%d received %q on %s", n.Id(), value, channel)
+		}
+		bus.AddNode(node)
+	}
+	return serve(bus)
+}
+
+func monitor_cmd(fs *flag.FlagSet) error {
+	var monitor byte
+
+	clog.SetLogLevel(clog.LogLevel(config.Settings.LogLevel))
+
+	if config.Settings.MonitorFrames {
+		monitor |= socket.MONITOR_FRAMES
+	}
+	if config.Settings.MonitorMessages {
+		monitor |= socket.MONITOR_MESSAGES
+	}
+	if monitor == 0 {
+		return fmt.Errorf("Nothing to monitor, enable -monitor-frames and/or -monitor-messages")
+	}
+
+	conn := socket.NewEventConn(config.Settings.Bind, "nocand-monitor", config.Settings.AuthToken)
+	conn.OnConnect(func(c *socket.EventConn) error {
+		clog.Info("Monitoring bus traffic on %s", c.Conn.RemoteAddr())
+		c.SendAsync(socket.NewBusMonitorRequestEvent(monitor), socket.ReturnErrorOrContinue)
+		return nil
+	})
+	conn.OnEvent(socket.BusTrafficEventId, func(c *socket.EventConn, e socket.Eventer) error {
+		fmt.Println(e)
+		return nil
+	})
+	conn.EnableAutoRedial()
+
+	if err := conn.Connect(); err != nil {
+		return fmt.Errorf("Could not connect to server at %s: %s", config.Settings.Bind, err)
+	}
+	return conn.WaitTermination(0)
 }
 
 func poweron_cmd(fs *flag.FlagSet) error {
 	init_config()
 
-	if err := init_pimaster(); err != nil {
+	if err := init_configured_driver(); err != nil {
 		return err
 	}
 
@@ -208,7 +438,7 @@ func poweron_cmd(fs *flag.FlagSet) error {
 func poweroff_cmd(fs *flag.FlagSet) error {
 	init_config()
 
-	if err := init_pimaster(); err != nil {
+	if err := init_configured_driver(); err != nil {
 		return err
 	}
 
@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+)
+
+// lookupNode finds a registered node by its udid, if query is 8 bytes long,
+// or by its node id, if query is a single byte.
+func lookupNode(query []byte) *models.Node {
+	switch len(query) {
+	case 8:
+		return Nodes.Lookup(models.CreateUdid8(query))
+	case 1:
+		return Nodes.Find(nocan.NodeId(query[0]))
+	}
+	return nil
+}
+
+// handleAddressLookup answers a SYS_ADDRESS_LOOKUP message, whose payload is
+// either the udid of a node, to find its node id, or a node id on 1 byte, to
+// find its udid. The SYS_ADDRESS_LOOKUP_ACK carries the node id followed by
+// the udid, or echoes the query with 0xFF as parameter if no registered node
+// matches. It is sent to the sender of the query, which may be node 0 for a
+// device that has no address yet.
+func (nc *NocanNetworkController) handleAddressLookup(sender nocan.NodeId, msg *nocan.Message) {
+	query := msg.Bytes()
+
+	if len(query) != 8 && len(query) != 1 {
+		clog.Warning("SYS_ADDRESS_LOOKUP: node %d sent a query of %d bytes, expected a udid or a node id", sender, len(query))
+		nc.SendSystemMessage(sender, nocan.SYS_ADDRESS_LOOKUP_ACK, 0xFF, query)
+		return
+	}
+
+	node := lookupNode(query)
+	if node == nil {
+		clog.Info("SYS_ADDRESS_LOOKUP: node %d failed to find % x", sender, query)
+		nc.SendSystemMessage(sender, nocan.SYS_ADDRESS_LOOKUP_ACK, 0xFF, query)
+		return
+	}
+	clog.Info("SYS_ADDRESS_LOOKUP: node %d found %s", sender, node)
+	nc.SendSystemMessage(sender, nocan.SYS_ADDRESS_LOOKUP_ACK, 0x00, append([]byte{byte(node.Id)}, node.Udid[:]...))
+}
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"github.com/omzlo/nocand/socket"
+	"time"
+)
+
+const POWER_CYCLE_DELAY = 1 * time.Second
+
+// Health returns a copy of the current bus health state and counters.
+func (nc *NocanNetworkController) Health() device.BusHealth {
+	nc.healthMutex.Lock()
+	defer nc.healthMutex.Unlock()
+
+	return nc.health
+}
+
+// setHealthState must be called with healthMutex held.
+func (nc *NocanNetworkController) setHealthState(state device.BusHealthState) bool {
+	if nc.health.State == state {
+		return false
+	}
+	nc.health.State = state
+	nc.health.ChangedAt = time.Now()
+	if state == device.BUS_ERROR_ACTIVE {
+		nc.busOffStreak = 0
+	}
+	return true
+}
+
+func (nc *NocanNetworkController) broadcastHealth(health device.BusHealth) {
+	clog.Warning("Bus health is now %s", health.State)
+	EventServer.Broadcast(socket.NewBusHealthEvent(&health), nil)
+}
+
+// handleErrorFrame updates the bus health from an error frame, as reported by
+// SocketCAN compatible drivers.
+func (nc *NocanNetworkController) handleErrorFrame(frame *can.Frame) {
+	class := frame.ErrorClass()
+	tx_errors, rx_errors := frame.ErrorCounters()
+
+	clog.Debug("CAN error frame: %s (tx errors=%d, rx errors=%d)", frame.ErrorString(), tx_errors, rx_errors)
+
+	nc.healthMutex.Lock()
+	nc.health.ErrorFrames++
+	nc.health.TxErrors = tx_errors
+	nc.health.RxErrors = rx_errors
+
+	state := nc.health.State
+	switch {
+	case (class & can.CAN_ERR_BUSOFF) != 0:
+		state = device.BUS_OFF
+		nc.health.BusOff++
+		nc.busOffStreak++
+	case (class & can.CAN_ERR_RESTARTED) != 0:
+		state = device.BUS_ERROR_ACTIVE
+	case (class & can.CAN_ERR_CRTL) != 0:
+		if (frame.Data[1] & (can.CAN_ERR_CRTL_RX_PASSIVE | can.CAN_ERR_CRTL_TX_PASSIVE)) != 0 {
+			state = device.BUS_ERROR_PASSIVE
+			nc.health.ErrorPassive++
+		} else if (frame.Data[1] & can.CAN_ERR_CRTL_ACTIVE) != 0 {
+			state = device.BUS_ERROR_ACTIVE
+		}
+	}
+	if nc.health.State == device.BUS_ELECTRICAL_FAULT {
+		// Only the driver power status can clear an electrical fault.
+		state = device.BUS_ELECTRICAL_FAULT
+	}
+	changed := nc.setHealthState(state)
+
+	reset := false
+	if nc.BusOffResetThreshold > 0 && nc.busOffStreak >= nc.BusOffResetThreshold {
+		nc.busOffStreak = 0
+		nc.health.Resets++
+		reset = true
+	}
+	health := nc.health
+	nc.healthMutex.Unlock()
+
+	if changed {
+		nc.broadcastHealth(health)
+	}
+	if reset {
+		clog.Warning("Resetting driver after %d consecutive bus-off events", nc.BusOffResetThreshold)
+		if err := nc.Driver.Reset(); err != nil {
+			clog.Warning("Driver reset failed: %s", err)
+		}
+	}
+}
+
+// checkDriverStatus updates the bus health from the STATUS_ERROR and
+// STATUS_FAULT bits reported by the driver.
+func (nc *NocanNetworkController) checkDriverStatus(status device.StatusByte) {
+	nc.healthMutex.Lock()
+
+	state := nc.health.State
+	switch {
+	case (status & device.STATUS_FAULT) != 0:
+		if state != device.BUS_ELECTRICAL_FAULT {
+			nc.health.Faults++
+		}
+		state = device.BUS_ELECTRICAL_FAULT
+		nc.faultStreak++
+	case (status & device.STATUS_ERROR) != 0:
+		nc.health.DriverErrors++
+		if state == device.BUS_ERROR_ACTIVE || state == device.BUS_ELECTRICAL_FAULT {
+			state = device.BUS_ERROR_PASSIVE
+		}
+		nc.driverError = true
+		nc.faultStreak = 0
+	default:
+		if state == device.BUS_ELECTRICAL_FAULT || (nc.driverError && state == device.BUS_ERROR_PASSIVE) {
+			state = device.BUS_ERROR_ACTIVE
+		}
+		nc.driverError = false
+		nc.faultStreak = 0
+	}
+	changed := nc.setHealthState(state)
+
+	power_cycle := false
+	if nc.FaultPowerCycleThreshold > 0 && nc.faultStreak >= nc.FaultPowerCycleThreshold {
+		nc.faultStreak = 0
+		nc.health.PowerCycles++
+		power_cycle = true
+	}
+	health := nc.health
+	nc.healthMutex.Unlock()
+
+	if changed {
+		nc.broadcastHealth(health)
+	}
+	if power_cycle {
+		clog.Warning("Power cycling the bus after %d consecutive electrical fault reports", nc.FaultPowerCycleThreshold)
+		go func() {
+			nc.SetPower(false)
+			time.Sleep(POWER_CYCLE_DELAY)
+			nc.SetPower(true)
+		}()
+	}
+}
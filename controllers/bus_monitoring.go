@@ -2,7 +2,8 @@ package controllers
 
 import (
 	"github.com/omzlo/clog"
-	"github.com/omzlo/nocand/models/rpi"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/device"
 	"github.com/omzlo/nocand/socket"
 	"os"
 	"os/signal"
@@ -22,15 +23,17 @@ func MilliAmpEstimation(c uint16) uint {
 }
 
 func (nc *NocanNetworkController) RequestPowerStatusUpdate() {
-	if rpi.DriverReady {
-		ps, err := rpi.DriverUpdatePowerStatus()
-		if err != nil {
-			clog.Warning("Failed to read driver power status: %s", err)
-		} else {
-			clog.DebugX("Driver voltage=%.1f, current sense=%d (~ %d mA), reference voltage=%.2f, status(%x)=%s.", ps.Voltage, ps.CurrentSense, MilliAmpEstimation(ps.CurrentSense), ps.RefLevel, byte(ps.Status), ps.Status)
-		}
-		EventServer.Broadcast(socket.NewBusPowerStatusUpdateEvent(ps), nil)
+	ps, err := nc.Driver.PowerStatus()
+	if err == device.ErrNotSupported {
+		return
+	}
+	if err != nil {
+		clog.Warning("Failed to read driver power status: %s", err)
+		return
 	}
+	nc.checkDriverStatus(ps.Status)
+	clog.DebugX("Driver voltage=%.1f, current sense=%d (~ %d mA), reference voltage=%.2f, status(%x)=%s.", ps.Voltage, ps.CurrentSense, MilliAmpEstimation(ps.CurrentSense), ps.RefLevel, byte(ps.Status), ps.Status)
+	EventServer.Broadcast(socket.NewBusPowerStatusUpdateEvent(ps), nil)
 }
 
 func (nc *NocanNetworkController) RunPowerMonitor(interval time.Duration) {
@@ -42,14 +45,16 @@ func (nc *NocanNetworkController) RunPowerMonitor(interval time.Duration) {
 	}()
 }
 
-func (nc *NocanNetworkController) Initialize(with_reset bool, spi_speed uint) error {
-	di, err := rpi.DriverInitialize(with_reset, spi_speed)
+func (nc *NocanNetworkController) Initialize(with_reset bool) error {
+	di, err := nc.Driver.Initialize(with_reset)
 	nc.DeviceInfo = di
 	return err
 }
 
 func (nc *NocanNetworkController) SetPower(power_on bool) {
-	rpi.DriverSetPower(power_on)
+	if err := nc.Driver.SetPower(power_on); err != nil && err != device.ErrNotSupported {
+		clog.Warning("Failed to set bus power: %s", err)
+	}
 	if power_on == false {
 		Nodes.Clear()
 	}
@@ -57,12 +62,18 @@ func (nc *NocanNetworkController) SetPower(power_on bool) {
 }
 
 func (nci *NocanNetworkController) SetCurrentLimit(limit uint16) {
-	rpi.DriverSetCurrentLimit(limit)
+	if err := nci.Driver.SetCurrentLimit(limit); err != nil {
+		clog.Warning("Failed to set driver current limit: %s", err)
+		return
+	}
 	clog.DebugX("Driver current limit set to %d (~ %d mA)", limit, MilliAmpEstimation(limit))
 }
 
 func (nci *NocanNetworkController) SetTerminationResistor(set bool) {
-	rpi.DriverSetCanResistor(set)
+	if err := nci.Driver.SetTerminationResistor(set); err != nil {
+		clog.Warning("Failed to configure termination resistor: %s", err)
+		return
+	}
 	if !set {
 		clog.Info("Termination resistor disabled.")
 	} else {
@@ -70,16 +81,38 @@ func (nci *NocanNetworkController) SetTerminationResistor(set bool) {
 	}
 }
 
-func (nc *NocanNetworkController) AutoPowerOffOnTermination(set bool) {
-	if !set {
-		return
-	}
+// ShutdownOnTermination makes the server exit cleanly on SIGINT or SIGTERM:
+// the bus is powered down if power_off is set, and Shutdown() saves and
+// closes the files written by the server.
+func (nc *NocanNetworkController) ShutdownOnTermination(power_off bool) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-c
-		nc.SetPower(false)
-		clog.Info("Powering the bus down after receiving %s signal from OS.", sig)
+		if power_off {
+			nc.SetPower(false)
+			clog.Info("Powering the bus down after receiving %s signal from OS.", sig)
+		} else {
+			clog.Info("Terminating after receiving %s signal from OS.", sig)
+		}
+		nc.Shutdown()
 		clog.Terminate(1)
 	}()
 }
+
+// Shutdown saves the channel cache and the retained channel values, whose
+// saves are otherwise delayed, and closes frame captures, node debug logs and
+// the current channel history segment. Only the first call has an effect.
+func (nc *NocanNetworkController) Shutdown() {
+	nc.shutdownOnce.Do(func() {
+		nc.CloseFrameRecorders()
+		nc.CloseNodeDebugLogs()
+		models.ChannelCacheSave()
+		if Channels.Retained != nil {
+			Channels.Retained.Save()
+		}
+		if Channels.History != nil {
+			Channels.History.Close()
+		}
+	})
+}
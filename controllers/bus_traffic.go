@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"time"
+)
+
+func resolveTraffic(event *socket.BusTrafficEvent, node_id nocan.NodeId, channel_id nocan.ChannelId, is_publish bool) {
+	if node := Nodes.Find(node_id); node != nil {
+		event.Udid = node.Udid
+	}
+	if is_publish {
+		if channel := Channels.Find(channel_id); channel != nil {
+			event.ChannelName = channel.Name
+		}
+	}
+}
+
+// monitorFrame sends a frame to clients that monitor bus traffic, if any.
+func (nc *NocanNetworkController) monitorFrame(dir can.Direction, frame *can.Frame) {
+	if !EventServer.Monitoring(socket.MONITOR_FRAMES) {
+		return
+	}
+	event := socket.NewBusFrameTrafficEvent(dir, time.Now(), frame)
+	if frame.IsExtended() && !frame.IsError() {
+		resolveTraffic(event, nocan.NodeId((frame.CanId>>21)&0x7F), nocan.ChannelId(frame.CanId&0xFFFF), (frame.CanId&nocan.NOCANID_MASK_SYSTEM) == 0)
+	}
+	EventServer.Broadcast(event, nil)
+}
+
+// monitorMessage sends a complete message to clients that monitor bus
+// traffic, if any.
+func (nc *NocanNetworkController) monitorMessage(dir can.Direction, msg *nocan.Message) {
+	if !EventServer.Monitoring(socket.MONITOR_MESSAGES) {
+		return
+	}
+	event := socket.NewBusMessageTrafficEvent(dir, time.Now(), msg)
+	resolveTraffic(event, msg.NodeId(), msg.ChannelId(), !msg.IsSystemMessage())
+	EventServer.Broadcast(event, nil)
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"time"
+)
+
+// handleChannelUnregister processes a SYS_CHANNEL_UNREGISTER message, which
+// carries the channel id on 2 bytes. The channel is only destroyed once every
+// node that registered it has unregistered it.
+func (nc *NocanNetworkController) handleChannelUnregister(node *models.Node, msg *nocan.Message) {
+	if msg.Dlc < 2 {
+		clog.Warning("SYS_CHANNEL_UNREGISTER: missing channel id in message from node %s", node)
+		nc.SendSystemMessage(node.Id, nocan.SYS_CHANNEL_UNREGISTER_ACK, 0xFF, nil)
+		return
+	}
+	channel_id := (nocan.ChannelId(msg.Data[0]) << 8) | nocan.ChannelId(msg.Data[1])
+
+	channel := Channels.Find(channel_id)
+	if channel == nil {
+		clog.Warning("SYS_CHANNEL_UNREGISTER: node %s refers to non-existing channel %d", node, channel_id)
+		nc.SendSystemMessage(node.Id, nocan.SYS_CHANNEL_UNREGISTER_ACK, 0xFF, nil)
+		return
+	}
+
+	found, remaining := channel.RemoveRegistrant(node.Id)
+	if !found {
+		clog.Warning("SYS_CHANNEL_UNREGISTER: node %s did not register channel '%s' (id=%d)", node, channel.Name, channel_id)
+		nc.SendSystemMessage(node.Id, nocan.SYS_CHANNEL_UNREGISTER_ACK, 0xFF, nil)
+		return
+	}
+	nc.SendSystemMessage(node.Id, nocan.SYS_CHANNEL_UNREGISTER_ACK, 0x00, nil)
+
+	if remaining > 0 {
+		clog.Info("Node %s unregistered channel '%s' (id=%d), still registered by %d node(s)", node, channel.Name, channel_id, remaining)
+		return
+	}
+	if !Channels.Unregister(channel) {
+		return
+	}
+	Subscriptions.ClearChannel(channel_id)
+	clog.Info("Node %s unregistered channel '%s' (id=%d), channel destroyed", node, channel.Name, channel_id)
+	EventServer.Broadcast(socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_DESTROYED, nil, time.Now()), nil)
+}
+
+// newChannelContentEvent returns a CHANNEL_UPDATED event with the current
+// value of a channel, which is flagged if it is stale.
+func newChannelContentEvent(channel *models.Channel) *socket.ChannelUpdateEvent {
+	value, updated_at, stale := channel.Snapshot()
+	cu := socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_UPDATED, value, updated_at)
+	cu.Stale = stale
+	return cu
+}
+
+// republishRetainedValue publishes the value of a channel on the bus again
+// when a node subscribes to it, typically after a reset, if the retained
+// store selects it. Waiting for the subscription rather than the registration
+// ensures that the node is ready to receive the value.
+func (nc *NocanNetworkController) republishRetainedValue(node *models.Node, channel *models.Channel) {
+	if Channels.Retained == nil || !Channels.Retained.Republishes(channel.Name) {
+		return
+	}
+	value := channel.GetContent()
+	if value == nil {
+		return
+	}
+	clog.Info("Publishing retained value %q of channel '%s' (id=%d) again for node %s", value, channel.Name, channel.Id, node)
+	nc.Publish(0, channel.Id, value)
+}
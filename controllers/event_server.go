@@ -12,6 +12,15 @@ import (
 var EventServer *socket.Server
 var SystemProperties *properties.Properties = properties.New()
 
+// DEFAULT_HISTORY_QUERY_LIMIT is the number of values returned for a channel
+// history request that sets no limit, and MAX_HISTORY_QUERY_LIMIT caps the
+// limit a request can set, so that a request does not read the whole history
+// kept on disk.
+const (
+	DEFAULT_HISTORY_QUERY_LIMIT = 1024
+	MAX_HISTORY_QUERY_LIMIT     = 8192
+)
+
 func clientChannelUpdateRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
 	var channel *models.Channel
 
@@ -29,7 +38,7 @@ func clientChannelUpdateRequestHandler(c *socket.ClientDescriptor, e socket.Even
 		return err
 	}
 
-	return c.SendEvent(socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_UPDATED, channel.Value, channel.UpdatedAt))
+	return c.SendEvent(newChannelContentEvent(channel))
 }
 
 func clientChannelUpdateHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
@@ -45,8 +54,12 @@ func clientChannelUpdateHandler(c *socket.ClientDescriptor, e socket.Eventer) er
 				clog.Warning("Channel creation error for (%d, %s): %s", cu.ChannelId, cu.ChannelName, err)
 				return c.SendAck(socket.ServerAckGeneralFailure)
 			}
+			channel.AddRegistrant(0)
 			clog.DebugXX("Broadcasting channel creation for %s", cu.ChannelName)
 			EventServer.Broadcast(socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_CREATED, nil, cu.UpdatedAt), c)
+			if channel.IsStale() {
+				EventServer.Broadcast(newChannelContentEvent(channel), nil)
+			}
 		}
 		return c.SendAck(socket.ServerAckSuccess)
 	} else {
@@ -63,18 +76,22 @@ func clientChannelUpdateHandler(c *socket.ClientDescriptor, e socket.Eventer) er
 		}
 
 		if cu.Status == socket.CHANNEL_UPDATED {
-			channel.SetContent(cu.Value)
+			Channels.SetContent(channel, cu.Value)
 			Bus.Publish(0, channel.Id, cu.Value)
+			Subscriptions.Publish(0, channel.Id)
 			clog.DebugXX("Broadcasting channel update on %s: %q", cu.ChannelName, cu.Value)
 			EventServer.Broadcast(socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_UPDATED, cu.Value, cu.UpdatedAt), c)
 			clog.DebugXX("Sending ack for channel update on %s: %q", cu.ChannelName, cu.Value)
 			return c.SendAck(socket.ServerAckSuccess)
 		}
 		if cu.Status == socket.CHANNEL_DESTROYED {
-			if !Channels.Unregister(channel) {
+			if !Channels.Delete(channel) {
 				clog.Warning("Could not unregister channel %s", cu.ChannelName)
 				return c.SendAck(socket.ServerAckGeneralFailure)
 			}
+			Subscriptions.ClearChannel(channel.Id)
+			EventServer.Broadcast(socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_DESTROYED, nil, time.Now()), c)
+			return c.SendAck(socket.ServerAckSuccess)
 		}
 	}
 	return c.SendAck(socket.ServerAckGeneralFailure)
@@ -83,7 +100,7 @@ func clientChannelUpdateHandler(c *socket.ClientDescriptor, e socket.Eventer) er
 func clientChannelListRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
 	cl := socket.NewChannelListEvent()
 	Channels.EachOrdered(func(c *models.Channel) {
-		cl.Append(socket.NewChannelUpdateEvent(c.Name, c.Id, socket.CHANNEL_UPDATED, c.Value, c.UpdatedAt))
+		cl.Append(newChannelContentEvent(c))
 	})
 	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
 		return err
@@ -101,7 +118,7 @@ func clientNodeUpdateRequestHandler(c *socket.ClientDescriptor, e socket.Eventer
 	if node == nil {
 		nu = socket.NewNodeUpdateEventWithParams(nur.NodeId, models.NodeStateUnknown, models.NullUdid8, time.Unix(0, 0))
 	} else {
-		nu = socket.NewNodeUpdateEventWithParams(nur.NodeId, node.State, node.Udid, node.LastSeen)
+		nu = Bus.newNodeUpdateEvent(node)
 	}
 	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
 		return err
@@ -109,10 +126,36 @@ func clientNodeUpdateRequestHandler(c *socket.ClientDescriptor, e socket.Eventer
 	return c.SendEvent(nu)
 }
 
+func clientNodeLookupRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
+	nl := e.(*socket.NodeLookupRequestEvent)
+
+	var node *models.Node
+	if nl.Udid != models.NullUdid8 {
+		node = Nodes.Lookup(nl.Udid)
+	} else {
+		node = Nodes.Find(nl.NodeId)
+	}
+	if node == nil {
+		return c.SendAck(socket.ServerAckNotFound)
+	}
+	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
+		return err
+	}
+	return c.SendEvent(Bus.newNodeUpdateEvent(node))
+}
+
 func clientNodeListRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
+	nlr := e.(*socket.NodeListRequestEvent)
+
 	nl := socket.NewNodeListEvent()
 	Nodes.Each(func(n *models.Node) {
-		nl.Append(socket.NewNodeUpdateEventWithParams(n.Id, n.State, n.Udid, n.LastSeen))
+		state, last_seen := n.Status()
+		nu := socket.NewNodeUpdateEventWithParams(n.Id, state, n.Udid, last_seen)
+		if nlr.WithStatistics {
+			stats := Bus.NodeStatistics(n.Id)
+			nu.Statistics = &stats
+		}
+		nl.Append(nu)
 	})
 	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
 		return err
@@ -120,6 +163,19 @@ func clientNodeListRequestHandler(c *socket.ClientDescriptor, e socket.Eventer)
 	return c.SendEvent(nl)
 }
 
+func clientNodeStatisticsRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
+	nsr := e.(*socket.NodeStatisticsRequestEvent)
+
+	if nsr.NodeId < 0 {
+		return c.SendAck(socket.ServerAckBadRequest)
+	}
+	stats := Bus.NodeStatistics(nsr.NodeId)
+	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
+		return err
+	}
+	return c.SendEvent(socket.NewNodeStatisticsEvent(nsr.NodeId, &stats))
+}
+
 func clientFirmwareUploadHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
 	firmware := e.(*socket.NodeFirmwareEvent)
 
@@ -139,32 +195,32 @@ func clientFirmwareUploadHandler(c *socket.ClientDescriptor, e socket.Eventer) e
 
 	progress := socket.NewNodeFirmwareProgressEvent(firmware.NodeId)
 
-	Bus.nodeContexts[node.Id].pendingFirmwareOperation = NewNodeFirmwareOperation(c, NODE_OP_UPLOAD_FLASH, progress, firmware)
+	Bus.setPendingFirmwareOperation(node.Id, NewNodeFirmwareOperation(c, NODE_OP_UPLOAD_FLASH, progress, firmware))
 	if err := Bus.SendSystemMessage(node.Id, nocan.SYS_NODE_BOOT_REQUEST, 0x01, nil); err != nil {
 		clog.Warning("Boot request for node %d firmware upload failed: %s", firmware.NodeId, err)
 		return c.SendAck(socket.ServerAckGeneralFailure)
 	}
-	progress.Update(0, 0)
 	return c.SendAck(socket.ServerAckSuccess)
 }
 
 func clientFirmwareDownloadRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
-	firmware := e.(*socket.NodeFirmwareEvent)
+	request := e.(*socket.NodeFirmwareDownloadRequestEvent)
 
-	node := Nodes.Find(firmware.NodeId)
+	node := Nodes.Find(request.NodeId)
 	if node == nil {
-		clog.Warning("Node firmware download request failed: node %d does not exist", firmware.NodeId)
+		clog.Warning("Node firmware download request failed: node %d does not exist", request.NodeId)
 		return c.SendAck(socket.ServerAckNotFound)
 	}
 
-	progress := socket.NewNodeFirmwareProgressEvent(firmware.NodeId)
+	// The downloaded code is sent back in this event.
+	firmware := socket.NewNodeFirmwareEvent(request.NodeId).ConfigureAsDownload()
+	progress := socket.NewNodeFirmwareProgressEvent(request.NodeId)
 
-	Bus.nodeContexts[node.Id].pendingFirmwareOperation = NewNodeFirmwareOperation(c, NODE_OP_DOWNLOAD_FLASH, progress, firmware)
+	Bus.setPendingFirmwareOperation(node.Id, NewNodeFirmwareOperation(c, NODE_OP_DOWNLOAD_FLASH, progress, firmware))
 	if err := Bus.SendSystemMessage(node.Id, nocan.SYS_NODE_BOOT_REQUEST, 0x01, nil); err != nil {
 		clog.Warning("Boot request for node %d firmware download failed: %s", firmware.NodeId, err)
 		return c.SendAck(socket.ServerAckGeneralFailure)
 	}
-	progress.Update(0, 0)
 	return c.SendAck(socket.ServerAckSuccess)
 }
 
@@ -210,7 +266,118 @@ func clientSystemPropertiesRequestHandler(c *socket.ClientDescriptor, e socket.E
 	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
 		return err
 	}
-	return c.SendEvent(socket.NewSystemPropertiesEvent(SystemProperties))
+	props := properties.New()
+	for k, v := range SystemProperties.Map {
+		props.Map[k] = v
+	}
+	if Bus != nil {
+		Bus.TxScheduler.AddProperties(props)
+		Bus.AddPingProperties(props)
+	}
+	unconsumed := uint32(0)
+	for _, cs := range Subscriptions.List() {
+		if cs.Unconsumed() {
+			unconsumed++
+		}
+	}
+	props.AddUint32("channels_unconsumed", unconsumed)
+	return c.SendEvent(socket.NewSystemPropertiesEvent(props))
+}
+
+func clientSubscriptionListRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
+	slr := e.(*socket.SubscriptionListRequestEvent)
+
+	sl := socket.NewSubscriptionListEvent()
+	for _, cs := range Subscriptions.List() {
+		if slr.Matches(cs) {
+			sl.Append(cs)
+		}
+	}
+	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
+		return err
+	}
+	return c.SendEvent(sl)
+}
+
+func clientNodeDebugRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
+	ndr := e.(*socket.NodeDebugRequestEvent)
+
+	var nodes []*models.Node
+	if ndr.NodeId == nocan.UNDEFINED_NODE {
+		Nodes.Each(func(node *models.Node) {
+			nodes = append(nodes, node)
+		})
+	} else {
+		node := Nodes.Find(ndr.NodeId)
+		if node == nil {
+			return c.SendAck(socket.ServerAckNotFound)
+		}
+		nodes = append(nodes, node)
+	}
+
+	if (ndr.Debug & socket.NODE_DEBUG_STREAM) != 0 {
+		c.SetDebugFilter(ndr)
+	} else {
+		c.SetDebugFilter(nil)
+	}
+	clog.Debug("Client %s node debug set to %s", c.Name(), ndr)
+
+	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
+		return err
+	}
+	if (ndr.Debug & socket.NODE_DEBUG_HISTORY) != 0 {
+		for _, node := range nodes {
+			for _, line := range node.DebugLog.Lines() {
+				if err := c.SendEvent(socket.NewNodeDebugEvent(node.Id, line)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func clientChannelHistoryRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
+	chr := e.(*socket.ChannelHistoryRequestEvent)
+
+	if Channels.History == nil {
+		clog.Warning("Channel history request failed: channel history is disabled")
+		return c.SendAck(socket.ServerAckGeneralFailure)
+	}
+
+	// The history of a channel that is not registered yet can still be read
+	// by name.
+	name, id := chr.ChannelName, nocan.UNDEFINED_CHANNEL
+	if name == "" {
+		channel := Channels.Find(chr.ChannelId)
+		if channel == nil {
+			return c.SendAck(socket.ServerAckNotFound)
+		}
+		name, id = channel.Name, channel.Id
+	} else if channel := Channels.Lookup(name); channel != nil {
+		id = channel.Id
+	}
+
+	limit := int(chr.Limit)
+	if limit == 0 {
+		limit = DEFAULT_HISTORY_QUERY_LIMIT
+	} else if limit > MAX_HISTORY_QUERY_LIMIT {
+		limit = MAX_HISTORY_QUERY_LIMIT
+	}
+
+	entries := Channels.History.Query(name, models.HistoryQuery{From: chr.From, To: chr.To, Limit: limit, Step: chr.Step})
+	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
+		return err
+	}
+	return c.SendEvent(socket.NewChannelHistoryEvent(name, id, entries))
+}
+
+func clientBusHealthRequestHandler(c *socket.ClientDescriptor, e socket.Eventer) error {
+	if err := c.SendAck(socket.ServerAckSuccess); err != nil {
+		return err
+	}
+	health := Bus.Health()
+	return c.SendEvent(socket.NewBusHealthEvent(&health))
 }
 
 func init() {
@@ -220,6 +387,9 @@ func init() {
 	EventServer.RegisterHandler(socket.ChannelListRequestEventId, clientChannelListRequestHandler)
 	EventServer.RegisterHandler(socket.NodeUpdateRequestEventId, clientNodeUpdateRequestHandler)
 	EventServer.RegisterHandler(socket.NodeListRequestEventId, clientNodeListRequestHandler)
+	EventServer.RegisterHandler(socket.NodeLookupRequestEventId, clientNodeLookupRequestHandler)
+	EventServer.RegisterHandler(socket.ChannelHistoryRequestEventId, clientChannelHistoryRequestHandler)
+	EventServer.RegisterHandler(socket.NodeStatisticsRequestEventId, clientNodeStatisticsRequestHandler)
 	EventServer.RegisterHandler(socket.NodeFirmwareEventId, clientFirmwareUploadHandler)
 	EventServer.RegisterHandler(socket.NodeFirmwareDownloadRequestEventId, clientFirmwareDownloadRequestHandler)
 	EventServer.RegisterHandler(socket.NodeRebootRequestEventId, clientNodeRebootRequestHandler)
@@ -227,4 +397,7 @@ func init() {
 	EventServer.RegisterHandler(socket.BusPowerStatusUpdateRequestEventId, clientBusPowerUpdateRequestHandler)
 	EventServer.RegisterHandler(socket.DeviceInformationRequestEventId, clientDeviceInformationRequestHandler)
 	EventServer.RegisterHandler(socket.SystemPropertiesRequestEventId, clientSystemPropertiesRequestHandler)
+	EventServer.RegisterHandler(socket.BusHealthRequestEventId, clientBusHealthRequestHandler)
+	EventServer.RegisterHandler(socket.SubscriptionListRequestEventId, clientSubscriptionListRequestHandler)
+	EventServer.RegisterHandler(socket.NodeDebugRequestEventId, clientNodeDebugRequestHandler)
 }
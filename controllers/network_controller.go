@@ -7,22 +7,35 @@ import (
 	"github.com/omzlo/nocand/models/can"
 	"github.com/omzlo/nocand/models/device"
 	"github.com/omzlo/nocand/models/nocan"
-	"github.com/omzlo/nocand/models/rpi"
 	"github.com/omzlo/nocand/socket"
+	"io"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
-var Bus *NocanNetworkController = NewNocanNetworkController()
+var Bus *NocanNetworkController
 var Nodes *models.NodeCollection = models.NewNodeCollection()
 var Channels *models.ChannelCollection = models.NewChannelCollection()
+var Subscriptions *models.SubscriptionTable = models.NewSubscriptionTable()
 var PingerEnabled = false
 
+// NodeContext
 //
-//
-//
+// The reassembly fields are only used by Serve(), statistics and ping
+// measurements are protected by statisticsMutex and the other fields by
+// contextMutex.
 type NodeContext struct {
 	pendingMessage           *nocan.Message
+	pendingSince             time.Time
+	pendingFrames            uint32
+	overflowing              bool
+	statistics               models.NodeStatistics
+	pingSentAt               time.Time
+	rttSum                   time.Duration
+	lastRtt                  time.Duration
+	jitter                   time.Duration
 	pendingFirmwareOperation *NodeFirmwareOperation
 	inputQueue               chan *nocan.Message
 	terminateSignal          chan bool
@@ -31,19 +44,123 @@ type NodeContext struct {
 
 type NocanNetworkController struct {
 	nodeContexts [128]NodeContext
+	Driver       device.Driver
 	DeviceInfo   *device.Information
+	TxScheduler  *TxScheduler
+	recorders    []can.FrameRecorder
+	// Automatic recovery actions, 0 disables them.
+	BusOffResetThreshold     uint
+	FaultPowerCycleThreshold uint
+	NodeQueueDepth           int
+	NodeQueueOverflow        OverflowPolicy
+	NodeEvictionDelay        time.Duration
+	NodeDebugLogDir          string
+	healthMutex              sync.Mutex
+	health                   device.BusHealth
+	busOffStreak             uint
+	faultStreak              uint
+	driverError              bool
+	statisticsMutex          sync.Mutex
+	contextMutex             sync.Mutex
+	debugFiles               map[models.Udid8]*os.File
+	debugFilesMutex          sync.Mutex
+	shutdownOnce             sync.Once
+}
+
+func NewNocanNetworkController(driver device.Driver) *NocanNetworkController {
+	nc := &NocanNetworkController{Driver: driver, NodeQueueDepth: DEFAULT_NODE_QUEUE_DEPTH, NodeQueueOverflow: DROP_OLDEST}
+	nc.health.ChangedAt = time.Now()
+	nc.TxScheduler = NewTxScheduler(nc.transmitMessage)
+	return nc
+}
+
+// AddFrameRecorder registers a capture writer that will receive every frame
+// sent or received by the controller. It must be called before Serve().
+func (nc *NocanNetworkController) AddFrameRecorder(recorder can.FrameRecorder) {
+	nc.recorders = append(nc.recorders, recorder)
+}
+
+func (nc *NocanNetworkController) CloseFrameRecorders() {
+	for _, recorder := range nc.recorders {
+		if err := recorder.Close(); err != nil {
+			clog.Warning("Failed to close frame capture: %s", err)
+		}
+	}
+}
+
+func (nc *NocanNetworkController) recordFrame(dir can.Direction, frame *can.Frame) {
+	if len(nc.recorders) > 0 {
+		now := time.Now()
+		for _, recorder := range nc.recorders {
+			recorder.RecordFrame(dir, now, frame)
+		}
+	}
 }
 
-func NewNocanNetworkController() *NocanNetworkController {
-	return &NocanNetworkController{}
+// nodeQueue returns the input queue of a node, and tells if the node has a
+// running goroutine.
+func (nc *NocanNetworkController) nodeQueue(nodeId nocan.NodeId) (chan *nocan.Message, bool) {
+	nc.contextMutex.Lock()
+	defer nc.contextMutex.Unlock()
+
+	return nc.nodeContexts[nodeId].inputQueue, nc.nodeContexts[nodeId].running
+}
+
+// startNode creates a new input queue for a node and starts the goroutine
+// that processes it. The goroutine of a previous registration, if any, is
+// asked to terminate.
+func (nc *NocanNetworkController) startNode(node *models.Node) {
+	nc.contextMutex.Lock()
+	context := &nc.nodeContexts[node.Id]
+	if context.running {
+		close(context.terminateSignal)
+	}
+	context.running = true
+	context.inputQueue = nc.newInputQueue()
+	context.terminateSignal = make(chan bool)
+	inputQueue := context.inputQueue
+	terminateSignal := context.terminateSignal
+	nc.contextMutex.Unlock()
+
+	go nc.handleBusNode(node, inputQueue, terminateSignal)
+}
+
+// stopNode asks the goroutine of a node to terminate. Frames received for
+// that node id are then discarded until a node registers with it again.
+func (nc *NocanNetworkController) stopNode(nodeId nocan.NodeId) {
+	nc.contextMutex.Lock()
+	defer nc.contextMutex.Unlock()
+
+	context := &nc.nodeContexts[nodeId]
+	if context.running {
+		close(context.terminateSignal)
+		context.running = false
+		context.inputQueue = nil
+	}
+}
+
+func (nc *NocanNetworkController) setPendingFirmwareOperation(nodeId nocan.NodeId, op *NodeFirmwareOperation) {
+	nc.contextMutex.Lock()
+	defer nc.contextMutex.Unlock()
+
+	nc.nodeContexts[nodeId].pendingFirmwareOperation = op
+}
+
+func (nc *NocanNetworkController) takePendingFirmwareOperation(nodeId nocan.NodeId) *NodeFirmwareOperation {
+	nc.contextMutex.Lock()
+	defer nc.contextMutex.Unlock()
+
+	op := nc.nodeContexts[nodeId].pendingFirmwareOperation
+	nc.nodeContexts[nodeId].pendingFirmwareOperation = nil
+	return op
 }
 
 func (nc *NocanNetworkController) ReceiveMessage(nodeId nocan.NodeId) (*nocan.Message, error) {
-	msg, more := <-nc.nodeContexts[nodeId].inputQueue
-	if more {
-		return msg, nil
+	inputQueue, _ := nc.nodeQueue(nodeId)
+	if inputQueue == nil {
+		return nil, fmt.Errorf("Receive message failed for node %d", nodeId)
 	}
-	return nil, fmt.Errorf("Receive message failed for node %d", nodeId)
+	return <-inputQueue, nil
 }
 
 const DEFAULT_EXPECT_TIMEOUT = 3 * time.Second
@@ -52,8 +169,10 @@ func (nc *NocanNetworkController) ExpectSystemMessage(node *models.Node, fn noca
 	ticker := time.NewTicker(DEFAULT_EXPECT_TIMEOUT)
 	defer ticker.Stop()
 
+	inputQueue, _ := nc.nodeQueue(node.Id)
+
 	select {
-	case msg := <-nc.nodeContexts[node.Id].inputQueue:
+	case msg := <-inputQueue:
 		if msg.IsSystemMessage() {
 			rfn, _ := msg.SystemFunctionParam()
 			if rfn == fn {
@@ -68,11 +187,18 @@ func (nc *NocanNetworkController) ExpectSystemMessage(node *models.Node, fn noca
 	}
 }
 
+// SendMessage queues a message in the transmit scheduler and waits until it
+// has been handed to the driver.
 func (nc *NocanNetworkController) SendMessage(msg *nocan.Message) error {
+	return nc.TxScheduler.Send(msg)
+}
+
+func (nc *NocanNetworkController) transmitMessage(msg *nocan.Message) error {
 	var frame can.Frame
 	var pos uint8
 
 	clog.DebugX("** Sending %s **", msg)
+	nc.monitorMessage(can.FRAME_TX, msg)
 	pos = 0
 	for {
 		frame.CanId = msg.CanId | can.CANID_MASK_EXTENDED
@@ -86,9 +212,11 @@ func (nc *NocanNetworkController) SendMessage(msg *nocan.Message) error {
 			frame.CanId |= nocan.NOCANID_MASK_LAST
 		}
 		copy(frame.Data[:], msg.Data[pos:pos+frame.Dlc])
-		if err := rpi.DriverSendCanFrame(frame); err != nil {
+		if err := nc.Driver.SendFrame(&frame); err != nil {
 			return err
 		}
+		nc.recordFrame(can.FRAME_TX, &frame)
+		nc.monitorFrame(can.FRAME_TX, &frame)
 		pos += frame.Dlc
 		if pos >= msg.Dlc {
 			break
@@ -107,33 +235,93 @@ func (nc *NocanNetworkController) Publish(node nocan.NodeId, channel nocan.Chann
 	return nc.SendMessage(msg)
 }
 
+// MAX_RECOVERY_PING_INTERVAL caps the delay between two pings sent to an
+// unresponsive node.
+const MAX_RECOVERY_PING_INTERVAL = 5 * time.Minute
+
+// recoveryPing schedules the pings sent to an unresponsive node.
+type recoveryPing struct {
+	next  time.Time
+	delay time.Duration
+}
+
 func (nc *NocanNetworkController) pinger(interval time.Duration) {
-	var dequeue []*models.Node
+	var lost, evicted []*models.Node
+	recovery := make(map[*models.Node]*recoveryPing)
+
 	for {
-		dequeue = nil
+		lost = nil
+		evicted = nil
+		now := time.Now()
+		unresponsive := make(map[*models.Node]bool)
 
 		Nodes.Each(func(node *models.Node) {
-			if node.FirmwareVersion >= 3 && node.State == models.NodeStateConnected {
-				inactivity := time.Since(node.LastSeen)
+			if node.GetFirmwareVersion() < 3 {
+				return
+			}
+			state, last_seen := node.Status()
+			inactivity := now.Sub(last_seen)
+			if nodeIsActive(state) {
 				if inactivity > interval*2 {
-					dequeue = append(dequeue, node)
+					lost = append(lost, node)
 				} else if inactivity >= interval {
-					nc.SendSystemMessage(node.Id, nocan.SYS_NODE_PING, 0, nil)
+					nc.sendPing(node.Id)
+				}
+			} else if state == models.NodeStateUnresponsive {
+				unresponsive[node] = true
+				if inactivity > nc.NodeEvictionDelay {
+					evicted = append(evicted, node)
+				} else if r := recovery[node]; r == nil {
+					recovery[node] = &recoveryPing{next: now.Add(interval), delay: interval}
+				} else if now.After(r.next) {
+					nc.sendPing(node.Id)
+					r.delay *= 2
+					if r.delay > MAX_RECOVERY_PING_INTERVAL {
+						r.delay = MAX_RECOVERY_PING_INTERVAL
+					}
+					r.next = now.Add(r.delay)
 				}
 			}
 		})
-		for _, node := range dequeue {
-			clog.Info("Unregistering node %s due to unresponsiveness. Last seen at %s", node, node.LastSeen)
-			node.State = models.NodeStateUnresponsive
-			EventServer.Broadcast(socket.NewNodeUpdateEventWithParams(node.Id, node.State, node.Udid, node.LastSeen), nil)
-			if !Nodes.Unregister(node) {
-				clog.Error("Failed to unregister node %d.", node.Id)
+		for node := range recovery {
+			if !unresponsive[node] {
+				delete(recovery, node)
 			}
 		}
+		for _, node := range lost {
+			if nc.setNodeState(node, models.NodeStateUnresponsive) {
+				_, last_seen := node.Status()
+				clog.Warning("Node %s is unresponsive. Last seen at %s", node, last_seen)
+				for _, transition := range node.History() {
+					clog.Debug("Node %s history: %s", node, transition)
+				}
+			}
+			if nc.NodeEvictionDelay <= 0 {
+				evicted = append(evicted, node)
+			}
+		}
+		for _, node := range evicted {
+			nc.evictNode(node)
+			delete(recovery, node)
+		}
 		time.Sleep(interval / 3)
 	}
 }
 
+// evictNode unregisters a node, stops its goroutine and resets its
+// statistics.
+func (nc *NocanNetworkController) evictNode(node *models.Node) {
+	_, last_seen := node.Status()
+	clog.Info("Unregistering node %s due to unresponsiveness. Last seen at %s", node, last_seen)
+	nc.stopNode(node.Id)
+	if !Nodes.Unregister(node) {
+		clog.Error("Failed to unregister node %d.", node.Id)
+	}
+	Subscriptions.ClearNode(node.Id)
+	nc.resetStatistics(node.Id)
+	EventServer.Broadcast(socket.NewNodeUpdateEventWithParams(node.Id, models.NodeStateUnknown, node.Udid, last_seen), nil)
+}
+
 func (nc *NocanNetworkController) RunPinger(interval time.Duration) {
 	if interval > 0 {
 		PingerEnabled = true
@@ -147,21 +335,36 @@ func (nc *NocanNetworkController) RunPinger(interval time.Duration) {
 
 func (nc *NocanNetworkController) Serve() error {
 
+	nc.contextMutex.Lock()
 	nc.nodeContexts[0].running = true
-	nc.nodeContexts[0].inputQueue = make(chan *nocan.Message, 16)
+	nc.nodeContexts[0].inputQueue = nc.newInputQueue()
 	nc.nodeContexts[0].terminateSignal = make(chan bool)
+	masterQueue := nc.nodeContexts[0].inputQueue
+	nc.contextMutex.Unlock()
 
-	models.NodeCacheLoad()
-
-	go nc.handleMasterNode()
+	go nc.handleMasterNode(masterQueue)
 
 	for {
-		frame := <-rpi.CanRxChannel
+		frame, err := nc.Driver.RecvFrame()
+		if err == io.EOF {
+			clog.Info("Driver has no more frames to deliver.")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		nc.recordFrame(can.FRAME_RX, frame)
+		nc.monitorFrame(can.FRAME_RX, frame)
 
 		clog.DebugXX("RECV FRAME %s", frame)
 
 		nodeId := (frame.CanId >> 21) & 0x7F
 
+		if frame.IsError() {
+			nc.handleErrorFrame(frame)
+			continue
+		}
+
 		if !frame.IsExtended() {
 			clog.Warning("Frame %s is not an extended CAN frame, discarding.", frame)
 			continue
@@ -172,38 +375,28 @@ func (nc *NocanNetworkController) Serve() error {
 			continue
 		}
 
-		if !nc.nodeContexts[nodeId].running { // sending message from an unregistered node?
+		inputQueue, running := nc.nodeQueue(nocan.NodeId(nodeId))
+		if !running { // sending message from an unregistered node?
 			clog.Warning("Got a frame %s from unknown node %d, dicarding.", frame, nodeId)
+			nc.updateStatistics(nocan.NodeId(nodeId), func(stats *models.NodeStatistics) {
+				stats.UnknownNodeFrames++
+				stats.DroppedFrames++
+			})
 			continue
 		}
 
-		if (frame.CanId & nocan.NOCANID_MASK_FIRST) != 0 {
-			if nc.nodeContexts[nodeId].pendingMessage != nil {
-				clog.Warning("Got frame %s with inconsistent first bit indicator, discarding.", frame)
-				continue
-			}
-			nc.nodeContexts[nodeId].pendingMessage = nocan.NewMessage(frame.CanId, frame.Data[:frame.Dlc])
-		} else {
-			if nc.nodeContexts[nodeId].pendingMessage == nil {
-				clog.Warning("Got first frame %s with missing first bit indicator, discarding.", frame)
-				continue
-			}
-			nc.nodeContexts[nodeId].pendingMessage.AppendData(frame.Data[:frame.Dlc])
-		}
-
-		if (frame.CanId & nocan.NOCANID_MASK_LAST) != 0 {
-			msg := nc.nodeContexts[nodeId].pendingMessage
+		if msg := nc.reassemble(nocan.NodeId(nodeId), frame); msg != nil {
 			clog.Debug("** Received %s **", msg)
-			nc.nodeContexts[nodeId].inputQueue <- msg
-			nc.nodeContexts[nodeId].pendingMessage = nil // clear
+			nc.monitorMessage(can.FRAME_RX, msg)
+			nc.dispatch(nocan.NodeId(nodeId), inputQueue, msg)
 		}
 	}
 }
 
-func (nc *NocanNetworkController) handleMasterNode() {
+func (nc *NocanNetworkController) handleMasterNode(inputQueue chan *nocan.Message) {
 MasterLoop:
 	for {
-		msg := <-nc.nodeContexts[0].inputQueue
+		msg := <-inputQueue
 
 		fn, param := msg.SystemFunctionParam()
 		switch nocan.MessageType(fn) {
@@ -222,16 +415,16 @@ MasterLoop:
 			node.SetAttribute("ID", strconv.Itoa(int(node.Id)))
 			node.SetAttribute("UDID", udid.String())
 
-			if nc.nodeContexts[node.Id].running {
-				// terminate existing goroutine
-				nc.nodeContexts[node.Id].terminateSignal <- true
-			}
-			nc.nodeContexts[node.Id].running = true
-			nc.nodeContexts[node.Id].inputQueue = make(chan *nocan.Message, 16)
-			nc.nodeContexts[node.Id].terminateSignal = make(chan bool)
-			go nc.handleBusNode(node)
+			// A node that requests an address has been reset and will subscribe again.
+			Subscriptions.ClearNode(node.Id)
+			node.DebugLog.Restart()
+			nc.setNodeState(node, models.NodeStateConnecting)
+			nc.startNode(node)
 			nc.SendSystemMessage(0, nocan.SYS_ADDRESS_CONFIGURE, uint8(node.Id), msg.Bytes())
 
+		case nocan.SYS_ADDRESS_LOOKUP:
+			nc.handleAddressLookup(0, msg)
+
 		default:
 			clog.Warning("Got unexpected message with null node id: %s", msg)
 		}
@@ -239,11 +432,7 @@ MasterLoop:
 	}
 }
 
-func (nc *NocanNetworkController) handleBusNode(node *models.Node) {
-
-	inputQueue := nc.nodeContexts[node.Id].inputQueue
-	terminateSignal := nc.nodeContexts[node.Id].terminateSignal
-
+func (nc *NocanNetworkController) handleBusNode(node *models.Node, inputQueue chan *nocan.Message, terminateSignal chan bool) {
 	for {
 		select {
 		case msg := <-inputQueue:
@@ -255,8 +444,7 @@ func (nc *NocanNetworkController) handleBusNode(node *models.Node) {
 			node.Touch()
 
 		case <-terminateSignal:
-			close(inputQueue)
-			// close input queue and terminate goroutine
+			// Serve() may still hold the queue, so it is not closed.
 			return
 			// use a 'return': don't put a 'break' here, it will break from the select only.
 		}
@@ -266,33 +454,42 @@ func (nc *NocanNetworkController) handleBusNode(node *models.Node) {
 
 func (nc *NocanNetworkController) handleBusNodeMessage(node *models.Node, msg *nocan.Message) {
 
+	state, _ := node.Status()
+	if state == models.NodeStateUnresponsive {
+		clog.Info("Node %s is responding again", node)
+		nc.setNodeState(node, models.NodeStateConnected)
+	} else if state == models.NodeStateConnected && runsApplication(msg) {
+		nc.setNodeState(node, models.NodeStateRunning)
+	}
+
 	if msg.IsSystemMessage() {
 		/* Case 1: system message */
 
 		fn, _ := msg.SystemFunctionParam()
 		switch nocan.MessageType(fn) {
 		case nocan.SYS_ADDRESS_CONFIGURE_ACK:
-			node.State = models.NodeStateConnected
-			EventServer.Broadcast(socket.NewNodeUpdateEventWithParams(node.Id, node.State, node.Udid, node.LastSeen), nil)
+			nc.setNodeState(node, models.NodeStateConnected)
 
 		case nocan.SYS_NODE_BOOT_ACK:
-			node.State = models.NodeStateBootloader
-			pendingFirmwareOperation := nc.nodeContexts[node.Id].pendingFirmwareOperation
+			nc.setNodeState(node, models.NodeStateBootloader)
+			pendingFirmwareOperation := nc.takePendingFirmwareOperation(node.Id)
 			if pendingFirmwareOperation != nil {
 				switch pendingFirmwareOperation.Operation {
 				case NODE_OP_UPLOAD_FLASH:
 					clog.Info("Initiating firmware upload for node %s", node)
-					node.State = models.NodeStateProgramming
+					nc.setNodeState(node, models.NodeStateProgramming)
 					if err := uploadFirmware(node, pendingFirmwareOperation); err != nil {
 						clog.Warning("Firmware upload failed: %s", err)
+						nc.setNodeState(node, models.NodeStateBootloader)
 					} else {
 						clog.Info("Firmware upload succeeded for node %s", node)
 					}
 				case NODE_OP_DOWNLOAD_FLASH:
 					clog.Info("Initializing firmware dowload for node %s", node)
-					node.State = models.NodeStateProgramming
+					nc.setNodeState(node, models.NodeStateProgramming)
 					if err := downloadFirmware(node, pendingFirmwareOperation); err != nil {
 						clog.Warning("Firmware download failed: %s", err)
+						nc.setNodeState(node, models.NodeStateBootloader)
 					} else {
 						clog.Info("Firmware download succeeded for node %s", node)
 					}
@@ -302,13 +499,15 @@ func (nc *NocanNetworkController) handleBusNodeMessage(node *models.Node, msg *n
 				// accelerate boot by sending bootloader exit request
 				nc.SendSystemMessage(msg.NodeId(), nocan.SYS_BOOTLOADER_LEAVE, 0, nil)
 			}
-			nc.nodeContexts[node.Id].pendingFirmwareOperation = nil
 
 		case nocan.SYS_BOOTLOADER_LEAVE_ACK:
 			// Do nothing
 
 		case nocan.SYS_NODE_PING_ACK:
-			// Do nothing
+			nc.handlePingAck(node.Id)
+
+		case nocan.SYS_ADDRESS_LOOKUP:
+			nc.handleAddressLookup(node.Id, msg)
 
 		case nocan.SYS_CHANNEL_REGISTER:
 			channel_name := node.ExpandAttributes(msg.DataToString())
@@ -321,8 +520,12 @@ func (nc *NocanNetworkController) handleBusNodeMessage(node *models.Node, msg *n
 				nc.SendSystemMessage(msg.NodeId(), nocan.SYS_CHANNEL_REGISTER_ACK, 0xFF, nil)
 			} else {
 				clog.Info("Registered channel %s for node %d as %d", channel_name, msg.NodeId(), channel.Id)
+				channel.AddRegistrant(node.Id)
 				nc.SendSystemMessage(msg.NodeId(), nocan.SYS_CHANNEL_REGISTER_ACK, 0x00, channel.Id.ToBytes())
 				EventServer.Broadcast(socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_CREATED, nil, time.Now()), nil)
+				if channel.IsStale() {
+					EventServer.Broadcast(newChannelContentEvent(channel), nil)
+				}
 			}
 
 		case nocan.SYS_CHANNEL_LOOKUP:
@@ -339,6 +542,15 @@ func (nc *NocanNetworkController) handleBusNodeMessage(node *models.Node, msg *n
 				nc.SendSystemMessage(msg.NodeId(), nocan.SYS_CHANNEL_LOOKUP_ACK, 0xFF, nil)
 			}
 
+		case nocan.SYS_CHANNEL_UNREGISTER:
+			nc.handleChannelUnregister(node, msg)
+
+		case nocan.SYS_CHANNEL_SUBSCRIBE, nocan.SYS_CHANNEL_UNSUBSCRIBE:
+			nc.handleSubscription(node, msg)
+
+		case nocan.SYS_DEBUG_MESSAGE:
+			nc.handleDebugMessage(node, msg)
+
 		default:
 			clog.Warning("Message of type %s from node %s was not processed", nocan.MessageType(fn), node)
 		}
@@ -348,9 +560,15 @@ func (nc *NocanNetworkController) handleBusNodeMessage(node *models.Node, msg *n
 
 		channel := Channels.Find(msg.ChannelId())
 		if channel != nil {
+			if Subscriptions.Publish(node.Id, channel.Id) {
+				clog.Debug("Node %s publishes to channel '%s'", node, channel.Name)
+			}
 			clog.Info("Updated content of channel '%s' (id=%d) to %q", channel.Name, msg.ChannelId(), msg.Bytes())
-			channel.SetContent(msg.Bytes())
-			EventServer.Broadcast(socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_UPDATED, msg.Bytes(), channel.UpdatedAt), nil)
+			Channels.SetContent(channel, msg.Bytes())
+			value, updated_at := channel.Content()
+			EventServer.Broadcast(socket.NewChannelUpdateEvent(channel.Name, channel.Id, socket.CHANNEL_UPDATED, value, updated_at), nil)
+		} else if Channels.Quarantined(msg.ChannelId()) {
+			clog.Warning("Node %d published to channel %d, which was unregistered, ignoring.", msg.NodeId(), msg.ChannelId())
 		} else {
 			clog.Warning("Could not update non-existing channel %d for node %d", msg.ChannelId(), msg.NodeId())
 		}
@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/omzlo/go-sscp"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/models/simulator"
+	"github.com/omzlo/nocand/socket"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testAuthToken = "network-controller-test-token"
+	testNodeCount = 4
+	testDuration  = 2 * time.Second
+	testTimeout   = 15 * time.Second
+)
+
+// testClient is a minimal event client: it counts the events it receives,
+// and ignores the acknowledgements of its requests.
+type testClient struct {
+	conn         *sscp.Conn
+	sendMutex    sync.Mutex
+	msgId        uint16
+	mutex        sync.Mutex
+	updates      map[string]int
+	nodeUpdates  int
+	disconnected chan struct{}
+}
+
+func dialTestClient(addr string) (*testClient, error) {
+	conn, err := sscp.Dial("tcp", addr, []byte("test"), []byte(testAuthToken))
+	if err != nil {
+		return nil, err
+	}
+
+	hello := socket.NewClientHelloEvent("test", socket.HELLO_MAJOR, socket.HELLO_MINOR)
+	hello.SetMsgId(1)
+	if err := socket.EncodeEvent(conn, hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response, err := socket.DecodeEvent(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.Id() != socket.ServerHelloEventId {
+		conn.Close()
+		return nil, fmt.Errorf("Expected server-hello-event, got %s", response.Id())
+	}
+
+	c := &testClient{conn: conn, msgId: 1, updates: make(map[string]int), disconnected: make(chan struct{})}
+	go c.readEvents()
+	return c, nil
+}
+
+func (c *testClient) readEvents() {
+	defer close(c.disconnected)
+	for {
+		event, err := socket.DecodeEvent(c.conn)
+		if err != nil {
+			return
+		}
+		c.mutex.Lock()
+		switch e := event.(type) {
+		case *socket.ChannelUpdateEvent:
+			if e.Status == socket.CHANNEL_UPDATED {
+				c.updates[e.ChannelName]++
+			}
+		case *socket.NodeUpdateEvent:
+			c.nodeUpdates++
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func (c *testClient) send(event socket.Eventer) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	c.msgId++
+	if c.msgId == 0 {
+		c.msgId = 1
+	}
+	event.SetMsgId(c.msgId)
+	return socket.EncodeEvent(c.conn, event)
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+	<-c.disconnected
+}
+
+// counterUpdates returns the number of updates received for the counter
+// channels of the simulated nodes.
+func (c *testClient) counterUpdates() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	count := 0
+	for name, n := range c.updates {
+		if strings.HasSuffix(name, "/counter") {
+			count += n
+		}
+	}
+	return count
+}
+
+// lastRegistration returns the time of the last transition of a node to the
+// connecting state, which happens each time it requests an address.
+func lastRegistration(node *models.Node) time.Time {
+	var last time.Time
+	for _, transition := range node.History() {
+		if transition.To == models.NodeStateConnecting {
+			last = transition.At
+		}
+	}
+	return last
+}
+
+// waitForRunningNodes waits until count nodes run their application.
+func waitForRunningNodes(t *testing.T, count int) map[models.Udid8]nocan.NodeId {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		ids := make(map[models.Udid8]nocan.NodeId)
+		Nodes.Each(func(node *models.Node) {
+			if state, _ := node.Status(); state == models.NodeStateRunning {
+				ids[node.Udid] = node.Id
+			}
+		})
+		if len(ids) == count {
+			return ids
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d of %d nodes are running after %s", len(ids), count, testTimeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestNetworkControllerConcurrency runs the controller on a simulated bus,
+// with the pinger, concurrent clients publishing and listing channels and
+// nodes, clients connecting and disconnecting, and nodes rebooting and
+// registering again. It is meant to be run with -race.
+func TestNetworkControllerConcurrency(t *testing.T) {
+	var received int64
+
+	bus := simulator.NewBus()
+	for i := uint(0); i < testNodeCount; i++ {
+		node := simulator.NewNode(simulator.GenerateUdid(i + 1))
+		node.Channels = []string{"test/$(ID)/counter", "test/$(ID)/setpoint"}
+		node.Subscriptions = []string{"test/$(ID)/setpoint"}
+		node.PublishInterval = 20 * time.Millisecond
+		node.OnPublish = func(n *simulator.Node, channel string, value []byte) {
+			atomic.AddInt64(&received, 1)
+		}
+		bus.AddNode(node)
+	}
+
+	Bus = NewNocanNetworkController(bus)
+	Bus.NodeEvictionDelay = testTimeout
+	if err := Bus.Initialize(NO_BUS_RESET); err != nil {
+		t.Fatalf("Could not initialize the simulated bus: %s", err)
+	}
+	if err := EventServer.ListenAndServe("127.0.0.1:0", testAuthToken); err != nil {
+		t.Fatalf("Could not start the event server: %s", err)
+	}
+	addr := EventServer.Addr().String()
+
+	go func() {
+		if err := Bus.Serve(); err != nil {
+			t.Errorf("Serve failed: %s", err)
+		}
+	}()
+	Bus.SetPower(true)
+	Bus.RunPinger(50 * time.Millisecond)
+
+	ids := waitForRunningNodes(t, testNodeCount)
+
+	var clients []*testClient
+	for i := 0; i < 4; i++ {
+		c, err := dialTestClient(addr)
+		if err != nil {
+			t.Fatalf("Could not connect client %d: %s", i, err)
+		}
+		defer c.close()
+		clients = append(clients, c)
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	stop := start.Add(testDuration)
+
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *testClient) {
+			defer wg.Done()
+			for n := 0; time.Now().Before(stop); n++ {
+				var err error
+				switch n % 4 {
+				case 0:
+					err = c.send(socket.NewChannelListRequestEvent())
+				case 1:
+					err = c.send(socket.NewNodeListRequestEvent())
+				case 2:
+					node_id := nocan.NodeId(1 + n%testNodeCount)
+					name := fmt.Sprintf("test/%d/setpoint", node_id)
+					err = c.send(socket.NewChannelUpdateEvent(name, nocan.UNDEFINED_CHANNEL, socket.CHANNEL_UPDATED, []byte(fmt.Sprintf("%d-%d", i, n)), time.Now()))
+				case 3:
+					err = c.send(socket.NewNodeUpdateRequestEvent(nocan.NodeId(1 + n%testNodeCount)))
+				}
+				if err != nil {
+					t.Errorf("Client %d failed to send a request: %s", i, err)
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}(i, c)
+	}
+
+	// Short-lived clients connect and leave while events are broadcast.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(stop) {
+			c, err := dialTestClient(addr)
+			if err != nil {
+				t.Errorf("Could not connect a short-lived client: %s", err)
+				return
+			}
+			c.send(socket.NewChannelListRequestEvent())
+			time.Sleep(10 * time.Millisecond)
+			c.close()
+		}
+	}()
+
+	// Nodes reboot in turn, and register again with the same udid.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; time.Now().Before(stop); n++ {
+			node_id := nocan.NodeId(1 + n%testNodeCount)
+			if err := clients[0].send(socket.NewNodeRebootRequestEvent(node_id, false)); err != nil {
+				t.Errorf("Could not request a reboot of node %d: %s", node_id, err)
+				return
+			}
+			time.Sleep(testDuration / 8)
+		}
+	}()
+
+	wg.Wait()
+
+	for udid, id := range waitForRunningNodes(t, testNodeCount) {
+		if ids[udid] != id {
+			t.Errorf("Node %s registered again as N%d, expected N%d", udid, id, ids[udid])
+		}
+		if lastRegistration(Nodes.Lookup(udid)).Before(start) {
+			t.Errorf("Node %s did not register again after a reboot", udid)
+		}
+	}
+	for i, c := range clients {
+		if c.counterUpdates() == 0 {
+			t.Errorf("Client %d received no counter updates", i)
+		}
+	}
+	if atomic.LoadInt64(&received) == 0 {
+		t.Errorf("Simulated nodes received no setpoint published by clients")
+	}
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// handleDebugMessage processes a SYS_DEBUG_MESSAGE, whose system parameter is
+// a sequence number and whose payload is text printed by the node. Completed
+// lines are kept in the debug log of the node, streamed to clients and
+// written to the debug log file of the node, if any.
+func (nc *NocanNetworkController) handleDebugMessage(node *models.Node, msg *nocan.Message) {
+	_, seq := msg.SystemFunctionParam()
+
+	for _, line := range node.DebugLog.Append(seq, msg.Bytes(), time.Now()) {
+		if line.Lost > 0 {
+			clog.Warning("Lost %d debug message(s) from node %s", line.Lost, node)
+		}
+		clog.Debug("Node %s debug: %s", node, line.Text)
+		nc.writeDebugLine(node, line)
+		EventServer.Broadcast(socket.NewNodeDebugEvent(node.Id, line), nil)
+	}
+}
+
+// debugLogFileName returns the name of the debug log file of a node in
+// NodeDebugLogDir, which is derived from its udid so that it does not change
+// with the node id.
+func (nc *NocanNetworkController) debugLogFileName(udid models.Udid8) string {
+	return filepath.Join(nc.NodeDebugLogDir, strings.Replace(udid.String(), ":", "", -1)+".log")
+}
+
+func (nc *NocanNetworkController) writeDebugLine(node *models.Node, line models.DebugLine) {
+	if nc.NodeDebugLogDir == "" {
+		return
+	}
+
+	nc.debugFilesMutex.Lock()
+	defer nc.debugFilesMutex.Unlock()
+
+	f, ok := nc.debugFiles[node.Udid]
+	if !ok {
+		var err error
+
+		if nc.debugFiles == nil {
+			nc.debugFiles = make(map[models.Udid8]*os.File)
+		}
+		file_name := nc.debugLogFileName(node.Udid)
+		if err = os.MkdirAll(nc.NodeDebugLogDir, 0755); err == nil {
+			f, err = os.OpenFile(file_name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		}
+		if err != nil {
+			// Only report the failure once for each node.
+			clog.Warning("Could not open debug log file '%s' for node %s: %s", file_name, node, err)
+			f = nil
+		} else {
+			clog.Info("Debug messages of node %s will be written in %s", node, file_name)
+		}
+		nc.debugFiles[node.Udid] = f
+	}
+	if f == nil {
+		return
+	}
+
+	s := fmt.Sprintf("%s N%d [%d] %s\n", line.Time.Format("2006-01-02 15:04:05.000000"), node.Id, line.Sequence, line.Text)
+	if line.Lost > 0 {
+		s = fmt.Sprintf("%s N%d (%d messages lost)\n", line.Time.Format("2006-01-02 15:04:05.000000"), node.Id, line.Lost) + s
+	}
+	if _, err := f.WriteString(s); err != nil {
+		clog.Warning("Could not write debug log file '%s' for node %s: %s", f.Name(), node, err)
+	}
+}
+
+// CloseNodeDebugLogs closes the debug log files of all nodes.
+func (nc *NocanNetworkController) CloseNodeDebugLogs() {
+	nc.debugFilesMutex.Lock()
+	defer nc.debugFilesMutex.Unlock()
+
+	for udid, f := range nc.debugFiles {
+		if f != nil {
+			f.Close()
+		}
+		delete(nc.debugFiles, udid)
+	}
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+)
+
+// OverflowPolicy
+//
+// OverflowPolicy selects the message that is dropped when a message arrives
+// for a node whose input queue is full.
+type OverflowPolicy byte
+
+const (
+	DROP_OLDEST OverflowPolicy = iota
+	DROP_NEWEST
+)
+
+var overflowPolicyNames = [...]string{
+	"drop-oldest",
+	"drop-newest",
+}
+
+func (op OverflowPolicy) String() string {
+	if int(op) < len(overflowPolicyNames) {
+		return overflowPolicyNames[op]
+	}
+	return "unknown"
+}
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	for i, name := range overflowPolicyNames {
+		if s == name {
+			return OverflowPolicy(i), nil
+		}
+	}
+	return DROP_OLDEST, fmt.Errorf("Unknown overflow policy '%s', expected 'drop-oldest' or 'drop-newest'", s)
+}
+
+const DEFAULT_NODE_QUEUE_DEPTH = 16
+
+func (nc *NocanNetworkController) newInputQueue() chan *nocan.Message {
+	depth := nc.NodeQueueDepth
+	if depth <= 0 {
+		depth = DEFAULT_NODE_QUEUE_DEPTH
+	}
+	return make(chan *nocan.Message, depth)
+}
+
+// dispatch hands a message to the goroutine of a node without ever blocking:
+// if the input queue of the node is full, a message is dropped according to
+// NodeQueueOverflow. It must only be called from Serve().
+func (nc *NocanNetworkController) dispatch(node_id nocan.NodeId, queue chan *nocan.Message, msg *nocan.Message) {
+	context := &nc.nodeContexts[node_id]
+
+	select {
+	case queue <- msg:
+		context.overflowing = false
+		return
+	default:
+	}
+
+	dropped := msg
+	if nc.NodeQueueOverflow == DROP_OLDEST {
+		select {
+		case dropped = <-queue:
+		default:
+			// The node caught up in the meantime.
+			dropped = nil
+		}
+		// Serve() is the only sender, so there is room now.
+		queue <- msg
+	}
+	if dropped == nil {
+		context.overflowing = false
+		return
+	}
+
+	var overflows uint32
+	nc.updateStatistics(node_id, func(stats *models.NodeStatistics) {
+		stats.QueueOverflows++
+		overflows = stats.QueueOverflows
+	})
+
+	if !context.overflowing {
+		// Only report the start of an overflow, not every message dropped.
+		context.overflowing = true
+		clog.Warning("Input queue of node %d is full, dropping messages (%s), starting with %s", node_id, nc.NodeQueueOverflow, dropped)
+		// Broadcast may block on slow clients.
+		go EventServer.Broadcast(socket.NewNodeQueueOverflowEvent(node_id, byte(nc.NodeQueueOverflow), overflows), nil)
+	} else {
+		clog.Debug("Input queue of node %d is full, dropped %s", node_id, dropped)
+	}
+}
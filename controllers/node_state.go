@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/socket"
+)
+
+// setNodeState moves a node to a new state and broadcasts a NodeUpdateEvent.
+// Illegal transitions are logged and ignored. It returns true if the state of
+// the node changed.
+func (nc *NocanNetworkController) setNodeState(node *models.Node, state models.NodeState) bool {
+	changed, err := node.Transition(state)
+	if err != nil {
+		clog.Warning("%s", err)
+		return false
+	}
+	if !changed {
+		return false
+	}
+	clog.Debug("Node %s is now %s", node, state)
+	EventServer.Broadcast(nc.newNodeUpdateEvent(node), nil)
+	return true
+}
+
+// newNodeUpdateEvent describes the state of a node, with its statistics,
+// including the round-trip time, jitter and loss of pings.
+func (nc *NocanNetworkController) newNodeUpdateEvent(node *models.Node) *socket.NodeUpdateEvent {
+	state, last_seen := node.Status()
+	nu := socket.NewNodeUpdateEventWithParams(node.Id, state, node.Udid, last_seen)
+	stats := nc.NodeStatistics(node.Id)
+	nu.Statistics = &stats
+	return nu
+}
+
+// nodeIsActive tells if a node runs its application, or has connected and
+// may be about to.
+func nodeIsActive(state models.NodeState) bool {
+	return state == models.NodeStateConnected || state == models.NodeStateRunning
+}
+
+// runsApplication tells if a message shows that a connected node runs its
+// application: anything else than the address and boot handshakes, or an
+// answer to a ping, which the bootloader also sends.
+func runsApplication(msg *nocan.Message) bool {
+	if !msg.IsSystemMessage() {
+		return true
+	}
+	fn, _ := msg.SystemFunctionParam()
+	switch nocan.MessageType(fn) {
+	case nocan.SYS_ADDRESS_CONFIGURE_ACK, nocan.SYS_NODE_BOOT_ACK, nocan.SYS_BOOTLOADER_LEAVE_ACK, nocan.SYS_NODE_PING_ACK:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/models/properties"
+	"time"
+)
+
+// sendPing pings a node and records the time, to measure the round-trip time
+// when the node answers. A ping that is still unanswered when the next one is
+// sent is counted as lost. A ping that could not be transmitted is not
+// counted, so that bus failures are not reported as losses.
+func (nc *NocanNetworkController) sendPing(node_id nocan.NodeId) error {
+	nc.statisticsMutex.Lock()
+	context := &nc.nodeContexts[node_id]
+	sent_at := time.Now()
+	context.pingSentAt = sent_at
+	nc.statisticsMutex.Unlock()
+
+	err := nc.SendSystemMessage(node_id, nocan.SYS_NODE_PING, 0, nil)
+
+	nc.statisticsMutex.Lock()
+	defer nc.statisticsMutex.Unlock()
+	if err != nil {
+		if context.pingSentAt.Equal(sent_at) {
+			context.pingSentAt = time.Time{}
+		}
+		clog.DebugX("Failed to ping node %d: %s", node_id, err)
+		return err
+	}
+	context.statistics.PingsSent++
+	return nil
+}
+
+// resetStatistics clears the statistics and the ping measurements of a node
+// id, once it is free to be used by another node.
+func (nc *NocanNetworkController) resetStatistics(node_id nocan.NodeId) {
+	nc.statisticsMutex.Lock()
+	defer nc.statisticsMutex.Unlock()
+
+	context := &nc.nodeContexts[node_id]
+	context.statistics = models.NodeStatistics{}
+	context.pingSentAt = time.Time{}
+	context.rttSum = 0
+	context.lastRtt = 0
+	context.jitter = 0
+}
+
+// handlePingAck updates the round-trip time statistics of a node. The jitter
+// is smoothed as in RFC 3550: it moves by 1/16 of the difference between two
+// consecutive round-trip times.
+func (nc *NocanNetworkController) handlePingAck(node_id nocan.NodeId) {
+	nc.statisticsMutex.Lock()
+	defer nc.statisticsMutex.Unlock()
+
+	context := &nc.nodeContexts[node_id]
+	if context.pingSentAt.IsZero() {
+		clog.Debug("Ignoring unexpected ping answer from node %d", node_id)
+		return
+	}
+	rtt := time.Since(context.pingSentAt)
+	context.pingSentAt = time.Time{}
+
+	stats := &context.statistics
+	if stats.PingsAnswered > 0 {
+		delta := rtt - context.lastRtt
+		if delta < 0 {
+			delta = -delta
+		}
+		context.jitter += (delta - context.jitter) / 16
+	}
+	context.lastRtt = rtt
+	context.rttSum += rtt
+	stats.PingsAnswered++
+
+	rtt_us := durationToMicroseconds(rtt)
+	if stats.PingsAnswered == 1 || rtt_us < stats.RttMin {
+		stats.RttMin = rtt_us
+	}
+	if rtt_us > stats.RttMax {
+		stats.RttMax = rtt_us
+	}
+	stats.RttAvg = durationToMicroseconds(context.rttSum / time.Duration(stats.PingsAnswered))
+	stats.RttJitter = durationToMicroseconds(context.jitter)
+	clog.DebugX("Ping round-trip time for node %d is %s", node_id, rtt)
+}
+
+func durationToMicroseconds(d time.Duration) uint32 {
+	us := d / time.Microsecond
+	if us > 0xFFFFFFFF {
+		return 0xFFFFFFFF
+	}
+	return uint32(us)
+}
+
+// AddPingProperties adds the ping statistics of each node that answered at
+// least one ping to props, as ping_N_sent, ping_N_answered and
+// ping_N_rtt_{min,avg,max,jitter}_us for node N.
+func (nc *NocanNetworkController) AddPingProperties(props *properties.Properties) {
+	nc.statisticsMutex.Lock()
+	defer nc.statisticsMutex.Unlock()
+
+	for id := range nc.nodeContexts {
+		stats := &nc.nodeContexts[id].statistics
+		if stats.PingsSent == 0 {
+			continue
+		}
+		props.AddUint32(fmt.Sprintf("ping_%d_sent", id), stats.PingsSent)
+		props.AddUint32(fmt.Sprintf("ping_%d_answered", id), stats.PingsAnswered)
+		if stats.PingsAnswered == 0 {
+			continue
+		}
+		props.AddUint32(fmt.Sprintf("ping_%d_rtt_min_us", id), stats.RttMin)
+		props.AddUint32(fmt.Sprintf("ping_%d_rtt_avg_us", id), stats.RttAvg)
+		props.AddUint32(fmt.Sprintf("ping_%d_rtt_max_us", id), stats.RttMax)
+		props.AddUint32(fmt.Sprintf("ping_%d_rtt_jitter_us", id), stats.RttJitter)
+	}
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/nocan"
+	"time"
+)
+
+// REASSEMBLY_TIMEOUT is the longest time allowed between the first and the
+// last fragment of a message. A complete 64 byte message only takes a few
+// milliseconds on the bus.
+const REASSEMBLY_TIMEOUT = 1 * time.Second
+
+// NodeStatistics returns a copy of the protocol error counters of a node id.
+func (nc *NocanNetworkController) NodeStatistics(node_id nocan.NodeId) models.NodeStatistics {
+	nc.statisticsMutex.Lock()
+	defer nc.statisticsMutex.Unlock()
+
+	if node_id < 0 {
+		return models.NodeStatistics{}
+	}
+	return nc.nodeContexts[node_id].statistics
+}
+
+func (nc *NocanNetworkController) updateStatistics(node_id nocan.NodeId, update func(stats *models.NodeStatistics)) {
+	nc.statisticsMutex.Lock()
+	defer nc.statisticsMutex.Unlock()
+
+	update(&nc.nodeContexts[node_id].statistics)
+}
+
+// discardPending drops the message being reassembled for a node, counting its
+// fragments as dropped.
+func (nc *NocanNetworkController) discardPending(node_id nocan.NodeId, update func(stats *models.NodeStatistics)) {
+	context := &nc.nodeContexts[node_id]
+	frames := context.pendingFrames
+
+	nc.updateStatistics(node_id, func(stats *models.NodeStatistics) {
+		stats.DroppedFrames += frames
+		update(stats)
+	})
+	context.pendingMessage = nil
+	context.pendingFrames = 0
+}
+
+// reassemble adds a frame to the message pending for a node, and returns the
+// message once its last fragment has been received. Frames that cannot be
+// part of a valid message are discarded and counted in the node statistics.
+// It must only be called from Serve().
+func (nc *NocanNetworkController) reassemble(node_id nocan.NodeId, frame *can.Frame) *nocan.Message {
+	context := &nc.nodeContexts[node_id]
+	now := time.Now()
+
+	if context.pendingMessage != nil && now.Sub(context.pendingSince) > REASSEMBLY_TIMEOUT {
+		clog.Warning("Reassembly of %s timed out after %s, discarding.", context.pendingMessage, REASSEMBLY_TIMEOUT)
+		nc.discardPending(node_id, func(stats *models.NodeStatistics) {
+			stats.ReassemblyTimeouts++
+		})
+	}
+
+	if (frame.CanId & nocan.NOCANID_MASK_FIRST) != 0 {
+		if context.pendingMessage != nil {
+			// The last fragment of the previous message was lost.
+			clog.Warning("Got frame %s with first bit indicator while %s is incomplete, discarding the incomplete message.", frame, context.pendingMessage)
+			nc.discardPending(node_id, func(stats *models.NodeStatistics) {
+				stats.OrphanFragments += context.pendingFrames
+			})
+		}
+		context.pendingMessage = nocan.NewMessage(frame.CanId, frame.Data[:frame.Dlc])
+		context.pendingSince = now
+		context.pendingFrames = 1
+	} else {
+		if context.pendingMessage == nil {
+			clog.Warning("Got frame %s with missing first bit indicator, discarding.", frame)
+			nc.updateStatistics(node_id, func(stats *models.NodeStatistics) {
+				stats.OrphanFragments++
+				stats.DroppedFrames++
+			})
+			return nil
+		}
+		context.pendingFrames++
+		if !context.pendingMessage.AppendData(frame.Data[:frame.Dlc]) {
+			clog.Warning("Got frame %s that extends %s beyond 64 bytes, discarding.", frame, context.pendingMessage)
+			nc.discardPending(node_id, func(stats *models.NodeStatistics) {
+				stats.OverflowedMessages++
+			})
+			return nil
+		}
+	}
+
+	if (frame.CanId & nocan.NOCANID_MASK_LAST) != 0 {
+		msg := context.pendingMessage
+		context.pendingMessage = nil
+		context.pendingFrames = 0
+		return msg
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+)
+
+// handleSubscription records a SYS_CHANNEL_SUBSCRIBE or SYS_CHANNEL_UNSUBSCRIBE
+// message, which carries the channel id on 2 bytes. Neither is acknowledged.
+func (nc *NocanNetworkController) handleSubscription(node *models.Node, msg *nocan.Message) {
+	fn, _ := msg.SystemFunctionParam()
+
+	if msg.Dlc < 2 {
+		clog.Warning("%s: missing channel id in message from node %s", nocan.MessageType(fn), node)
+		return
+	}
+	channel_id := (nocan.ChannelId(msg.Data[0]) << 8) | nocan.ChannelId(msg.Data[1])
+	channel := Channels.Find(channel_id)
+	if channel == nil {
+		clog.Warning("%s: node %s refers to non-existing channel %d", nocan.MessageType(fn), node, channel_id)
+		return
+	}
+
+	if nocan.MessageType(fn) == nocan.SYS_CHANNEL_SUBSCRIBE {
+		if Subscriptions.Subscribe(node.Id, channel_id) {
+			clog.Info("Node %s subscribed to channel '%s' (id=%d)", node, channel.Name, channel_id)
+			nc.republishRetainedValue(node, channel)
+		}
+	} else {
+		if Subscriptions.Unsubscribe(node.Id, channel_id) {
+			clog.Info("Node %s unsubscribed from channel '%s' (id=%d)", node, channel.Name, channel_id)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/nocan"
+	"github.com/omzlo/nocand/models/properties"
+	"sync"
+)
+
+// TxClass
+//
+// Outgoing messages are sorted in priority classes: a pending message of a
+// lower class is only transmitted when all higher classes are empty.
+type TxClass int
+
+const (
+	TX_CLASS_CONFIG TxClass = iota
+	TX_CLASS_BOOTLOADER
+	TX_CLASS_PING
+	TX_CLASS_PUBLISH
+	TX_CLASS_COUNT
+)
+
+var txClassNames = [TX_CLASS_COUNT]string{
+	"config",
+	"bootloader",
+	"ping",
+	"publish",
+}
+
+func (tc TxClass) String() string {
+	if tc < 0 || tc >= TX_CLASS_COUNT {
+		return "unknown"
+	}
+	return txClassNames[tc]
+}
+
+// DefaultTxQueueDepths is the maximum number of messages waiting in each class.
+var DefaultTxQueueDepths = [TX_CLASS_COUNT]int{64, 64, 16, 128}
+
+var ErrTxQueueFull = errors.New("Transmit queue is full")
+
+func MessageTxClass(msg *nocan.Message) TxClass {
+	if !msg.IsSystemMessage() {
+		return TX_CLASS_PUBLISH
+	}
+	fn, _ := msg.SystemFunctionParam()
+	switch {
+	case fn == nocan.SYS_NODE_PING:
+		return TX_CLASS_PING
+	case fn == nocan.SYS_NODE_BOOT_REQUEST:
+		return TX_CLASS_BOOTLOADER
+	case fn >= nocan.SYS_BOOTLOADER_GET_SIGNATURE && fn <= nocan.SYS_BOOTLOADER_ERASE_ACK:
+		return TX_CLASS_BOOTLOADER
+	}
+	return TX_CLASS_CONFIG
+}
+
+type TxClassStatistics struct {
+	Pending uint32
+	Sent    uint32
+	Dropped uint32
+	Failed  uint32
+}
+
+type txRequest struct {
+	msg    *nocan.Message
+	result chan error
+}
+
+// TxScheduler
+//
+// TxScheduler sits in front of the driver: messages are queued by class and
+// transmitted one at a time by a single goroutine. All the frames of a
+// message are handed to the driver before the next message is started, so
+// fragments of different messages are never interleaved.
+type TxScheduler struct {
+	Mutex    sync.Mutex
+	Depths   [TX_CLASS_COUNT]int
+	transmit func(*nocan.Message) error
+	queues   [TX_CLASS_COUNT][]*txRequest
+	stats    [TX_CLASS_COUNT]TxClassStatistics
+	wakeup   chan struct{}
+}
+
+func NewTxScheduler(transmit func(*nocan.Message) error) *TxScheduler {
+	ts := &TxScheduler{Depths: DefaultTxQueueDepths, transmit: transmit, wakeup: make(chan struct{}, 1)}
+	go ts.run()
+	return ts
+}
+
+// Send queues a message and waits until it has been handed to the driver.
+func (ts *TxScheduler) Send(msg *nocan.Message) error {
+	class := MessageTxClass(msg)
+	request := &txRequest{msg: msg, result: make(chan error, 1)}
+
+	ts.Mutex.Lock()
+	if len(ts.queues[class]) >= ts.Depths[class] {
+		ts.stats[class].Dropped++
+		ts.Mutex.Unlock()
+		clog.Warning("Dropping %s: %s transmit queue is full", msg, class)
+		return ErrTxQueueFull
+	}
+	ts.queues[class] = append(ts.queues[class], request)
+	ts.stats[class].Pending++
+	ts.Mutex.Unlock()
+
+	select {
+	case ts.wakeup <- struct{}{}:
+	default:
+	}
+	return <-request.result
+}
+
+func (ts *TxScheduler) next() (TxClass, *txRequest) {
+	ts.Mutex.Lock()
+	defer ts.Mutex.Unlock()
+
+	for class := TxClass(0); class < TX_CLASS_COUNT; class++ {
+		if len(ts.queues[class]) > 0 {
+			request := ts.queues[class][0]
+			ts.queues[class][0] = nil
+			ts.queues[class] = ts.queues[class][1:]
+			ts.stats[class].Pending--
+			return class, request
+		}
+	}
+	return TX_CLASS_COUNT, nil
+}
+
+func (ts *TxScheduler) run() {
+	for {
+		class, request := ts.next()
+		if request == nil {
+			<-ts.wakeup
+			continue
+		}
+
+		err := ts.transmit(request.msg)
+
+		ts.Mutex.Lock()
+		if err != nil {
+			ts.stats[class].Failed++
+		} else {
+			ts.stats[class].Sent++
+		}
+		ts.Mutex.Unlock()
+
+		request.result <- err
+	}
+}
+
+func (ts *TxScheduler) Statistics() [TX_CLASS_COUNT]TxClassStatistics {
+	ts.Mutex.Lock()
+	defer ts.Mutex.Unlock()
+
+	return ts.stats
+}
+
+// AddProperties adds the counters of each class to props, as
+// tx_<class>_pending, tx_<class>_sent, tx_<class>_dropped and tx_<class>_failed.
+func (ts *TxScheduler) AddProperties(props *properties.Properties) {
+	for class, stats := range ts.Statistics() {
+		name := TxClass(class).String()
+		props.AddUint32(fmt.Sprintf("tx_%s_pending", name), stats.Pending)
+		props.AddUint32(fmt.Sprintf("tx_%s_sent", name), stats.Sent)
+		props.AddUint32(fmt.Sprintf("tx_%s_dropped", name), stats.Dropped)
+		props.AddUint32(fmt.Sprintf("tx_%s_failed", name), stats.Failed)
+	}
+}
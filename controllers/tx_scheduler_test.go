@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"github.com/omzlo/nocand/models/nocan"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver records the frames sent through it. While it is held, SendFrame
+// blocks, so that messages pile up in the transmit queues.
+type fakeDriver struct {
+	mutex   sync.Mutex
+	frames  []can.Frame
+	fail    error
+	held    chan struct{}
+	entered chan struct{}
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{entered: make(chan struct{}, 1)}
+}
+
+func (d *fakeDriver) Initialize(reset bool) (*device.Information, error) {
+	return &device.Information{}, nil
+}
+func (d *fakeDriver) Reset() error                              { return nil }
+func (d *fakeDriver) DeviceInfo() (*device.Information, error)  { return &device.Information{}, nil }
+func (d *fakeDriver) RecvFrame() (*can.Frame, error)            { select {} }
+func (d *fakeDriver) SetPower(powered bool) error               { return device.ErrNotSupported }
+func (d *fakeDriver) SetCurrentLimit(limit uint16) error        { return device.ErrNotSupported }
+func (d *fakeDriver) SetTerminationResistor(set bool) error     { return device.ErrNotSupported }
+func (d *fakeDriver) PowerStatus() (*device.PowerStatus, error) { return nil, device.ErrNotSupported }
+
+func (d *fakeDriver) SendFrame(frame *can.Frame) error {
+	d.mutex.Lock()
+	held, fail := d.held, d.fail
+	d.mutex.Unlock()
+
+	if held != nil {
+		select {
+		case d.entered <- struct{}{}:
+		default:
+		}
+		<-held
+	}
+	if fail != nil {
+		return fail
+	}
+
+	d.mutex.Lock()
+	d.frames = append(d.frames, *frame)
+	d.mutex.Unlock()
+	return nil
+}
+
+// hold makes SendFrame block until release is called.
+func (d *fakeDriver) hold() {
+	d.mutex.Lock()
+	d.held = make(chan struct{})
+	d.mutex.Unlock()
+}
+
+func (d *fakeDriver) release() {
+	d.mutex.Lock()
+	close(d.held)
+	d.held = nil
+	d.mutex.Unlock()
+}
+
+// sentIds returns the ids of the messages sent, without the frame flags.
+func (d *fakeDriver) sentIds() []uint32 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	ids := make([]uint32, 0, len(d.frames))
+	for _, frame := range d.frames {
+		ids = append(ids, frame.CanId&^can.CANID_MASK_CONTROL&nocan.NOCANID_MASK_MESSAGE)
+	}
+	return ids
+}
+
+var testTxMessages = [TX_CLASS_COUNT]*nocan.Message{
+	TX_CLASS_CONFIG:     nocan.NewSystemMessage(1, nocan.SYS_ADDRESS_CONFIGURE, 1, nil),
+	TX_CLASS_BOOTLOADER: nocan.NewSystemMessage(2, nocan.SYS_BOOTLOADER_GET_SIGNATURE, 0, nil),
+	TX_CLASS_PING:       nocan.NewSystemMessage(3, nocan.SYS_NODE_PING, 0, nil),
+	TX_CLASS_PUBLISH:    nocan.NewPublishMessage(0, 4, []byte("4")),
+}
+
+// blockScheduler sends a message that stays in the held driver, so that the
+// messages sent next are queued. It returns the result of that first send.
+func blockScheduler(t *testing.T, nc *NocanNetworkController, driver *fakeDriver) chan error {
+	driver.hold()
+	result := make(chan error, 1)
+	go func() { result <- nc.SendMessage(nocan.NewPublishMessage(0, 99, nil)) }()
+	select {
+	case <-driver.entered:
+	case <-time.After(time.Second):
+		t.Fatalf("The driver did not receive the first message")
+	}
+	return result
+}
+
+// waitForPending waits until count messages are queued in class.
+func waitForPending(t *testing.T, ts *TxScheduler, class TxClass, count uint32) {
+	deadline := time.Now().Add(time.Second)
+	for ts.Statistics()[class].Pending != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s queue has %d pending messages, expected %d", class, ts.Statistics()[class].Pending, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMessageTxClass(t *testing.T) {
+	for class, msg := range testTxMessages {
+		if MessageTxClass(msg) != TxClass(class) {
+			t.Errorf("%s is in class %s, expected %s", msg, MessageTxClass(msg), TxClass(class))
+		}
+	}
+	for _, fn := range []nocan.MessageType{nocan.SYS_NODE_BOOT_REQUEST, nocan.SYS_BOOTLOADER_WRITE, nocan.SYS_BOOTLOADER_ERASE_ACK} {
+		if class := MessageTxClass(nocan.NewSystemMessage(1, fn, 0, nil)); class != TX_CLASS_BOOTLOADER {
+			t.Errorf("%s is in class %s, expected bootloader", fn, class)
+		}
+	}
+}
+
+func TestTxSchedulerPriority(t *testing.T) {
+	driver := newFakeDriver()
+	nc := NewNocanNetworkController(driver)
+	first := blockScheduler(t, nc, driver)
+
+	// Queue the classes from the lowest priority to the highest, with two
+	// publish messages to check that a class is served in order.
+	second_publish := nocan.NewPublishMessage(0, 5, []byte("5"))
+	var wg sync.WaitGroup
+	send := func(msg *nocan.Message) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := nc.SendMessage(msg); err != nil {
+				t.Errorf("Sending %s failed: %s", msg, err)
+			}
+		}()
+	}
+	send(testTxMessages[TX_CLASS_PUBLISH])
+	waitForPending(t, nc.TxScheduler, TX_CLASS_PUBLISH, 1)
+	send(second_publish)
+	waitForPending(t, nc.TxScheduler, TX_CLASS_PUBLISH, 2)
+	for class := TX_CLASS_PING; class >= TX_CLASS_CONFIG; class-- {
+		send(testTxMessages[class])
+		waitForPending(t, nc.TxScheduler, class, 1)
+	}
+
+	driver.release()
+	if err := <-first; err != nil {
+		t.Fatalf("Sending the first message failed: %s", err)
+	}
+	wg.Wait()
+
+	expected := []uint32{nocan.NewPublishMessage(0, 99, nil).CanId}
+	for _, msg := range testTxMessages {
+		expected = append(expected, msg.CanId)
+	}
+	expected = append(expected, second_publish.CanId)
+
+	sent := driver.sentIds()
+	if len(sent) != len(expected) {
+		t.Fatalf("Driver sent %d frames, expected %d", len(sent), len(expected))
+	}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Errorf("Frame %d has id 0x%08x, expected 0x%08x", i, sent[i], expected[i])
+		}
+	}
+}
+
+func TestTxSchedulerOverflow(t *testing.T) {
+	const depth = 2
+
+	for class := TX_CLASS_CONFIG; class < TX_CLASS_COUNT; class++ {
+		driver := newFakeDriver()
+		nc := NewNocanNetworkController(driver)
+		for i := range nc.TxScheduler.Depths {
+			nc.TxScheduler.Depths[i] = depth
+		}
+		first := blockScheduler(t, nc, driver)
+		// The first message is a publish message, which is no longer queued.
+		waitForPending(t, nc.TxScheduler, TX_CLASS_PUBLISH, 0)
+
+		var wg sync.WaitGroup
+		for i := 0; i < depth; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				nc.SendMessage(testTxMessages[class])
+			}()
+		}
+		waitForPending(t, nc.TxScheduler, class, depth)
+
+		// A full class rejects messages without waiting for the driver...
+		if err := nc.SendMessage(testTxMessages[class]); err != ErrTxQueueFull {
+			t.Errorf("Sending to a full %s queue returned %v, expected ErrTxQueueFull", class, err)
+		}
+		// ...but does not prevent other classes from queuing messages.
+		other := (class + 1) % TX_CLASS_COUNT
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nc.SendMessage(testTxMessages[other])
+		}()
+		waitForPending(t, nc.TxScheduler, other, 1)
+
+		driver.release()
+		<-first
+		wg.Wait()
+
+		stats := nc.TxScheduler.Statistics()
+		if stats[class].Dropped != 1 || stats[class].Pending != 0 {
+			t.Errorf("%s queue has statistics %+v, expected 1 dropped and 0 pending", class, stats[class])
+		}
+		sent := uint32(depth)
+		if class == TX_CLASS_PUBLISH {
+			sent++
+		}
+		if stats[class].Sent != sent {
+			t.Errorf("%s queue sent %d messages, expected %d", class, stats[class].Sent, sent)
+		}
+		if stats[other].Sent == 0 || stats[other].Dropped != 0 {
+			t.Errorf("%s queue has statistics %+v after %s overflowed", other, stats[other], class)
+		}
+	}
+}
+
+func TestTxSchedulerDriverFailure(t *testing.T) {
+	driver := newFakeDriver()
+	driver.fail = errors.New("bus off")
+	nc := NewNocanNetworkController(driver)
+
+	for class, msg := range testTxMessages {
+		if err := nc.SendMessage(msg); err != driver.fail {
+			t.Errorf("Sending %s returned %v, expected the driver error", msg, err)
+		}
+		if stats := nc.TxScheduler.Statistics()[class]; stats.Failed != 1 || stats.Sent != 0 {
+			t.Errorf("%s queue has statistics %+v after a driver failure", TxClass(class), stats)
+		}
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/omzlo/clog v0.0.0-20200929154205-ef979337c74c
 	github.com/omzlo/go-sscp v0.0.0-20210205211644-9300fad1816f
+	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c
 )
 
 replace (
@@ -0,0 +1,223 @@
+package can
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/omzlo/clog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction
+//
+// Direction tells if a recorded frame was received or transmitted by nocand.
+type Direction byte
+
+const (
+	FRAME_RX Direction = 'R'
+	FRAME_TX Direction = 'T'
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FRAME_RX:
+		return "RX"
+	case FRAME_TX:
+		return "TX"
+	}
+	return "??"
+}
+
+// FrameRecorder is implemented by capture writers, which receive every frame
+// going through the network controller.
+type FrameRecorder interface {
+	RecordFrame(dir Direction, timestamp time.Time, frame *Frame)
+	Close() error
+}
+
+// FormatCandump formats a frame as a line of a 'candump -l' log file, followed
+// by a 'R' or 'T' direction indicator as written by 'candump -l -x'.
+func FormatCandump(dir Direction, timestamp time.Time, iface string, frame *Frame) string {
+	var id string
+
+	dlc := frame.Dlc
+	if dlc > 8 {
+		dlc = 8
+	}
+
+	switch {
+	case frame.IsError():
+		id = fmt.Sprintf("%08X", frame.CanId&^(CANID_MASK_EXTENDED|CANID_MASK_REMOTE))
+	case frame.IsExtended():
+		id = fmt.Sprintf("%08X", frame.CanId&^CANID_MASK_CONTROL)
+	default:
+		id = fmt.Sprintf("%03X", frame.CanId&0x7FF)
+	}
+
+	s := fmt.Sprintf("(%010d.%06d) %s %s#", timestamp.Unix(), timestamp.Nanosecond()/1000, iface, id)
+	if frame.IsRemote() && !frame.IsError() {
+		s += "R"
+	} else {
+		for i := uint8(0); i < dlc; i++ {
+			s += fmt.Sprintf("%02X", frame.Data[i])
+		}
+	}
+	if dir != 0 {
+		s += " " + string(dir)
+	}
+	return s
+}
+
+// ParseCandump decodes a line produced by FormatCandump or by 'candump -l'.
+// The direction is 0 if the line does not specify one.
+func ParseCandump(line string) (Direction, time.Time, string, *Frame, error) {
+	var dir Direction
+	var timestamp time.Time
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return 0, timestamp, "", nil, fmt.Errorf("Malformed candump line %q", line)
+	}
+
+	ts := strings.TrimSuffix(strings.TrimPrefix(fields[0], "("), ")")
+	dot := strings.IndexByte(ts, '.')
+	if dot < 0 {
+		return 0, timestamp, "", nil, fmt.Errorf("Malformed candump timestamp %q", fields[0])
+	}
+	sec, err := strconv.ParseInt(ts[:dot], 10, 64)
+	if err != nil {
+		return 0, timestamp, "", nil, fmt.Errorf("Malformed candump timestamp %q", fields[0])
+	}
+	usec, err := strconv.ParseInt(ts[dot+1:], 10, 64)
+	if err != nil {
+		return 0, timestamp, "", nil, fmt.Errorf("Malformed candump timestamp %q", fields[0])
+	}
+	timestamp = time.Unix(sec, usec*1000)
+
+	if len(fields) > 3 {
+		switch fields[3] {
+		case "R":
+			dir = FRAME_RX
+		case "T":
+			dir = FRAME_TX
+		}
+	}
+
+	sep := strings.IndexByte(fields[2], '#')
+	if sep < 0 {
+		return 0, timestamp, "", nil, fmt.Errorf("Malformed candump frame %q", fields[2])
+	}
+	sid := fields[2][:sep]
+	sdata := fields[2][sep+1:]
+
+	id, err := strconv.ParseUint(sid, 16, 32)
+	if err != nil {
+		return 0, timestamp, "", nil, fmt.Errorf("Malformed candump frame id %q", sid)
+	}
+
+	frame := new(Frame)
+	switch len(sid) {
+	case 3:
+		frame.CanId = uint32(id)
+	case 8:
+		frame.CanId = uint32(id)
+		if (frame.CanId & CANID_MASK_ERROR) == 0 {
+			frame.CanId |= CANID_MASK_EXTENDED
+		}
+	default:
+		return 0, timestamp, "", nil, fmt.Errorf("Malformed candump frame id %q", sid)
+	}
+
+	if strings.HasPrefix(sdata, "R") {
+		frame.CanId |= CANID_MASK_REMOTE
+		if len(sdata) > 1 {
+			if dlc, err := strconv.ParseUint(sdata[1:2], 10, 8); err == nil && dlc <= 8 {
+				frame.Dlc = uint8(dlc)
+			}
+		}
+		return dir, timestamp, fields[1], frame, nil
+	}
+
+	if len(sdata)%2 != 0 || len(sdata) > 16 {
+		return 0, timestamp, "", nil, fmt.Errorf("Malformed candump frame data %q", sdata)
+	}
+	for i := 0; i < len(sdata); i += 2 {
+		b, err := strconv.ParseUint(sdata[i:i+2], 16, 8)
+		if err != nil {
+			return 0, timestamp, "", nil, fmt.Errorf("Malformed candump frame data %q", sdata)
+		}
+		frame.Data[i/2] = byte(b)
+	}
+	frame.Dlc = uint8(len(sdata) / 2)
+	return dir, timestamp, fields[1], frame, nil
+}
+
+// CandumpWriter
+//
+// CandumpWriter is a FrameRecorder that writes a 'candump -l' log file.
+type CandumpWriter struct {
+	Mutex     sync.Mutex
+	Interface string
+	file      *os.File
+	writer    *bufio.Writer
+	flusher   *time.Timer
+}
+
+func NewCandumpWriter(fname string, iface string) (*CandumpWriter, error) {
+	f, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &CandumpWriter{Interface: iface, file: f, writer: bufio.NewWriter(f)}, nil
+}
+
+func (cw *CandumpWriter) RecordFrame(dir Direction, timestamp time.Time, frame *Frame) {
+	cw.Mutex.Lock()
+	defer cw.Mutex.Unlock()
+
+	if cw.file == nil {
+		return
+	}
+	if _, err := cw.writer.WriteString(FormatCandump(dir, timestamp, cw.Interface, frame) + "\n"); err != nil {
+		clog.Error("Failed to write to capture file %s, capture stopped: %s", cw.file.Name(), err)
+		cw.file.Close()
+		cw.file = nil
+		return
+	}
+	// Flush regularly so that the capture is usable while nocand runs.
+	if cw.flusher == nil {
+		cw.flusher = time.AfterFunc(1*time.Second, cw.flush)
+	}
+}
+
+func (cw *CandumpWriter) flush() {
+	cw.Mutex.Lock()
+	defer cw.Mutex.Unlock()
+
+	cw.flusher = nil
+	if cw.file != nil {
+		cw.writer.Flush()
+	}
+}
+
+func (cw *CandumpWriter) Close() error {
+	cw.Mutex.Lock()
+	defer cw.Mutex.Unlock()
+
+	if cw.file == nil {
+		return nil
+	}
+	if cw.flusher != nil {
+		cw.flusher.Stop()
+		cw.flusher = nil
+	}
+	err := cw.writer.Flush()
+	if cerr := cw.file.Close(); err == nil {
+		err = cerr
+	}
+	cw.file = nil
+	return err
+}
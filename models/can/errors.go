@@ -0,0 +1,69 @@
+package can
+
+import (
+	"strings"
+)
+
+// Error classes of an error frame, stored in the CAN id, as defined by
+// SocketCAN in <linux/can/error.h>.
+const (
+	CAN_ERR_TX_TIMEOUT = 0x00000001
+	CAN_ERR_LOSTARB    = 0x00000002
+	CAN_ERR_CRTL       = 0x00000004
+	CAN_ERR_PROT       = 0x00000008
+	CAN_ERR_TRX        = 0x00000010
+	CAN_ERR_ACK        = 0x00000020
+	CAN_ERR_BUSOFF     = 0x00000040
+	CAN_ERR_BUSERROR   = 0x00000080
+	CAN_ERR_RESTARTED  = 0x00000100
+)
+
+// Controller status details, stored in Data[1] of an error frame with the
+// CAN_ERR_CRTL class.
+const (
+	CAN_ERR_CRTL_RX_OVERFLOW = 0x01
+	CAN_ERR_CRTL_TX_OVERFLOW = 0x02
+	CAN_ERR_CRTL_RX_WARNING  = 0x04
+	CAN_ERR_CRTL_TX_WARNING  = 0x08
+	CAN_ERR_CRTL_RX_PASSIVE  = 0x10
+	CAN_ERR_CRTL_TX_PASSIVE  = 0x20
+	CAN_ERR_CRTL_ACTIVE      = 0x40
+)
+
+var errorClassStrings = [...]string{
+	"tx-timeout",
+	"lost-arbitration",
+	"controller",
+	"protocol",
+	"transceiver",
+	"no-ack",
+	"bus-off",
+	"bus-error",
+	"restarted",
+}
+
+// ErrorClass returns the error class bits of an error frame.
+func (frame *Frame) ErrorClass() uint32 {
+	return frame.CanId &^ CANID_MASK_CONTROL
+}
+
+// ErrorCounters returns the TX and RX error counters reported in an error frame.
+func (frame *Frame) ErrorCounters() (uint8, uint8) {
+	return frame.Data[6], frame.Data[7]
+}
+
+// ErrorString describes the error classes of an error frame.
+func (frame *Frame) ErrorString() string {
+	var r []string
+
+	class := frame.ErrorClass()
+	for i, s := range errorClassStrings {
+		if (class & (1 << uint(i))) != 0 {
+			r = append(r, s)
+		}
+	}
+	if len(r) == 0 {
+		return "unspecified"
+	}
+	return strings.Join(r, "+")
+}
@@ -2,20 +2,32 @@ package models
 
 import (
 	"errors"
+	"github.com/omzlo/clog"
 	"github.com/omzlo/nocand/models/nocan"
 	"sort"
 	"sync"
 	"time"
 )
 
+// CHANNEL_ID_QUARANTINE is the time during which the id of an unregistered
+// channel is not reused, so that nodes that still know the old id do not
+// publish to a different channel.
+const CHANNEL_ID_QUARANTINE = 10 * time.Minute
+
 // Channel
 //
-//
+// Id and Name never change once a channel is registered. The other fields
+// are updated concurrently and must be accessed through the methods below.
+// Stale is set while Value is a retained value restored from a previous run,
+// until the channel is updated again.
 type Channel struct {
-	Id        nocan.ChannelId
-	Name      string
-	Value     []byte
-	UpdatedAt time.Time
+	Mutex       sync.Mutex
+	Id          nocan.ChannelId
+	Name        string
+	Value       []byte
+	UpdatedAt   time.Time
+	Stale       bool
+	registrants map[nocan.NodeId]bool
 }
 
 func (c *Channel) String() string {
@@ -23,38 +35,112 @@ func (c *Channel) String() string {
 }
 
 func (c *Channel) Touch() {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
 	c.UpdatedAt = time.Now()
 }
 
 func (c *Channel) GetContent() []byte {
-	return c.Value
+	value, _ := c.Content()
+	return value
+}
+
+// Content returns the value of the channel and the time it was last updated.
+// The value is never modified in place, so it can be used without copying.
+func (c *Channel) Content() ([]byte, time.Time) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return c.Value, c.UpdatedAt
+}
+
+// Snapshot returns the value of the channel, the time it was last updated,
+// and whether the value is stale, all at once.
+func (c *Channel) Snapshot() ([]byte, time.Time, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return c.Value, c.UpdatedAt, c.Stale
+}
+
+// IsStale tells if the value of the channel was restored from a previous run
+// and has not been updated since.
+func (c *Channel) IsStale() bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	return c.Stale
+}
+
+// AddRegistrant records that a node registered the channel. Node 0 stands
+// for clients. It returns false if the node had already registered it.
+func (c *Channel) AddRegistrant(node_id nocan.NodeId) bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if c.registrants == nil {
+		c.registrants = make(map[nocan.NodeId]bool)
+	}
+	if c.registrants[node_id] {
+		return false
+	}
+	c.registrants[node_id] = true
+	return true
+}
+
+// RemoveRegistrant forgets that a node registered the channel. It returns
+// false if the node had not registered it, and the number of nodes that still
+// hold a registration.
+func (c *Channel) RemoveRegistrant(node_id nocan.NodeId) (bool, int) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	if !c.registrants[node_id] {
+		return false, len(c.registrants)
+	}
+	delete(c.registrants, node_id)
+	return true, len(c.registrants)
 }
 
 func (c *Channel) SetContent(content []byte) bool {
 	if len(content) > 64 {
 		return false
 	}
-	c.Value = make([]byte, len(content))
-	copy(c.Value, content)
-	c.Touch()
+	value := make([]byte, len(content))
+	copy(value, content)
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	c.Value = value
+	c.UpdatedAt = time.Now()
+	c.Stale = false
 	return true
 }
 
 // ChannelCollection
 //
-//
+// If Retained is set, channels that it retains get their value back when
+// they are registered or restored by RestoreRetained, and their value is
+// recorded by SetContent. If History
+// is set, SetContent also records every value in it.
 type ChannelCollection struct {
-	Mutex  sync.RWMutex
-	ById   map[nocan.ChannelId]*Channel
-	ByName map[string]*Channel
-	TopId  nocan.ChannelId
+	Mutex      sync.RWMutex
+	ById       map[nocan.ChannelId]*Channel
+	ByName     map[string]*Channel
+	TopId      nocan.ChannelId
+	Retained   *RetainedStore
+	History    *ChannelHistory
+	quarantine map[nocan.ChannelId]time.Time
 }
 
 func NewChannelCollection() *ChannelCollection {
 	cc := &ChannelCollection{
-		ById:   make(map[nocan.ChannelId]*Channel),
-		ByName: make(map[string]*Channel),
-		TopId:  nocan.ChannelId(0),
+		ById:       make(map[nocan.ChannelId]*Channel),
+		ByName:     make(map[string]*Channel),
+		TopId:      nocan.ChannelId(0),
+		quarantine: make(map[nocan.ChannelId]time.Time),
 	}
 	return cc
 }
@@ -94,32 +180,142 @@ func (cc *ChannelCollection) Register(channelName string) (*Channel, error) {
 	cc.Mutex.Lock()
 	defer cc.Mutex.Unlock()
 
-	for {
-		if cc.TopId < 0 {
-			cc.TopId = 0
+	if channel, ok := cc.ByName[channelName]; ok {
+		// Registered concurrently.
+		return channel, nil
+	}
+
+	now := time.Now()
+
+	// A channel gets the id it had in the channel cache back, unless another
+	// channel uses it.
+	if id, ok := ChannelCacheLookup(channelName); ok {
+		if _, used := cc.ById[id]; !used {
+			delete(cc.quarantine, id)
+			return cc.insert(id, channelName, now), nil
+		}
+	}
+
+	// Otherwise, use the lowest id that is neither in use, in quarantine nor
+	// cached for another channel, and only take an id from the cache if
+	// there is no other choice.
+	for _, skip_cached := range []bool{true, false} {
+		for id := nocan.ChannelId(0); id < nocan.UNDEFINED_CHANNEL; id++ {
+			if _, ok := cc.ById[id]; ok {
+				continue
+			}
+			if freed_at, ok := cc.quarantine[id]; ok {
+				if now.Sub(freed_at) < CHANNEL_ID_QUARANTINE {
+					continue
+				}
+				delete(cc.quarantine, id)
+			}
+			if skip_cached && ChannelCacheReverseLookup(id) {
+				continue
+			}
+			return cc.insert(id, channelName, now), nil
 		}
-		if channel, ok := cc.ById[cc.TopId]; !ok {
-			channel = &Channel{Id: cc.TopId, Name: channelName, UpdatedAt: time.Now()}
-			cc.ById[cc.TopId] = channel
-			cc.ByName[channelName] = channel
-			cc.TopId++
-			return channel, nil
+	}
+	return nil, errors.New("Maximum number of channels has been reached")
+}
+
+// insert adds a channel with the given id, restores its retained value and
+// records it in the channel cache. The collection must be locked.
+func (cc *ChannelCollection) insert(id nocan.ChannelId, channelName string, now time.Time) *Channel {
+	channel := &Channel{Id: id, Name: channelName, UpdatedAt: now}
+	if cc.Retained != nil {
+		if rv, ok := cc.Retained.Get(channelName); ok {
+			channel.Value = rv.Value
+			channel.UpdatedAt = rv.UpdatedAt
+			channel.Stale = true
 		}
-		cc.TopId++
 	}
-	// normally never reached
-	// return nil, errors.New("Maximum numver of channels has been reached")
+	cc.ById[id] = channel
+	cc.ByName[channelName] = channel
+	if id >= cc.TopId {
+		cc.TopId = id + 1
+	}
+	ChannelCacheSetEntry(channelName, id)
+	return channel
 }
 
+// RestoreRetained registers the channels that have a value in Retained, so
+// that their stale value is available before the nodes that own them
+// register them again. It returns the number of channels restored.
+func (cc *ChannelCollection) RestoreRetained() int {
+	if cc.Retained == nil {
+		return 0
+	}
+
+	count := 0
+	for _, name := range cc.Retained.Names() {
+		if cc.Lookup(name) != nil {
+			continue
+		}
+		if _, err := cc.Register(name); err != nil {
+			clog.Warning("Could not restore retained channel '%s': %s", name, err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// Unregister removes a channel from the collection, and puts its id in
+// quarantine for CHANNEL_ID_QUARANTINE. The retained value of the channel is
+// kept, so that the channel gets it back when it is registered again. It
+// returns false if the channel was not registered.
 func (cc *ChannelCollection) Unregister(channel *Channel) bool {
 	cc.Mutex.Lock()
 	defer cc.Mutex.Unlock()
 
+	if cc.ById[channel.Id] != channel {
+		return false
+	}
 	delete(cc.ByName, channel.Name)
 	delete(cc.ById, channel.Id)
+	cc.quarantine[channel.Id] = time.Now()
 	return true
 }
 
+// Delete unregisters a channel that is explicitly destroyed, and forgets its
+// retained value. It returns false if the channel was not registered.
+func (cc *ChannelCollection) Delete(channel *Channel) bool {
+	if !cc.Unregister(channel) {
+		return false
+	}
+	if cc.Retained != nil {
+		cc.Retained.Forget(channel.Name)
+	}
+	return true
+}
+
+// SetContent updates the value of a channel, and records it in Retained and
+// History.
+func (cc *ChannelCollection) SetContent(channel *Channel, content []byte) bool {
+	if !channel.SetContent(content) {
+		return false
+	}
+	value, updated_at := channel.Content()
+	if cc.Retained != nil {
+		cc.Retained.Set(channel.Name, value, updated_at)
+	}
+	if cc.History != nil {
+		cc.History.Record(channel.Name, value, updated_at)
+	}
+	return true
+}
+
+// Quarantined tells if a channel id belonged to a channel that was
+// unregistered less than CHANNEL_ID_QUARANTINE ago.
+func (cc *ChannelCollection) Quarantined(channelId nocan.ChannelId) bool {
+	cc.Mutex.RLock()
+	defer cc.Mutex.RUnlock()
+
+	freed_at, ok := cc.quarantine[channelId]
+	return ok && time.Since(freed_at) < CHANNEL_ID_QUARANTINE
+}
+
 func (cc *ChannelCollection) Lookup(channelName string) *Channel {
 	cc.Mutex.RLock()
 	defer cc.Mutex.RUnlock()
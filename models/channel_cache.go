@@ -0,0 +1,214 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/helpers"
+	"github.com/omzlo/nocand/models/nocan"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CHANNEL_CACHE_VERSION is the version of the format of the channel cache
+// file. Files with another version are ignored.
+const CHANNEL_CACHE_VERSION = 1
+
+// CHANNEL_CACHE_SAVE_DELAY groups the changes made while nodes register their
+// channels in a single save.
+const CHANNEL_CACHE_SAVE_DELAY = 5 * time.Second
+
+var channelCache map[string]nocan.ChannelId
+var reverseChannelCache map[nocan.ChannelId]string
+var channelCacheDirty bool = false
+var channelCacheFile *helpers.FilePath
+var channelCacheDelayedSave *time.Timer = nil
+var channelCacheMutex sync.Mutex
+
+type JsonChannelCacheEntry struct {
+	Name      string          `json:"name"`
+	ChannelId nocan.ChannelId `json:"id"`
+}
+
+type JsonChannelCache struct {
+	Version  int                     `json:"version"`
+	Channels []JsonChannelCacheEntry `json:"channels"`
+}
+
+func ChannelCacheFile(file *helpers.FilePath) {
+	channelCacheMutex.Lock()
+	defer channelCacheMutex.Unlock()
+
+	if file.String() == "" {
+		channelCacheFile = nil
+	} else {
+		channelCacheFile = file
+	}
+}
+
+// ChannelCacheLoad reads the channel ids saved by a previous run, so that
+// channels are registered again with the same ids. Entries already set by
+// ChannelCacheSetEntry take precedence over those of the file, whose
+// conflicting entries are ignored.
+func ChannelCacheLoad() error {
+	var cache JsonChannelCache
+
+	channelCacheMutex.Lock()
+	defer channelCacheMutex.Unlock()
+
+	if channelCacheFile == nil {
+		return nil
+	}
+
+	f, err := os.Open(channelCacheFile.String())
+	if err != nil {
+		if os.IsNotExist(err) {
+			clog.Debug("Channel cache file %s does not exist yet", channelCacheFile)
+			return nil
+		}
+		clog.Warning("Could not open channel cache file %s: %s", channelCacheFile, err)
+		return err
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(&cache); err != nil {
+		clog.Warning("Could not read channel cache file %s: %s", channelCacheFile, err)
+		return err
+	}
+	if cache.Version != CHANNEL_CACHE_VERSION {
+		clog.Warning("Ignoring channel cache file %s with unsupported version %d", channelCacheFile, cache.Version)
+		return fmt.Errorf("Unsupported channel cache version %d", cache.Version)
+	}
+
+	for _, entry := range cache.Channels {
+		if entry.Name == "" || entry.ChannelId >= nocan.UNDEFINED_CHANNEL {
+			clog.Warning("Ignoring invalid entry '%s' with id=%d in channel cache %s", entry.Name, entry.ChannelId, channelCacheFile)
+			continue
+		}
+		if other, exists := reverseChannelCache[entry.ChannelId]; exists {
+			clog.Warning("There is already a channel '%s' with id=%d in the cache %s, ignoring channel '%s' with same id", other, entry.ChannelId, channelCacheFile, entry.Name)
+			continue
+		}
+		if other_id, exists := channelCache[entry.Name]; exists {
+			if other_id != entry.ChannelId {
+				clog.Warning("Channel '%s' already has id=%d in the cache %s, ignoring id=%d", entry.Name, other_id, channelCacheFile, entry.ChannelId)
+			}
+			continue
+		}
+		channelCache[entry.Name] = entry.ChannelId
+		reverseChannelCache[entry.ChannelId] = entry.Name
+	}
+
+	clog.Info("Loaded channel cache file %s with %d entries", channelCacheFile, len(channelCache))
+	return nil
+}
+
+// ChannelCacheSave writes the channel cache if it changed since it was last
+// saved. The file is replaced atomically, so that a crash never leaves a
+// truncated cache behind.
+func ChannelCacheSave() error {
+	channelCacheMutex.Lock()
+	defer channelCacheMutex.Unlock()
+
+	if channelCacheFile == nil || !channelCacheDirty {
+		return nil
+	}
+
+	cache := JsonChannelCache{Version: CHANNEL_CACHE_VERSION, Channels: make([]JsonChannelCacheEntry, 0, len(channelCache))}
+	for name, id := range channelCache {
+		cache.Channels = append(cache.Channels, JsonChannelCacheEntry{name, id})
+	}
+	sort.Slice(cache.Channels, func(i, j int) bool { return cache.Channels[i].ChannelId < cache.Channels[j].ChannelId })
+
+	data, err := json.MarshalIndent(&cache, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file_name := channelCacheFile.String()
+	if err = os.MkdirAll(filepath.Dir(file_name), 0755); err != nil {
+		clog.Warning("Could not create directory for channel cache file %s: %s", file_name, err)
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(file_name), filepath.Base(file_name)+".tmp")
+	if err != nil {
+		clog.Warning("Could not create channel cache file %s: %s", file_name, err)
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file_name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		clog.Warning("Could not write channel cache file %s: %s", file_name, err)
+		return err
+	}
+
+	channelCacheDirty = false
+	clog.Info("Saved channel cache file %s with %d entries", file_name, len(cache.Channels))
+	return nil
+}
+
+// ChannelCacheSetEntry records the id of a channel, and schedules a save of
+// the cache. It returns false if the entry was already known.
+func ChannelCacheSetEntry(name string, channel_id nocan.ChannelId) bool {
+	channelCacheMutex.Lock()
+	defer channelCacheMutex.Unlock()
+
+	if id, exists := channelCache[name]; exists && id == channel_id {
+		return false
+	}
+
+	if previous_id, exists := channelCache[name]; exists {
+		delete(reverseChannelCache, previous_id)
+	}
+	if previous_name, exists := reverseChannelCache[channel_id]; exists {
+		delete(channelCache, previous_name)
+	}
+	channelCache[name] = channel_id
+	reverseChannelCache[channel_id] = name
+	channelCacheDirty = true
+	if channelCacheFile != nil && channelCacheDelayedSave == nil {
+		channelCacheDelayedSave = time.AfterFunc(CHANNEL_CACHE_SAVE_DELAY, func() {
+			channelCacheMutex.Lock()
+			channelCacheDelayedSave = nil
+			channelCacheMutex.Unlock()
+			ChannelCacheSave()
+		})
+	}
+	return true
+}
+
+// ChannelCacheLookup returns the id that a channel had in the cache.
+func ChannelCacheLookup(name string) (nocan.ChannelId, bool) {
+	channelCacheMutex.Lock()
+	defer channelCacheMutex.Unlock()
+
+	id, ok := channelCache[name]
+	return id, ok
+}
+
+// ChannelCacheReverseLookup tells if a channel id is reserved in the cache.
+func ChannelCacheReverseLookup(channel_id nocan.ChannelId) bool {
+	channelCacheMutex.Lock()
+	defer channelCacheMutex.Unlock()
+
+	_, ok := reverseChannelCache[channel_id]
+	return ok
+}
+
+func init() {
+	channelCache = make(map[string]nocan.ChannelId)
+	reverseChannelCache = make(map[nocan.ChannelId]string)
+}
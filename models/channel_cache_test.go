@@ -0,0 +1,164 @@
+package models
+
+import (
+	"github.com/omzlo/nocand/models/helpers"
+	"github.com/omzlo/nocand/models/nocan"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// useChannelCache starts the test with an empty channel cache kept in file,
+// and stops using that file at the end of the test.
+func useChannelCache(t *testing.T, file string) {
+	reset := func(file *helpers.FilePath) {
+		channelCacheMutex.Lock()
+		defer channelCacheMutex.Unlock()
+
+		if channelCacheDelayedSave != nil {
+			channelCacheDelayedSave.Stop()
+			channelCacheDelayedSave = nil
+		}
+		channelCache = make(map[string]nocan.ChannelId)
+		reverseChannelCache = make(map[nocan.ChannelId]string)
+		channelCacheDirty = false
+		channelCacheFile = file
+	}
+	reset(helpers.NewFilePath(file))
+	t.Cleanup(func() { reset(nil) })
+}
+
+func writeTestFile(t *testing.T, file string, content string) {
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("Could not write %s: %s", file, err)
+	}
+}
+
+func TestChannelCacheRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "channels")
+	useChannelCache(t, file)
+
+	ChannelCacheSetEntry("a", 0)
+	ChannelCacheSetEntry("b", 5)
+	ChannelCacheSetEntry("c", 7)
+	ChannelCacheSetEntry("c", 3)
+	if err := ChannelCacheSave(); err != nil {
+		t.Fatalf("ChannelCacheSave failed: %s", err)
+	}
+
+	useChannelCache(t, file)
+	if err := ChannelCacheLoad(); err != nil {
+		t.Fatalf("ChannelCacheLoad failed: %s", err)
+	}
+	for name, expected := range map[string]nocan.ChannelId{"a": 0, "b": 5, "c": 3} {
+		if id, ok := ChannelCacheLookup(name); !ok || id != expected {
+			t.Errorf("Channel '%s' has id %d (found=%t) after a reload, expected %d", name, id, ok, expected)
+		}
+	}
+	if ChannelCacheReverseLookup(7) {
+		t.Errorf("Id 7 is still reserved after channel 'c' moved to id 3")
+	}
+}
+
+func TestChannelCacheVersion(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "channels")
+	useChannelCache(t, file)
+
+	writeTestFile(t, file, `{"version": 99, "channels": [{"name": "a", "id": 4}]}`)
+	if err := ChannelCacheLoad(); err == nil {
+		t.Errorf("ChannelCacheLoad accepted version 99")
+	}
+	if _, ok := ChannelCacheLookup("a"); ok {
+		t.Errorf("Entries of a cache with an unsupported version were loaded")
+	}
+}
+
+func TestChannelCacheLoadAfterSetEntry(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "channels")
+	useChannelCache(t, file)
+
+	writeTestFile(t, file, `{"version": 1, "channels": [{"name": "a", "id": 0}, {"name": "b", "id": 5}]}`)
+	ChannelCacheSetEntry("b", 0)
+	if err := ChannelCacheLoad(); err != nil {
+		t.Fatalf("ChannelCacheLoad failed: %s", err)
+	}
+
+	// The entry set before the load wins, and both maps agree.
+	if id, _ := ChannelCacheLookup("b"); id != 0 {
+		t.Errorf("Channel 'b' has id %d, expected 0", id)
+	}
+	if _, ok := ChannelCacheLookup("a"); ok {
+		t.Errorf("Channel 'a' was loaded with an id already in use")
+	}
+	if ChannelCacheReverseLookup(5) {
+		t.Errorf("Id 5 is reserved for channel 'b', which has id 0")
+	}
+}
+
+func TestRegisterReusesCachedIds(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "channels")
+	useChannelCache(t, file)
+
+	writeTestFile(t, file, `{"version": 1, "channels": [{"name": "a", "id": 0}, {"name": "b", "id": 5}]}`)
+	if err := ChannelCacheLoad(); err != nil {
+		t.Fatalf("ChannelCacheLoad failed: %s", err)
+	}
+
+	cc := NewChannelCollection()
+	b, _ := cc.Register("b")
+	c, _ := cc.Register("c")
+	a, _ := cc.Register("a")
+	if a.Id != 0 || b.Id != 5 {
+		t.Errorf("Channels 'a' and 'b' got ids %d and %d, expected 0 and 5", a.Id, b.Id)
+	}
+	// A new channel does not take an id reserved for another channel.
+	if c.Id == 0 || c.Id == 5 {
+		t.Errorf("Channel 'c' got reserved id %d", c.Id)
+	}
+	if id, _ := ChannelCacheLookup("c"); id != c.Id {
+		t.Errorf("Channel 'c' has id %d in the cache, expected %d", id, c.Id)
+	}
+}
+
+func TestRestoreRetainedKeepsCachedIds(t *testing.T) {
+	dir := t.TempDir()
+	cache_file := filepath.Join(dir, "channels")
+	retained_file := filepath.Join(dir, "retained")
+	useChannelCache(t, cache_file)
+
+	writeTestFile(t, cache_file, `{"version": 1, "channels": [{"name": "a", "id": 0}, {"name": "b", "id": 5}]}`)
+	writeTestFile(t, retained_file, `{"version": 1, "values": [{"name": "b", "value": "MjA=", "updated_at": "2020-01-01T00:00:00Z"}]}`)
+	if err := ChannelCacheLoad(); err != nil {
+		t.Fatalf("ChannelCacheLoad failed: %s", err)
+	}
+	retained, err := NewRetainedStore(helpers.NewFilePath(retained_file), []string{"*"}, nil)
+	if err != nil {
+		t.Fatalf("NewRetainedStore failed: %s", err)
+	}
+	if err := retained.Load(); err != nil {
+		t.Fatalf("Load of retained values failed: %s", err)
+	}
+
+	cc := NewChannelCollection()
+	cc.Retained = retained
+	if count := cc.RestoreRetained(); count != 1 {
+		t.Fatalf("RestoreRetained restored %d channels, expected 1", count)
+	}
+	b := cc.Lookup("b")
+	if b == nil || b.Id != 5 {
+		t.Fatalf("Retained channel 'b' was restored as %v, expected id 5", b)
+	}
+	if value, _, stale := b.Snapshot(); string(value) != "20" || !stale {
+		t.Errorf("Retained channel 'b' has value %q (stale=%t), expected stale \"20\"", value, stale)
+	}
+
+	a, _ := cc.Register("a")
+	if a.Id != 0 {
+		t.Errorf("Channel 'a' got id %d after retained channels were restored, expected 0", a.Id)
+	}
+	for name, expected := range map[string]nocan.ChannelId{"a": 0, "b": 5} {
+		if id, ok := ChannelCacheLookup(name); !ok || id != expected {
+			t.Errorf("Channel '%s' has id %d (found=%t) in the cache, expected %d", name, id, ok, expected)
+		}
+	}
+}
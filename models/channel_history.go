@@ -0,0 +1,314 @@
+package models
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/clog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CHANNEL_HISTORY_LENGTH = 1024
+	CHANNEL_HISTORY_SEGMENT        = time.Hour
+)
+
+// HistoryEntry is a value taken by a channel, and the time it was set.
+type HistoryEntry struct {
+	Time  time.Time `json:"time"`
+	Value []byte    `json:"value"`
+}
+
+// HistoryQuery
+//
+// HistoryQuery selects the entries of a channel history between From and To,
+// where a zero time leaves that end open. If Step is not 0, only the last
+// entry of each interval of Step is kept. If Limit is not 0, only the Limit
+// most recent entries are kept.
+type HistoryQuery struct {
+	From  time.Time
+	To    time.Time
+	Limit int
+	Step  time.Duration
+}
+
+func (q *HistoryQuery) includes(t time.Time) bool {
+	if !q.From.IsZero() && t.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && t.After(q.To) {
+		return false
+	}
+	return true
+}
+
+type historyRing struct {
+	entries []HistoryEntry
+	next    int
+}
+
+func (r *historyRing) add(entry HistoryEntry, length int) {
+	if len(r.entries) < length {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % length
+}
+
+func (r *historyRing) ordered() []HistoryEntry {
+	entries := make([]HistoryEntry, 0, len(r.entries))
+	entries = append(entries, r.entries[r.next:]...)
+	return append(entries, r.entries[:r.next]...)
+}
+
+type jsonHistoryRecord struct {
+	Channel string    `json:"channel"`
+	Time    time.Time `json:"time"`
+	Value   []byte    `json:"value"`
+}
+
+// ChannelHistory
+//
+// ChannelHistory keeps the last Length values of each channel in memory, by
+// channel name. If Dir is set, every value is also appended to segment
+// files, one per CHANNEL_HISTORY_SEGMENT, which are deleted once they are
+// older than Retention. Queries that reach further back than the memory
+// read these files, which also cover previous runs of the server.
+type ChannelHistory struct {
+	Mutex        sync.Mutex
+	Length       int
+	Dir          string
+	Retention    time.Duration
+	rings        map[string]*historyRing
+	segment      *os.File
+	segmentStart time.Time
+}
+
+func NewChannelHistory(length int, dir string, retention time.Duration) *ChannelHistory {
+	if length <= 0 {
+		length = DEFAULT_CHANNEL_HISTORY_LENGTH
+	}
+	return &ChannelHistory{Length: length, Dir: dir, Retention: retention, rings: make(map[string]*historyRing)}
+}
+
+func (ch *ChannelHistory) segmentFileName(start time.Time) string {
+	return filepath.Join(ch.Dir, fmt.Sprintf("history-%d.jsonl", start.Unix()))
+}
+
+// segmentFiles returns the start time and the name of the segment files in
+// Dir, in chronological order.
+func (ch *ChannelHistory) segmentFiles() ([]time.Time, []string) {
+	names, _ := filepath.Glob(filepath.Join(ch.Dir, "history-*.jsonl"))
+
+	var starts []time.Time
+	var files []string
+	for _, name := range names {
+		base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "history-"), ".jsonl")
+		secs, err := strconv.ParseInt(base, 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, time.Unix(secs, 0))
+		files = append(files, name)
+	}
+	sort.Sort(segmentsByStart{starts, files})
+	return starts, files
+}
+
+type segmentsByStart struct {
+	starts []time.Time
+	files  []string
+}
+
+func (s segmentsByStart) Len() int           { return len(s.starts) }
+func (s segmentsByStart) Less(i, j int) bool { return s.starts[i].Before(s.starts[j]) }
+func (s segmentsByStart) Swap(i, j int) {
+	s.starts[i], s.starts[j] = s.starts[j], s.starts[i]
+	s.files[i], s.files[j] = s.files[j], s.files[i]
+}
+
+// expireSegments deletes the segment files older than Retention.
+func (ch *ChannelHistory) expireSegments(now time.Time) {
+	if ch.Retention <= 0 {
+		return
+	}
+	starts, files := ch.segmentFiles()
+	for i, start := range starts {
+		if now.Sub(start.Add(CHANNEL_HISTORY_SEGMENT)) > ch.Retention {
+			if err := os.Remove(files[i]); err != nil {
+				clog.Warning("Could not delete channel history segment %s: %s", files[i], err)
+			} else {
+				clog.Debug("Deleted channel history segment %s", files[i])
+			}
+		}
+	}
+}
+
+// writeRecord appends a value to the current segment file, and opens a new
+// segment when the current one is over. The history must be locked.
+func (ch *ChannelHistory) writeRecord(name string, entry HistoryEntry) {
+	start := entry.Time.Truncate(CHANNEL_HISTORY_SEGMENT)
+	if !start.Equal(ch.segmentStart) {
+		if ch.segment != nil {
+			ch.segment.Close()
+			ch.segment = nil
+		}
+		// A failure is only reported once for each segment.
+		ch.segmentStart = start
+		file_name := ch.segmentFileName(start)
+		err := os.MkdirAll(ch.Dir, 0755)
+		if err == nil {
+			ch.segment, err = os.OpenFile(file_name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		}
+		if err != nil {
+			clog.Warning("Could not open channel history segment %s: %s", file_name, err)
+			ch.segment = nil
+		}
+		ch.expireSegments(entry.Time)
+	}
+	if ch.segment == nil {
+		return
+	}
+
+	data, err := json.Marshal(&jsonHistoryRecord{Channel: name, Time: entry.Time, Value: entry.Value})
+	if err == nil {
+		_, err = ch.segment.Write(append(data, '\n'))
+	}
+	if err != nil {
+		clog.Warning("Could not write channel history segment %s: %s", ch.segment.Name(), err)
+	}
+}
+
+// Record adds a value of a channel to the history. The value must not be
+// modified afterwards.
+func (ch *ChannelHistory) Record(name string, value []byte, at time.Time) {
+	ch.Mutex.Lock()
+	defer ch.Mutex.Unlock()
+
+	ring, ok := ch.rings[name]
+	if !ok {
+		ring = &historyRing{}
+		ch.rings[name] = ring
+	}
+	entry := HistoryEntry{Time: at, Value: value}
+	ring.add(entry, ch.Length)
+	if ch.Dir != "" {
+		ch.writeRecord(name, entry)
+	}
+}
+
+// readSegments returns the entries of a channel found in the segment files
+// that overlap the query, and that are older than before (if not zero).
+// Segments are read from the newest one, and if the query sets a limit, older
+// segments are not read once the entries read are enough to satisfy it.
+func (ch *ChannelHistory) readSegments(name string, q *HistoryQuery, before time.Time) []HistoryEntry {
+	var entries []HistoryEntry
+
+	starts, files := ch.segmentFiles()
+	for i := len(starts) - 1; i >= 0; i-- {
+		start := starts[i]
+		if !q.From.IsZero() && start.Add(CHANNEL_HISTORY_SEGMENT).Before(q.From) {
+			break
+		}
+		if !q.To.IsZero() && start.After(q.To) {
+			continue
+		}
+		if !before.IsZero() && !start.Before(before) {
+			continue
+		}
+		f, err := os.Open(files[i])
+		if err != nil {
+			clog.Warning("Could not open channel history segment %s: %s", files[i], err)
+			continue
+		}
+		var segment_entries []HistoryEntry
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record jsonHistoryRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// A partial line left by a crash.
+				continue
+			}
+			if record.Channel != name || (!before.IsZero() && !record.Time.Before(before)) {
+				continue
+			}
+			segment_entries = append(segment_entries, HistoryEntry{Time: record.Time, Value: record.Value})
+		}
+		f.Close()
+		entries = append(segment_entries, entries...)
+
+		if q.Limit > 0 && len(q.selectEntries(entries)) >= q.Limit {
+			break
+		}
+	}
+	return entries
+}
+
+// selectEntries returns the entries in the time range of the query, keeping
+// only the last entry of each interval of Step if it is set. The limit of
+// the query is not applied.
+func (q *HistoryQuery) selectEntries(entries []HistoryEntry) []HistoryEntry {
+	selected := make([]HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !q.includes(entry.Time) {
+			continue
+		}
+		if q.Step > 0 && len(selected) > 0 {
+			last := &selected[len(selected)-1]
+			if last.Time.Truncate(q.Step).Equal(entry.Time.Truncate(q.Step)) {
+				*last = entry
+				continue
+			}
+		}
+		selected = append(selected, entry)
+	}
+	return selected
+}
+
+// Query returns the entries of the history of a channel selected by q, in
+// chronological order.
+func (ch *ChannelHistory) Query(name string, q HistoryQuery) []HistoryEntry {
+	var entries []HistoryEntry
+
+	ch.Mutex.Lock()
+	if ring, ok := ch.rings[name]; ok {
+		entries = ring.ordered()
+	}
+	ch.Mutex.Unlock()
+
+	if ch.Dir != "" && (q.Limit == 0 || len(q.selectEntries(entries)) < q.Limit) {
+		// Segment files hold every entry kept in memory, and older ones.
+		var oldest time.Time
+		if len(entries) > 0 {
+			oldest = entries[0].Time
+		}
+		if oldest.IsZero() || q.From.IsZero() || q.From.Before(oldest) {
+			entries = append(ch.readSegments(name, &q, oldest), entries...)
+		}
+	}
+
+	selected := q.selectEntries(entries)
+	if q.Limit > 0 && len(selected) > q.Limit {
+		selected = selected[len(selected)-q.Limit:]
+	}
+	return selected
+}
+
+// Close closes the current segment file.
+func (ch *ChannelHistory) Close() {
+	ch.Mutex.Lock()
+	defer ch.Mutex.Unlock()
+
+	if ch.segment != nil {
+		ch.segment.Close()
+		ch.segment = nil
+	}
+	ch.segmentStart = time.Time{}
+}
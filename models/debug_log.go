@@ -0,0 +1,122 @@
+package models
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEBUG_LOG_LENGTH        = 256
+	DEBUG_LINE_MAX_LENGTH   = 256
+	DEBUG_MESSAGE_MAX_BYTES = 64
+)
+
+// DebugLine
+//
+// DebugLine is a line of text printed by a node with SYS_DEBUG_MESSAGE.
+// Sequence is the sequence number of the message that completed the line, and
+// Lost counts the messages that went missing just before the line.
+type DebugLine struct {
+	Sequence uint8     `json:"sequence"`
+	Lost     uint32    `json:"lost"`
+	Time     time.Time `json:"time"`
+	Text     string    `json:"text"`
+}
+
+// DebugLog
+//
+// DebugLog reassembles the SYS_DEBUG_MESSAGE messages of a node into lines,
+// and keeps the last DEBUG_LOG_LENGTH lines.
+type DebugLog struct {
+	Mutex   sync.Mutex
+	lines   []DebugLine
+	next    int
+	pending []byte
+	started bool
+	nextSeq uint8
+	lost    uint32
+}
+
+func NewDebugLog() *DebugLog {
+	return &DebugLog{lines: make([]DebugLine, 0, DEBUG_LOG_LENGTH)}
+}
+
+func (dl *DebugLog) flush(seq uint8, now time.Time) DebugLine {
+	line := DebugLine{Sequence: seq, Lost: dl.lost, Time: now, Text: strings.TrimRight(string(dl.pending), "\r")}
+	dl.pending = dl.pending[:0]
+	dl.lost = 0
+	return line
+}
+
+func (dl *DebugLog) store(line DebugLine) {
+	if len(dl.lines) < DEBUG_LOG_LENGTH {
+		dl.lines = append(dl.lines, line)
+		return
+	}
+	dl.lines[dl.next] = line
+	dl.next = (dl.next + 1) % DEBUG_LOG_LENGTH
+}
+
+// Append adds the payload of a SYS_DEBUG_MESSAGE with sequence number seq, and
+// returns the lines it completes, if any. A line ends with a newline, or with
+// a message shorter than DEBUG_MESSAGE_MAX_BYTES: a longer line is sent as a
+// series of full messages. A gap in the sequence numbers ends the pending
+// line, which is then incomplete, and is recorded in Lost.
+func (dl *DebugLog) Append(seq uint8, data []byte, now time.Time) []DebugLine {
+	dl.Mutex.Lock()
+	defer dl.Mutex.Unlock()
+
+	var lines []DebugLine
+
+	if dl.started && seq != dl.nextSeq {
+		if len(dl.pending) > 0 {
+			lines = append(lines, dl.flush(dl.nextSeq-1, now))
+		}
+		dl.lost += uint32(seq - dl.nextSeq)
+	}
+	dl.started = true
+	dl.nextSeq = seq + 1
+
+	text := data
+	for {
+		i := bytes.IndexByte(text, '\n')
+		if i < 0 {
+			break
+		}
+		dl.pending = append(dl.pending, text[:i]...)
+		lines = append(lines, dl.flush(seq, now))
+		text = text[i+1:]
+	}
+	dl.pending = append(dl.pending, text...)
+	if len(dl.pending) > 0 && (len(data) < DEBUG_MESSAGE_MAX_BYTES || len(dl.pending) >= DEBUG_LINE_MAX_LENGTH) {
+		lines = append(lines, dl.flush(seq, now))
+	}
+
+	for _, line := range lines {
+		dl.store(line)
+	}
+	return lines
+}
+
+// Restart forgets the sequence number and the pending line of a node that
+// has been reset, and starts a new sequence.
+func (dl *DebugLog) Restart() {
+	dl.Mutex.Lock()
+	defer dl.Mutex.Unlock()
+
+	dl.pending = dl.pending[:0]
+	dl.started = false
+	dl.lost = 0
+}
+
+// Lines returns the lines kept in the log, from the oldest to the newest.
+func (dl *DebugLog) Lines() []DebugLine {
+	dl.Mutex.Lock()
+	defer dl.Mutex.Unlock()
+
+	lines := make([]DebugLine, 0, len(dl.lines))
+	lines = append(lines, dl.lines[dl.next:]...)
+	return append(lines, dl.lines[:dl.next]...)
+}
@@ -0,0 +1,31 @@
+package device
+
+import (
+	"errors"
+	"github.com/omzlo/nocand/models/can"
+)
+
+// Driver
+//
+// A Driver gives the network controller access to a CAN bus. The PiMaster
+// HAT is one implementation, but any device that can send and receive
+// extended CAN frames can be used.
+type Driver interface {
+	// Initialize opens the device, optionally resetting it, and returns
+	// information describing it.
+	Initialize(reset bool) (*Information, error)
+	Reset() error
+	DeviceInfo() (*Information, error)
+	// SendFrame queues a frame for transmission on the bus.
+	SendFrame(frame *can.Frame) error
+	// RecvFrame blocks until a frame is received from the bus.
+	RecvFrame() (*can.Frame, error)
+	SetPower(powered bool) error
+	SetCurrentLimit(limit uint16) error
+	SetTerminationResistor(set bool) error
+	PowerStatus() (*PowerStatus, error)
+}
+
+// ErrNotSupported is returned by drivers for operations that the underlying
+// device does not provide, such as bus power control on a plain CAN adapter.
+var ErrNotSupported = errors.New("Operation not supported by driver")
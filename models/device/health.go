@@ -0,0 +1,55 @@
+package device
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// BusHealthState
+//
+// BusHealthState follows the CAN fault confinement states, with an additional
+// state for electrical faults reported by the driver.
+type BusHealthState byte
+
+const (
+	BUS_ERROR_ACTIVE BusHealthState = iota
+	BUS_ERROR_PASSIVE
+	BUS_OFF
+	BUS_ELECTRICAL_FAULT
+)
+
+var busHealthStateStrings = [...]string{
+	"error-active",
+	"error-passive",
+	"bus-off",
+	"electrical-fault",
+}
+
+func (s BusHealthState) String() string {
+	if int(s) < len(busHealthStateStrings) {
+		return busHealthStateStrings[s]
+	}
+	return "unknown"
+}
+
+func (s BusHealthState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// BusHealth
+//
+// BusHealth holds the current bus health state and error counters since
+// nocand started.
+type BusHealth struct {
+	State        BusHealthState `json:"state"`
+	ErrorFrames  uint32         `json:"error_frames"`
+	ErrorPassive uint32         `json:"error_passive"`
+	BusOff       uint32         `json:"bus_off"`
+	DriverErrors uint32         `json:"driver_errors"`
+	Faults       uint32         `json:"faults"`
+	Resets       uint32         `json:"resets"`
+	PowerCycles  uint32         `json:"power_cycles"`
+	TxErrors     uint8          `json:"tx_errors"`
+	RxErrors     uint8          `json:"rx_errors"`
+	ChangedAt    time.Time      `json:"changed_at"`
+}
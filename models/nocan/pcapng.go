@@ -0,0 +1,212 @@
+package nocan
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/can"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	PCAPNG_SECTION_HEADER_BLOCK  = 0x0A0D0D0A
+	PCAPNG_INTERFACE_BLOCK       = 0x00000001
+	PCAPNG_ENHANCED_PACKET_BLOCK = 0x00000006
+	PCAPNG_BYTE_ORDER_MAGIC      = 0x1A2B3C4D
+	LINKTYPE_CAN_SOCKETCAN       = 227
+	PCAPNG_OPT_ENDOFOPT          = 0
+	PCAPNG_OPT_COMMENT           = 1
+	PCAPNG_OPT_SHB_USERAPPL      = 4
+	PCAPNG_OPT_IF_NAME           = 2
+	PCAPNG_OPT_IF_TSRESOL        = 9
+	PCAPNG_OPT_EPB_FLAGS         = 2
+	PCAPNG_EPB_FLAGS_INBOUND     = 1
+	PCAPNG_EPB_FLAGS_OUTBOUND    = 2
+	socketcan_frame_size         = 16
+)
+
+// FrameAnnotation describes a CAN frame in NoCAN terms: source or destination
+// node, message type, channel or system parameter and fragment position.
+func FrameAnnotation(frame *can.Frame) string {
+	var s string
+
+	if frame.IsError() {
+		return "CAN error frame"
+	}
+	if !frame.IsExtended() {
+		return "Not a NoCAN frame (standard CAN id)"
+	}
+
+	node := NodeId((frame.CanId >> 21) & 0x7F)
+	if (frame.CanId & NOCANID_MASK_SYSTEM) != 0 {
+		fn := MessageType((frame.CanId >> 8) & 0xFF)
+		s = fmt.Sprintf("node=%d type=%s param=%d", node, fn, frame.CanId&0xFF)
+	} else {
+		s = fmt.Sprintf("node=%d type=%s channel=%d", node, PUBLISH, frame.CanId&0xFFFF)
+	}
+
+	switch frame.CanId & (NOCANID_MASK_FIRST | NOCANID_MASK_LAST) {
+	case NOCANID_MASK_FIRST | NOCANID_MASK_LAST:
+		s += " fragment=first,last"
+	case NOCANID_MASK_FIRST:
+		s += " fragment=first"
+	case NOCANID_MASK_LAST:
+		s += " fragment=last"
+	default:
+		s += " fragment=middle"
+	}
+	return s
+}
+
+// PcapngWriter
+//
+// PcapngWriter is a can.FrameRecorder that writes a pcapng file readable by
+// Wireshark. Frames are stored as LINKTYPE_CAN_SOCKETCAN packets, each with a
+// comment produced by FrameAnnotation.
+type PcapngWriter struct {
+	Mutex     sync.Mutex
+	Interface string
+	file      *os.File
+	writer    *bufio.Writer
+	flusher   *time.Timer
+}
+
+func NewPcapngWriter(fname string, iface string) (*PcapngWriter, error) {
+	f, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	pw := &PcapngWriter{Interface: iface, file: f, writer: bufio.NewWriter(f)}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], PCAPNG_BYTE_ORDER_MAGIC)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], 0xFFFFFFFFFFFFFFFF) // section length not specified
+	shb = pcapngAppendOption(shb, PCAPNG_OPT_SHB_USERAPPL, []byte("nocand"))
+	shb = pcapngAppendOption(shb, PCAPNG_OPT_ENDOFOPT, nil)
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], LINKTYPE_CAN_SOCKETCAN)
+	binary.LittleEndian.PutUint32(idb[4:], socketcan_frame_size)
+	idb = pcapngAppendOption(idb, PCAPNG_OPT_IF_NAME, []byte(iface))
+	idb = pcapngAppendOption(idb, PCAPNG_OPT_IF_TSRESOL, []byte{6})
+	idb = pcapngAppendOption(idb, PCAPNG_OPT_ENDOFOPT, nil)
+
+	if err := pw.writeBlock(PCAPNG_SECTION_HEADER_BLOCK, shb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := pw.writeBlock(PCAPNG_INTERFACE_BLOCK, idb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return pw, nil
+}
+
+func pcapngAppendOption(buf []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(value)))
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, value...)
+	return append(buf, make([]byte, (4-len(value)%4)%4)...)
+}
+
+func (pw *PcapngWriter) writeBlock(block_type uint32, body []byte) error {
+	var hdr [8]byte
+	var trailer [4]byte
+
+	total := uint32(len(body) + 12)
+	binary.LittleEndian.PutUint32(hdr[0:], block_type)
+	binary.LittleEndian.PutUint32(hdr[4:], total)
+	binary.LittleEndian.PutUint32(trailer[0:], total)
+	if _, err := pw.writer.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := pw.writer.Write(body); err != nil {
+		return err
+	}
+	_, err := pw.writer.Write(trailer[:])
+	return err
+}
+
+func (pw *PcapngWriter) RecordFrame(dir can.Direction, timestamp time.Time, frame *can.Frame) {
+	pw.Mutex.Lock()
+	defer pw.Mutex.Unlock()
+
+	if pw.file == nil {
+		return
+	}
+
+	dlc := frame.Dlc
+	if dlc > 8 {
+		dlc = 8
+	}
+	ts := uint64(timestamp.UnixNano() / 1000)
+
+	epb := make([]byte, 20+socketcan_frame_size)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], socketcan_frame_size)
+	binary.LittleEndian.PutUint32(epb[16:], socketcan_frame_size)
+	// The SocketCAN pseudo-header stores the CAN id in network byte order.
+	binary.BigEndian.PutUint32(epb[20:], frame.CanId)
+	epb[24] = dlc
+	copy(epb[28:], frame.Data[:dlc])
+
+	var flags [4]byte
+	if dir == can.FRAME_TX {
+		binary.LittleEndian.PutUint32(flags[:], PCAPNG_EPB_FLAGS_OUTBOUND)
+	} else {
+		binary.LittleEndian.PutUint32(flags[:], PCAPNG_EPB_FLAGS_INBOUND)
+	}
+	epb = pcapngAppendOption(epb, PCAPNG_OPT_COMMENT, []byte(FrameAnnotation(frame)))
+	epb = pcapngAppendOption(epb, PCAPNG_OPT_EPB_FLAGS, flags[:])
+	epb = pcapngAppendOption(epb, PCAPNG_OPT_ENDOFOPT, nil)
+
+	if err := pw.writeBlock(PCAPNG_ENHANCED_PACKET_BLOCK, epb); err != nil {
+		clog.Error("Failed to write to capture file %s, capture stopped: %s", pw.file.Name(), err)
+		pw.file.Close()
+		pw.file = nil
+		return
+	}
+	// Flush regularly so that the capture can be opened while nocand runs.
+	if pw.flusher == nil {
+		pw.flusher = time.AfterFunc(1*time.Second, pw.flush)
+	}
+}
+
+func (pw *PcapngWriter) flush() {
+	pw.Mutex.Lock()
+	defer pw.Mutex.Unlock()
+
+	pw.flusher = nil
+	if pw.file != nil {
+		pw.writer.Flush()
+	}
+}
+
+func (pw *PcapngWriter) Close() error {
+	pw.Mutex.Lock()
+	defer pw.Mutex.Unlock()
+
+	if pw.file == nil {
+		return nil
+	}
+	if pw.flusher != nil {
+		pw.flusher.Stop()
+		pw.flusher = nil
+	}
+	err := pw.writer.Flush()
+	if cerr := pw.file.Close(); err == nil {
+		err = cerr
+	}
+	pw.file = nil
+	return err
+}
@@ -41,11 +41,11 @@ func (id Udid8) String() string {
 	return retval
 }
 
-func (id Udid8) DecodeString(s string) error {
+func (id *Udid8) DecodeString(s string) error {
 	src := []byte(s)
 
-	if len(id) < 8 {
-		return errors.New("Insufficient space to store node uid")
+	if len(src) != 3*len(id)-1 {
+		return fmt.Errorf("Node udid '%s' should be 8 hex bytes separated by ':'", s)
 	}
 
 	for i := 0; i < len(s); i += 3 {
@@ -98,35 +98,151 @@ func (ns NodeState) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + ns.String() + `"`), nil
 }
 
-// Node
+// nodeStateTransitions lists the states that can be reached from each state.
+// Any state can go back to NodeStateConnecting, since a node that resets
+// requests a new address.
+var nodeStateTransitions = [NodeStateCount][]NodeState{
+	NodeStateUnknown:      {NodeStateConnecting},
+	NodeStateConnecting:   {NodeStateConnected, NodeStateUnresponsive},
+	NodeStateConnected:    {NodeStateRunning, NodeStateBootloader, NodeStateUnresponsive},
+	NodeStateBootloader:   {NodeStateProgramming, NodeStateUnresponsive},
+	NodeStateRunning:      {NodeStateBootloader, NodeStateUnresponsive},
+	NodeStateProgramming:  {NodeStateBootloader, NodeStateUnresponsive},
+	NodeStateUnresponsive: {NodeStateConnected},
+}
+
+// CanTransitionTo tells if a node can move from state ns to state to.
+func (ns NodeState) CanTransitionTo(to NodeState) bool {
+	if int(ns) >= len(nodeStateTransitions) || to >= NodeStateCount {
+		return false
+	}
+	if to == NodeStateConnecting {
+		return true
+	}
+	for _, s := range nodeStateTransitions[ns] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NodeTransition
 //
+// NodeTransition records a change of state of a node.
+type NodeTransition struct {
+	From NodeState `json:"from"`
+	To   NodeState `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+func (nt NodeTransition) String() string {
+	return fmt.Sprintf("%s -> %s at %s", nt.From, nt.To, nt.At.Format(time.RFC3339Nano))
+}
+
+// NODE_STATE_HISTORY_LENGTH is the number of transitions kept for each node.
+const NODE_STATE_HISTORY_LENGTH = 16
+
+// Node
 //
+// Id and Udid never change once a node is created. The other fields are
+// updated concurrently and must be accessed through the methods below.
 type Node struct {
+	Mutex           sync.Mutex
 	State           NodeState
+	StateChangedAt  time.Time
 	Id              nocan.NodeId
 	Udid            Udid8
 	LastSeen        time.Time
 	FirmwareVersion uint8
 	Attributes      map[string]string
+	DebugLog        *DebugLog
+	history         []NodeTransition
 }
 
 func NewNode(id nocan.NodeId, udid Udid8, fw_version uint8) *Node {
-	return &Node{State: NodeStateUnknown, Udid: udid, Id: id, FirmwareVersion: fw_version, Attributes: make(map[string]string)}
+	return &Node{State: NodeStateUnknown, StateChangedAt: time.Now(), Udid: udid, Id: id, FirmwareVersion: fw_version, Attributes: make(map[string]string), DebugLog: NewDebugLog()}
 }
 
 func (n *Node) Touch() {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
 	n.LastSeen = time.Now()
 }
 
+// Transition moves the node to a new state, and records the change in the
+// history of the node. It returns false if the node is already in that
+// state, and an error if the transition is not allowed.
+func (n *Node) Transition(state NodeState) (bool, error) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	if n.State == state {
+		return false, nil
+	}
+	if !n.State.CanTransitionTo(state) {
+		return false, fmt.Errorf("Node %s cannot go from state %s to state %s", n, n.State, state)
+	}
+
+	transition := NodeTransition{From: n.State, To: state, At: time.Now()}
+	if len(n.history) == NODE_STATE_HISTORY_LENGTH {
+		copy(n.history, n.history[1:])
+		n.history = n.history[:NODE_STATE_HISTORY_LENGTH-1]
+	}
+	n.history = append(n.history, transition)
+	n.State = state
+	n.StateChangedAt = transition.At
+	return true, nil
+}
+
+// History returns the last state transitions of the node, oldest first.
+func (n *Node) History() []NodeTransition {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	history := make([]NodeTransition, len(n.history))
+	copy(history, n.history)
+	return history
+}
+
+// Status returns the state of the node and the last time it was seen.
+func (n *Node) Status() (NodeState, time.Time) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	return n.State, n.LastSeen
+}
+
+func (n *Node) SetFirmwareVersion(version uint8) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	n.FirmwareVersion = version
+}
+
+func (n *Node) GetFirmwareVersion() uint8 {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	return n.FirmwareVersion
+}
+
 func (n *Node) String() string {
 	return fmt.Sprintf("N%d (%s)", n.Id, n.Udid)
 }
 
 func (n *Node) SetAttribute(attr string, value string) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
 	n.Attributes[attr] = value
 }
 
 func (n *Node) GetAttribute(attr string) string {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
 	return n.Attributes[attr]
 }
 
@@ -149,6 +265,43 @@ func (n *Node) ExpandAttributes(s string) string {
 	}
 }
 
+// NodeStatistics
+//
+// NodeStatistics counts the protocol errors detected while reassembling the
+// messages of a node id, since nocand started, and measures the round-trip
+// time of pings. Round-trip times are in microseconds.
+type NodeStatistics struct {
+	DroppedFrames      uint32 `json:"dropped_frames"`
+	OrphanFragments    uint32 `json:"orphan_fragments"`
+	ReassemblyTimeouts uint32 `json:"reassembly_timeouts"`
+	OverflowedMessages uint32 `json:"overflowed_messages"`
+	UnknownNodeFrames  uint32 `json:"unknown_node_frames"`
+	QueueOverflows     uint32 `json:"queue_overflows"`
+	PingsSent          uint32 `json:"pings_sent"`
+	PingsAnswered      uint32 `json:"pings_answered"`
+	RttMin             uint32 `json:"rtt_min_us"`
+	RttAvg             uint32 `json:"rtt_avg_us"`
+	RttMax             uint32 `json:"rtt_max_us"`
+	RttJitter          uint32 `json:"rtt_jitter_us"`
+}
+
+// PingLoss returns the fraction of pings that were not answered, between 0
+// and 1.
+func (ns NodeStatistics) PingLoss() float64 {
+	if ns.PingsSent == 0 || ns.PingsAnswered >= ns.PingsSent {
+		return 0
+	}
+	return float64(ns.PingsSent-ns.PingsAnswered) / float64(ns.PingsSent)
+}
+
+func (ns NodeStatistics) String() string {
+	return fmt.Sprintf("dropped frames=%d, orphan fragments=%d, reassembly timeouts=%d, overflowed messages=%d, unknown node frames=%d, queue overflows=%d, pings=%d/%d (%.1f%% loss), rtt min/avg/max/jitter=%s/%s/%s/%s",
+		ns.DroppedFrames, ns.OrphanFragments, ns.ReassemblyTimeouts, ns.OverflowedMessages, ns.UnknownNodeFrames, ns.QueueOverflows,
+		ns.PingsAnswered, ns.PingsSent, ns.PingLoss()*100,
+		time.Duration(ns.RttMin)*time.Microsecond, time.Duration(ns.RttAvg)*time.Microsecond,
+		time.Duration(ns.RttMax)*time.Microsecond, time.Duration(ns.RttJitter)*time.Microsecond)
+}
+
 // NodeCollection
 //
 //
@@ -199,8 +352,7 @@ func (nc *NodeCollection) Register(udid Udid8, fw_version uint8) (*Node, error)
 	}
 
 	if node := nc.Lookup(udid); node != nil {
-		node.State = NodeStateConnecting
-		node.FirmwareVersion = fw_version
+		node.SetFirmwareVersion(fw_version)
 		return node, nil
 	}
 
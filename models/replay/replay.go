@@ -0,0 +1,118 @@
+package replay
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReplayDriver
+//
+// ReplayDriver implements device.Driver by feeding the received frames of a
+// 'candump -l' log file back to the network controller. Frames sent by the
+// controller are discarded. A Speed of 1 reproduces the original timing, a
+// Speed of 10 replays ten times faster and a Speed of 0 replays frames as
+// fast as possible.
+type ReplayDriver struct {
+	File      string
+	Speed     float64
+	file      *os.File
+	scanner   *bufio.Scanner
+	lineno    int
+	origin    time.Time
+	startedAt time.Time
+}
+
+func NewDriver(fname string, speed float64) *ReplayDriver {
+	return &ReplayDriver{File: fname, Speed: speed}
+}
+
+func (d *ReplayDriver) Initialize(reset bool) (*device.Information, error) {
+	f, err := os.Open(d.File)
+	if err != nil {
+		return nil, err
+	}
+	d.file = f
+	d.scanner = bufio.NewScanner(f)
+	d.lineno = 0
+	d.origin = time.Time{}
+	clog.Info("Replaying CAN frames from %s", d.File)
+	return d.DeviceInfo()
+}
+
+func (d *ReplayDriver) Reset() error {
+	return nil
+}
+
+func (d *ReplayDriver) DeviceInfo() (*device.Information, error) {
+	info := &device.Information{}
+	copy(info.Type[:], "REPLAY  ")
+	copy(info.Signature[:], "CAN0")
+	return info, nil
+}
+
+func (d *ReplayDriver) SendFrame(frame *can.Frame) error {
+	clog.DebugXX("SEND FRAME %s (discarded by replay driver)", frame)
+	return nil
+}
+
+// RecvFrame returns the next received frame of the log file, waiting as
+// required by Speed. It returns io.EOF at the end of the file.
+func (d *ReplayDriver) RecvFrame() (*can.Frame, error) {
+	if d.scanner == nil {
+		return nil, fmt.Errorf("Replay file %s is not open", d.File)
+	}
+	for d.scanner.Scan() {
+		d.lineno++
+		line := strings.TrimSpace(d.scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dir, timestamp, _, frame, err := can.ParseCandump(line)
+		if err != nil {
+			clog.Warning("%s:%d: %s", d.File, d.lineno, err)
+			continue
+		}
+		if dir == can.FRAME_TX {
+			continue
+		}
+
+		if d.origin.IsZero() {
+			d.origin = timestamp
+			d.startedAt = time.Now()
+		} else if d.Speed > 0 {
+			due := d.startedAt.Add(time.Duration(float64(timestamp.Sub(d.origin)) / d.Speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		return frame, nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return nil, err
+	}
+	d.file.Close()
+	return nil, io.EOF
+}
+
+func (d *ReplayDriver) SetPower(powered bool) error {
+	return device.ErrNotSupported
+}
+
+func (d *ReplayDriver) SetCurrentLimit(limit uint16) error {
+	return device.ErrNotSupported
+}
+
+func (d *ReplayDriver) SetTerminationResistor(set bool) error {
+	return device.ErrNotSupported
+}
+
+func (d *ReplayDriver) PowerStatus() (*device.PowerStatus, error) {
+	return nil, device.ErrNotSupported
+}
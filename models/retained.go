@@ -0,0 +1,235 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/helpers"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RETAINED_STORE_VERSION is the version of the format of the retained value
+// file. Files with another version are ignored.
+const RETAINED_STORE_VERSION = 1
+
+// RETAINED_STORE_SAVE_DELAY groups the values published in a short period in
+// a single save.
+const RETAINED_STORE_SAVE_DELAY = 5 * time.Second
+
+type RetainedValue struct {
+	Name      string    `json:"name"`
+	Value     []byte    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type JsonRetainedStore struct {
+	Version int             `json:"version"`
+	Values  []RetainedValue `json:"values"`
+}
+
+// RetainedStore
+//
+// RetainedStore keeps the last value of the channels whose name matches one
+// of Patterns in a file, so that they can be restored after a restart.
+// Patterns use the syntax of path.Match, where '*' does not match '/'.
+// Republish selects the restored values that are published again on the bus
+// when a node subscribes to their channel.
+type RetainedStore struct {
+	Mutex       sync.Mutex
+	Patterns    []string
+	Republish   []string
+	file        *helpers.FilePath
+	values      map[string]RetainedValue
+	dirty       bool
+	delayedSave *time.Timer
+}
+
+func NewRetainedStore(file *helpers.FilePath, patterns []string, republish []string) (*RetainedStore, error) {
+	for _, pattern := range append(append([]string{}, patterns...), republish...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid retained channel pattern '%s': %s", pattern, err)
+		}
+	}
+	return &RetainedStore{Patterns: patterns, Republish: republish, file: file, values: make(map[string]RetainedValue)}, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Retains tells if the value of a channel is kept in the store.
+func (rs *RetainedStore) Retains(name string) bool {
+	return matchAny(rs.Patterns, name)
+}
+
+// Republishes tells if the value of a channel is published again when a
+// node subscribes to it.
+func (rs *RetainedStore) Republishes(name string) bool {
+	return rs.Retains(name) && matchAny(rs.Republish, name)
+}
+
+// Names returns the names of the channels that have a retained value, in
+// alphabetical order.
+func (rs *RetainedStore) Names() []string {
+	rs.Mutex.Lock()
+	defer rs.Mutex.Unlock()
+
+	names := make([]string, 0, len(rs.values))
+	for name := range rs.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load reads the values saved by a previous run. Values of channels that no
+// longer match Patterns are dropped.
+func (rs *RetainedStore) Load() error {
+	var store JsonRetainedStore
+
+	rs.Mutex.Lock()
+	defer rs.Mutex.Unlock()
+
+	if rs.file == nil || rs.file.IsNull() {
+		return nil
+	}
+
+	f, err := os.Open(rs.file.String())
+	if err != nil {
+		if os.IsNotExist(err) {
+			clog.Debug("Retained value file %s does not exist yet", rs.file)
+			return nil
+		}
+		clog.Warning("Could not open retained value file %s: %s", rs.file, err)
+		return err
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(&store); err != nil {
+		clog.Warning("Could not read retained value file %s: %s", rs.file, err)
+		return err
+	}
+	if store.Version != RETAINED_STORE_VERSION {
+		clog.Warning("Ignoring retained value file %s with unsupported version %d", rs.file, store.Version)
+		return fmt.Errorf("Unsupported retained value file version %d", store.Version)
+	}
+
+	for _, rv := range store.Values {
+		if rs.Retains(rv.Name) && len(rv.Value) <= 64 {
+			rs.values[rv.Name] = rv
+		} else {
+			rs.dirty = true
+		}
+	}
+	clog.Info("Loaded retained value file %s with %d values", rs.file, len(rs.values))
+	return nil
+}
+
+// Save writes the retained values if they changed since they were last
+// saved. The file is replaced atomically.
+func (rs *RetainedStore) Save() error {
+	rs.Mutex.Lock()
+	defer rs.Mutex.Unlock()
+
+	if rs.file == nil || rs.file.IsNull() || !rs.dirty {
+		return nil
+	}
+
+	store := JsonRetainedStore{Version: RETAINED_STORE_VERSION, Values: make([]RetainedValue, 0, len(rs.values))}
+	for _, rv := range rs.values {
+		store.Values = append(store.Values, rv)
+	}
+	sort.Slice(store.Values, func(i, j int) bool { return store.Values[i].Name < store.Values[j].Name })
+
+	data, err := json.MarshalIndent(&store, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file_name := rs.file.String()
+	if err = os.MkdirAll(filepath.Dir(file_name), 0755); err != nil {
+		clog.Warning("Could not create directory for retained value file %s: %s", file_name, err)
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(file_name), filepath.Base(file_name)+".tmp")
+	if err != nil {
+		clog.Warning("Could not create retained value file %s: %s", file_name, err)
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file_name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		clog.Warning("Could not write retained value file %s: %s", file_name, err)
+		return err
+	}
+
+	rs.dirty = false
+	clog.Debug("Saved retained value file %s with %d values", file_name, len(store.Values))
+	return nil
+}
+
+func (rs *RetainedStore) scheduleSave() {
+	if rs.file != nil && !rs.file.IsNull() && rs.delayedSave == nil {
+		rs.delayedSave = time.AfterFunc(RETAINED_STORE_SAVE_DELAY, func() {
+			rs.Mutex.Lock()
+			rs.delayedSave = nil
+			rs.Mutex.Unlock()
+			rs.Save()
+		})
+	}
+}
+
+// Set records the value of a channel, if the store retains it.
+func (rs *RetainedStore) Set(name string, value []byte, updated_at time.Time) {
+	if !rs.Retains(name) {
+		return
+	}
+
+	rs.Mutex.Lock()
+	defer rs.Mutex.Unlock()
+
+	rs.values[name] = RetainedValue{Name: name, Value: value, UpdatedAt: updated_at}
+	rs.dirty = true
+	rs.scheduleSave()
+}
+
+// Get returns the retained value of a channel.
+func (rs *RetainedStore) Get(name string) (RetainedValue, bool) {
+	rs.Mutex.Lock()
+	defer rs.Mutex.Unlock()
+
+	rv, ok := rs.values[name]
+	return rv, ok
+}
+
+// Forget drops the retained value of a channel, after a client destroyed it.
+func (rs *RetainedStore) Forget(name string) {
+	rs.Mutex.Lock()
+	defer rs.Mutex.Unlock()
+
+	if _, ok := rs.values[name]; ok {
+		delete(rs.values, name)
+		rs.dirty = true
+		rs.scheduleSave()
+	}
+}
@@ -0,0 +1,152 @@
+package rpi
+
+import (
+	"fmt"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"sync"
+)
+
+// FakeTransport
+//
+// FakeTransport emulates the SPI responses of a PiMaster, so that the opcode
+// layer can be exercised without hardware. Frames stored with
+// SPI_OP_STORE_DATA are recorded by SPI_OP_SEND_REQ, and frames passed to
+// Inject are returned by SPI_OP_FETCH_DATA.
+type FakeTransport struct {
+	Mutex        sync.Mutex
+	Signature    [4]byte
+	VersionMajor byte
+	VersionMinor byte
+	ChipId       [12]byte
+	Status       device.StatusByte
+	Levels       [8]byte
+	CurrentLimit uint16
+	Resets       int
+	stored       *can.Frame
+	sent         []can.Frame
+	pending      []can.Frame
+}
+
+func NewFakeTransport() *FakeTransport {
+	return &FakeTransport{Signature: [4]byte{'C', 'A', 'N', '0'}, VersionMajor: 1}
+}
+
+// Inject queues a frame, as if it had been received from the CAN bus.
+func (f *FakeTransport) Inject(frame *can.Frame) {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	f.pending = append(f.pending, *frame)
+	f.Status |= device.STATUS_RX_PENDING
+}
+
+// Sent returns the frames transmitted so far and clears the list.
+func (f *FakeTransport) Sent() []can.Frame {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	sent := f.sent
+	f.sent = nil
+	return sent
+}
+
+func (f *FakeTransport) Transfer(buf []byte) error {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	if len(buf) < 2 {
+		return fmt.Errorf("Short SPI transfer of %d bytes", len(buf))
+	}
+	req := make([]byte, len(buf))
+	copy(req, buf)
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	switch req[0] {
+	case SPI_OP_NULL:
+	case SPI_OP_RESET:
+		f.Resets++
+		f.stored = nil
+		f.pending = nil
+		f.Status = 0
+	case SPI_OP_DEVICE_INFO:
+		if len(buf) < 19 {
+			return fmt.Errorf("SPI_OP_DEVICE_INFO: short transfer of %d bytes", len(buf))
+		}
+		copy(buf[1:5], f.Signature[:])
+		buf[5] = f.VersionMajor
+		buf[6] = f.VersionMinor
+		copy(buf[7:19], f.ChipId[:])
+	case SPI_OP_POWER_LEVEL:
+		if len(buf) < 11 {
+			return fmt.Errorf("SPI_OP_POWER_LEVEL: short transfer of %d bytes", len(buf))
+		}
+		buf[1] = byte(f.Status)
+		copy(buf[3:11], f.Levels[:])
+	case SPI_OP_SET_POWER:
+		f.setStatus(device.STATUS_POWERED, req[1] != 0)
+	case SPI_OP_SET_CAN_RES:
+		f.setStatus(device.STATUS_CAN_RES, req[1] != 0)
+	case SPI_OP_SET_CURRENT_LIMIT:
+		if len(req) < 3 {
+			return fmt.Errorf("SPI_OP_SET_CURRENT_LIMIT: short transfer of %d bytes", len(req))
+		}
+		f.CurrentLimit = (uint16(req[1]) << 8) | uint16(req[2])
+	case SPI_OP_STATUS:
+		buf[1] = byte(f.Status)
+	case SPI_OP_STORE_DATA:
+		if len(req) < 15 || req[1] != 13 {
+			return fmt.Errorf("SPI_OP_STORE_DATA: expected 13 bytes of data")
+		}
+		frame, err := can.DecodeFrame(req[2:15])
+		if err != nil {
+			return err
+		}
+		f.stored = frame
+	case SPI_OP_SEND_REQ:
+		if f.stored == nil {
+			buf[1] = SPI_ERR_BYTE
+			break
+		}
+		f.sent = append(f.sent, *f.stored)
+		f.stored = nil
+		buf[1] = SPI_OK_BYTE
+	case SPI_OP_FETCH_DATA:
+		if len(buf) < 15 {
+			return fmt.Errorf("SPI_OP_FETCH_DATA: short transfer of %d bytes", len(buf))
+		}
+		if len(f.pending) == 0 {
+			buf[1] = SPI_ERR_BYTE
+			break
+		}
+		buf[1] = 13
+		return can.EncodeFrame(&f.pending[0], buf[2:15])
+	case SPI_OP_RECV_ACK:
+		if len(f.pending) == 0 {
+			buf[1] = SPI_ERR_BYTE
+			break
+		}
+		f.pending = f.pending[1:]
+		if len(f.pending) == 0 {
+			f.Status &^= device.STATUS_RX_PENDING
+		}
+		buf[1] = SPI_OK_BYTE
+	default:
+		return fmt.Errorf("Unknown SPI opcode %d", req[0])
+	}
+	return nil
+}
+
+func (f *FakeTransport) setStatus(bit device.StatusByte, set bool) {
+	if set {
+		f.Status |= bit
+	} else {
+		f.Status &^= bit
+	}
+}
+
+func (f *FakeTransport) Close() error {
+	return nil
+}
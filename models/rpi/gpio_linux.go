@@ -0,0 +1,204 @@
+//go:build linux
+// +build linux
+
+package rpi
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// ioctl requests of the GPIO character device (v1 ABI) in <linux/gpio.h>
+const (
+	GPIO_GET_CHIPINFO_IOCTL          = 0x8044B401
+	GPIO_GET_LINEHANDLE_IOCTL        = 0xC16CB403
+	GPIO_GET_LINEEVENT_IOCTL         = 0xC030B404
+	GPIOHANDLE_GET_LINE_VALUES_IOCTL = 0xC040B408
+)
+
+const (
+	GPIOHANDLE_REQUEST_INPUT          = 1 << 0
+	GPIOHANDLE_REQUEST_BIAS_PULL_DOWN = 1 << 6
+
+	GPIOEVENT_REQUEST_RISING_EDGE  = 1 << 0
+	GPIOEVENT_REQUEST_FALLING_EDGE = 1 << 1
+
+	GPIOEVENT_DATA_SIZE = 16
+)
+
+type gpiochipInfo struct {
+	name  [32]byte
+	label [32]byte
+	lines uint32
+}
+
+type gpiohandleRequest struct {
+	lineOffsets   [64]uint32
+	flags         uint32
+	defaultValues [64]uint8
+	consumerLabel [32]byte
+	lines         uint32
+	fd            int32
+}
+
+type gpioeventRequest struct {
+	lineOffset    uint32
+	handleFlags   uint32
+	eventFlags    uint32
+	consumerLabel [32]byte
+	fd            int32
+}
+
+type gpiohandleData struct {
+	values [64]uint8
+}
+
+// The labels of the chips driving the 40-pin header, on the BCM283x/BCM2711
+// and on the RP1 of the Raspberry Pi 5.
+var gpioChipLabels = []string{"pinctrl-bcm2", "pinctrl-rp1"}
+
+// findGpioChip returns the GPIO character device that drives the Raspberry Pi
+// header, or /dev/gpiochip0 if none is recognized.
+func findGpioChip() string {
+	chips, _ := filepath.Glob("/dev/gpiochip*")
+	for _, chip := range chips {
+		fd, err := unix.Open(chip, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			continue
+		}
+		var info gpiochipInfo
+		err = ioctl(fd, GPIO_GET_CHIPINFO_IOCTL, unsafe.Pointer(&info))
+		unix.Close(fd)
+		if err != nil {
+			continue
+		}
+		label := cString(info.label[:])
+		for _, prefix := range gpioChipLabels {
+			if strings.HasPrefix(label, prefix) {
+				return chip
+			}
+		}
+	}
+	return "/dev/gpiochip0"
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// GpioLine
+//
+// GpioLine is an input line requested from a GPIO character device, with
+// optional edge events.
+type GpioLine struct {
+	Offset uint32
+	file   *os.File
+}
+
+func openGpioChip(chip string) (int, error) {
+	fd, err := unix.Open(chip, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("Could not open GPIO device %s: %s", chip, err)
+	}
+	return fd, nil
+}
+
+// RequestGpioEvents requests a line as an input and reports the edges
+// selected by event_flags. If the kernel does not support the requested bias,
+// the line is requested again without it.
+func RequestGpioEvents(chip string, offset uint32, handle_flags uint32, event_flags uint32) (*GpioLine, error) {
+	fd, err := openGpioChip(chip)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	req := gpioeventRequest{lineOffset: offset, handleFlags: GPIOHANDLE_REQUEST_INPUT | handle_flags, eventFlags: event_flags}
+	copy(req.consumerLabel[:], "nocand")
+
+	err = ioctl(fd, GPIO_GET_LINEEVENT_IOCTL, unsafe.Pointer(&req))
+	if err == unix.EINVAL && handle_flags != 0 {
+		req.handleFlags = GPIOHANDLE_REQUEST_INPUT
+		err = ioctl(fd, GPIO_GET_LINEEVENT_IOCTL, unsafe.Pointer(&req))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not request GPIO line %d on %s: %s", offset, chip, err)
+	}
+	// Non-blocking, so that os.File uses the runtime poller and read
+	// deadlines work.
+	if err := unix.SetNonblock(int(req.fd), true); err != nil {
+		unix.Close(int(req.fd))
+		return nil, err
+	}
+	return &GpioLine{Offset: offset, file: os.NewFile(uintptr(req.fd), fmt.Sprintf("%s:%d", chip, offset))}, nil
+}
+
+// RequestGpioInput requests a line as an input, without events.
+func RequestGpioInput(chip string, offset uint32) (*GpioLine, error) {
+	fd, err := openGpioChip(chip)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	req := gpiohandleRequest{flags: GPIOHANDLE_REQUEST_INPUT, lines: 1}
+	req.lineOffsets[0] = offset
+	copy(req.consumerLabel[:], "nocand")
+
+	if err := ioctl(fd, GPIO_GET_LINEHANDLE_IOCTL, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("Could not request GPIO line %d on %s: %s", offset, chip, err)
+	}
+	return &GpioLine{Offset: offset, file: os.NewFile(uintptr(req.fd), fmt.Sprintf("%s:%d", chip, offset))}, nil
+}
+
+// Value returns the current level of the line, 0 or 1.
+func (l *GpioLine) Value() (int, error) {
+	var data gpiohandleData
+
+	conn, err := l.file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var ioerr error
+	err = conn.Control(func(fd uintptr) {
+		ioerr = ioctl(int(fd), GPIOHANDLE_GET_LINE_VALUES_IOCTL, unsafe.Pointer(&data))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if ioerr != nil {
+		return 0, ioerr
+	}
+	return int(data.values[0]), nil
+}
+
+// WaitEdge waits for at most timeout for edge events on the line, and
+// returns true if at least one was received. Pending events are consumed.
+func (l *GpioLine) WaitEdge(timeout time.Duration) (bool, error) {
+	var buf [16 * GPIOEVENT_DATA_SIZE]byte
+
+	l.file.SetReadDeadline(time.Now().Add(timeout))
+	_, err := l.file.Read(buf[:])
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *GpioLine) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,241 @@
+//go:build linux
+// +build linux
+
+package rpi
+
+import (
+	"errors"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"os"
+	"time"
+)
+
+// CAN_RX is on BCM GPIO 25, active low while frames are waiting.
+// CAN_TX is on BCM GPIO 22, high when the PiMaster can accept a new frame.
+// MCU_RESET is on BCM GPIO 26, kept as an input to avoid leaving the MCU stuck at reset.
+const (
+	CAN_RX_PIN    = 25
+	CAN_TX_PIN    = 22
+	MCU_RESET_PIN = 26
+)
+
+const (
+	TX_READY_TIMEOUT = 3 * time.Second
+	TX_READY_POLL    = 100 * time.Millisecond
+	RX_POLL          = 1 * time.Second
+)
+
+var ErrTransmitTimeout = errors.New("Timeout waiting for the PiMaster to accept a CAN frame")
+
+var rxLine, txLine, resetLine *GpioLine
+
+func closeLines() {
+	for _, line := range []**GpioLine{&rxLine, &txLine, &resetLine} {
+		if *line != nil {
+			(*line).Close()
+			*line = nil
+		}
+	}
+}
+
+func DriverInitialize(reset bool, spi_device string, gpio_chip string, speed uint) (*device.Information, error) {
+	var err error
+
+	DriverReady = false
+
+	closeLines()
+	SetTransport(nil)
+
+	if gpio_chip == "" {
+		gpio_chip = findGpioChip()
+	}
+	if resetLine, err = RequestGpioInput(gpio_chip, MCU_RESET_PIN); err != nil {
+		return nil, err
+	}
+	if txLine, err = RequestGpioEvents(gpio_chip, CAN_TX_PIN, GPIOHANDLE_REQUEST_BIAS_PULL_DOWN, GPIOEVENT_REQUEST_RISING_EDGE); err != nil {
+		closeLines()
+		return nil, err
+	}
+	if rxLine, err = RequestGpioEvents(gpio_chip, CAN_RX_PIN, 0, GPIOEVENT_REQUEST_FALLING_EDGE); err != nil {
+		closeLines()
+		return nil, err
+	}
+	clog.Info("Using GPIO device %s", gpio_chip)
+
+	spi, err := OpenSpiDev(spi_device, speed)
+	if err != nil {
+		closeLines()
+		return nil, err
+	}
+	SetTransport(spi)
+	clog.Info("Connected to driver using SPI interface %s at %d bps", spi_device, speed)
+
+	if reset {
+		clog.Info("Reseting driver")
+		if err := DriverReset(); err != nil {
+			return nil, err
+		}
+	}
+
+	clog.DebugX("Waiting for TX line to be HIGH")
+	for {
+		level, err := txLine.Value()
+		if err != nil {
+			return nil, err
+		}
+		if level != 0 {
+			break
+		}
+		if _, err := txLine.WaitEdge(TX_READY_POLL); err != nil {
+			return nil, err
+		}
+	}
+	clog.DebugX("TX line is HIGH")
+
+	info, err := DriverCheckSignature()
+	if err != nil {
+		return nil, fmt.Errorf("SPI driver signature check failed: %s", err)
+	}
+	clog.Info("Driver signature verified.")
+
+	go receiveLoop(rxLine)
+	DriverReady = true
+
+	return info, nil
+}
+
+// receiveLoop fetches frames while the RX line is low, and then sleeps until
+// the next falling edge. It checks the line every RX_POLL in case an edge was
+// missed, and exits when the line is closed.
+func receiveLoop(line *GpioLine) {
+	for {
+		for {
+			level, err := line.Value()
+			if err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					clog.Error("Failed to read RX line: %s", err)
+				}
+				return
+			}
+			if level != 0 {
+				break
+			}
+			frame, err := DriverRecvCanFrame()
+			if err != nil {
+				clog.Error(err.Error())
+				break
+			}
+			CanRxChannel <- *frame
+		}
+		if _, err := line.WaitEdge(RX_POLL); err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				clog.Error("Failed to wait for RX line: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// DriverSendCanFrame waits until the PiMaster is ready to transmit, for at most
+// TX_READY_TIMEOUT, and hands it the frame.
+func DriverSendCanFrame(frame can.Frame) error {
+	TxMutex.Lock()
+	defer TxMutex.Unlock()
+
+	if err := waitTxReady(TX_READY_TIMEOUT); err != nil {
+		clog.Warning("Microcontroller transmission has been blocking for more than %s on frame %s.", TX_READY_TIMEOUT, frame)
+		return err
+	}
+	if err := driverSendCanFrame(&frame); err != nil {
+		clog.Error("Failed to send CAN frame - %s", err)
+		return err
+	}
+	clog.DebugXX("SEND FRAME %s", frame)
+	return nil
+}
+
+// waitTxReady sleeps until the TX line goes high. It is woken up by rising
+// edges, and also checks the line every TX_READY_POLL in case an edge was
+// missed.
+func waitTxReady(timeout time.Duration) error {
+	if txLine == nil {
+		return fmt.Errorf("Driver is not available")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		level, err := txLine.Value()
+		if err != nil {
+			return err
+		}
+		if level != 0 {
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrTransmitTimeout
+		}
+		if remaining > TX_READY_POLL {
+			remaining = TX_READY_POLL
+		}
+		if _, err := txLine.WaitEdge(remaining); err != nil {
+			return err
+		}
+	}
+}
+
+// PiMasterDriver
+//
+// PiMasterDriver implements device.Driver for the PiMaster HAT, using the
+// Linux spidev and GPIO character devices.
+type PiMasterDriver struct {
+	SpiDevice string
+	GpioChip  string
+	SpiSpeed  uint
+}
+
+// NewDriver creates a PiMaster driver. If gpio_chip is empty, the GPIO device
+// of the Raspberry Pi header is detected automatically.
+func NewDriver(spi_device string, gpio_chip string, spi_speed uint) *PiMasterDriver {
+	return &PiMasterDriver{SpiDevice: spi_device, GpioChip: gpio_chip, SpiSpeed: spi_speed}
+}
+
+func (d *PiMasterDriver) Initialize(reset bool) (*device.Information, error) {
+	return DriverInitialize(reset, d.SpiDevice, d.GpioChip, d.SpiSpeed)
+}
+
+func (d *PiMasterDriver) Reset() error {
+	return DriverReset()
+}
+
+func (d *PiMasterDriver) DeviceInfo() (*device.Information, error) {
+	return DriverReadDeviceInfo()
+}
+
+func (d *PiMasterDriver) SendFrame(frame *can.Frame) error {
+	return DriverSendCanFrame(*frame)
+}
+
+func (d *PiMasterDriver) RecvFrame() (*can.Frame, error) {
+	frame := <-CanRxChannel
+	return &frame, nil
+}
+
+func (d *PiMasterDriver) SetPower(powered bool) error {
+	return DriverSetPower(powered)
+}
+
+func (d *PiMasterDriver) SetCurrentLimit(limit uint16) error {
+	return DriverSetCurrentLimit(limit)
+}
+
+func (d *PiMasterDriver) SetTerminationResistor(set bool) error {
+	return DriverSetCanResistor(set)
+}
+
+func (d *PiMasterDriver) PowerStatus() (*device.PowerStatus, error) {
+	return DriverUpdatePowerStatus()
+}
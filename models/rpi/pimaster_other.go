@@ -0,0 +1,62 @@
+//go:build !linux
+// +build !linux
+
+package rpi
+
+import (
+	"errors"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+)
+
+var errNotLinux = errors.New("The PiMaster driver is only supported on Linux")
+
+// PiMasterDriver
+//
+// The PiMaster driver relies on the Linux spidev and GPIO character devices:
+// on other systems it always fails.
+type PiMasterDriver struct {
+	SpiDevice string
+	GpioChip  string
+	SpiSpeed  uint
+}
+
+func NewDriver(spi_device string, gpio_chip string, spi_speed uint) *PiMasterDriver {
+	return &PiMasterDriver{SpiDevice: spi_device, GpioChip: gpio_chip, SpiSpeed: spi_speed}
+}
+
+func (d *PiMasterDriver) Initialize(reset bool) (*device.Information, error) {
+	return nil, errNotLinux
+}
+
+func (d *PiMasterDriver) Reset() error {
+	return errNotLinux
+}
+
+func (d *PiMasterDriver) DeviceInfo() (*device.Information, error) {
+	return nil, errNotLinux
+}
+
+func (d *PiMasterDriver) SendFrame(frame *can.Frame) error {
+	return errNotLinux
+}
+
+func (d *PiMasterDriver) RecvFrame() (*can.Frame, error) {
+	return nil, errNotLinux
+}
+
+func (d *PiMasterDriver) SetPower(powered bool) error {
+	return errNotLinux
+}
+
+func (d *PiMasterDriver) SetCurrentLimit(limit uint16) error {
+	return errNotLinux
+}
+
+func (d *PiMasterDriver) SetTerminationResistor(set bool) error {
+	return errNotLinux
+}
+
+func (d *PiMasterDriver) PowerStatus() (*device.PowerStatus, error) {
+	return nil, errNotLinux
+}
@@ -1,28 +1,11 @@
 package rpi
 
-/*
-#cgo LDFLAGS: -lwiringPi
-#include <wiringPiSPI.h>
-#include "glue.h"
-*/
-import "C"
-import "fmt"
-
-//import "encoding/hex"
-import "github.com/omzlo/clog"
-import "github.com/omzlo/nocand/models/can"
-import "github.com/omzlo/nocand/models/device"
-import "sync"
-import "time"
-
-const (
-	SpiChannel C.int = 0
-	SpiSpeed   C.int = 250000
-)
-
-const (
-	WITHOUT_RESET = false
-	WITH_RESET    = true
+import (
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"sync"
 )
 
 const (
@@ -62,42 +45,48 @@ const (
 )
 
 var SPIMutex sync.Mutex
-var CanTxChannel chan (can.Frame)
-var CanRxChannel chan (can.Frame)
+var TxMutex sync.Mutex
+var CanRxChannel chan (can.Frame) = make(chan (can.Frame), 1000)
 var DriverReady = false
-var trCounter uint = 0
 
-func SPITransfer(buf []byte) error {
-	var block [128]C.uchar
-	//var counter uint
+// Transport
+//
+// Transport performs full-duplex SPI transfers with the PiMaster
+// microcontroller: buf is sent and overwritten with the bytes received.
+type Transport interface {
+	Transfer(buf []byte) error
+	Close() error
+}
 
-	//counter = trCounter
-	trCounter++
+var spiTransport Transport
 
-	lbuf := len(buf)
+// SetTransport selects the SPI transport used by the functions below, such
+// as the fake PiMaster used by the tests. The previous transport, if any, is
+// closed.
+func SetTransport(t Transport) {
+	SPIMutex.Lock()
+	defer SPIMutex.Unlock()
 
-	if lbuf > 128 {
-		return fmt.Errorf("SPI.Transfer: data must be less than 128 bytes")
+	if spiTransport != nil {
+		spiTransport.Close()
 	}
+	spiTransport = t
+}
 
-	for i := 0; i < lbuf; i++ {
-		block[i] = C.uchar(buf[i])
+func SPITransfer(buf []byte) error {
+	if len(buf) > 128 {
+		return fmt.Errorf("SPI.Transfer: data must be less than 128 bytes")
 	}
 
-	//clog.DebugX("(%d) SPI SEND %d: %s (%s)", counter, lbuf, hex.EncodeToString(buf), spi_op_names[buf[0]])
-
 	SPIMutex.Lock()
-	r := C.wiringPiSPIDataRW(SpiChannel, &block[0], C.int(len(buf)))
-	SPIMutex.Unlock()
+	defer SPIMutex.Unlock()
 
-	if r < 0 {
-		return fmt.Errorf("SPI.Transfer: transfer error")
+	if spiTransport == nil {
+		return fmt.Errorf("SPI.Transfer: no SPI device")
 	}
-
-	for i := 0; i < lbuf; i++ {
-		buf[i] = byte(block[i])
+	if err := spiTransport.Transfer(buf); err != nil {
+		return fmt.Errorf("SPI.Transfer: transfer error, %s", err)
 	}
-	//clog.DebugX("(%d) SPI RECV %d: %s", counter, lbuf, hex.EncodeToString(buf))
 	return nil
 }
 
@@ -278,11 +267,6 @@ func driverSendCanFrame(frame *can.Frame) error {
 	return DriverSendReq()
 }
 
-func DriverSendCanFrame(frame can.Frame) error {
-	CanTxChannel <- frame
-	return nil
-}
-
 func DriverCheckSignature() (*device.Information, error) {
 	info, err := DriverReadDeviceInfo()
 	if err != nil {
@@ -294,107 +278,3 @@ func DriverCheckSignature() (*device.Information, error) {
 	}
 	return nil, fmt.Errorf("Driver signature mismatch: %q", info.Signature)
 }
-
-func DriverInitialize(reset bool, speed uint) (*device.Information, error) {
-	DriverReady = false
-
-	C.setup_wiring_pi()
-
-	r := C.wiringPiSPISetup(SpiChannel, C.int(speed))
-	if r < 0 {
-		return nil, fmt.Errorf("Could not open SPI device")
-	}
-	clog.Info("Connected to driver using SPI interface at %d bps", speed)
-	if C.digitalReadCE0() == 0 {
-		clog.Warning("Raspberry Pi SPI pin CE0 is low, this could indicate you board is misconfigured or damaged.")
-	}
-
-	if reset {
-		clog.Info("Reseting driver")
-		if err := DriverReset(); err != nil {
-			return nil, err
-		}
-	}
-
-	clog.DebugX("Waiting for TX line to be HIGH")
-	for C.digitalReadTx() == 0 {
-		time.Sleep(100 * time.Millisecond)
-	}
-	clog.DebugX("TX line is HIGH")
-
-	info, err := DriverCheckSignature()
-	if err != nil {
-		return nil, fmt.Errorf("SPI driver signature check failed: %s", err)
-	}
-	clog.Info("Driver signature verified.")
-	C.setup_interrupts()
-	if C.digitalReadRx() == 0 {
-		CanRxInterrupt()
-		clog.Warning("RX line was in an unexpected state. Nocand attempted to correct the issue.")
-	}
-
-	DriverReady = true
-
-	return info, nil
-}
-
-//export CanRxInterrupt
-func CanRxInterrupt() {
-	for C.digitalReadRx() == 0 {
-		frame, e := DriverRecvCanFrame()
-		if e != nil {
-			clog.Error(e.Error())
-			break
-		}
-		CanRxChannel <- *frame
-	}
-}
-
-func init() {
-	CanTxChannel = make(chan (can.Frame), 32)
-	CanRxChannel = make(chan (can.Frame), 1000)
-
-	go func() {
-		for {
-			frame := <-CanTxChannel
-			start := time.Now()
-			for C.digitalReadTx() == 0 {
-				now := time.Now()
-				for C.digitalReadTx() == 0 && time.Since(now).Seconds() < 3 {
-				}
-				if C.digitalReadTx() == 0 {
-					clog.Warning("Microcontroller transmission has been blocking for more than %d seconds on frame %s.", int(time.Since(start).Seconds()), frame)
-				}
-			}
-			if err := driverSendCanFrame(&frame); err != nil {
-				clog.Error("Failed to send CAN frame - %s", err)
-			}
-			clog.DebugXX("SEND FRAME %s", frame)
-
-		}
-	}()
-
-	/* Alternative to CanRxInterrupt */
-	/* ---
-	go func() {
-		for !DriverReady {
-			time.Sleep(10 * time.Millisecond)
-		}
-		for {
-			if C.digitalReadRx() == 0 {
-				for C.digitalReadRx() == 0 {
-					frame, e := DriverRecvCanFrame()
-					if e != nil {
-						clog.Error(e.Error())
-						break
-					}
-					//clog.DebugXX("RECV FRAME %s", frame)
-					CanRxChannel <- *frame
-				}
-			} else {
-				time.Sleep(1 * time.Millisecond)
-			}
-		}
-	}()
-	*/
-}
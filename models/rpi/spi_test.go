@@ -0,0 +1,139 @@
+package rpi
+
+import (
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"testing"
+)
+
+func useFakeTransport(t *testing.T) *FakeTransport {
+	fake := NewFakeTransport()
+	SetTransport(fake)
+	t.Cleanup(func() { SetTransport(nil) })
+	return fake
+}
+
+func TestDriverRecvCanFrame(t *testing.T) {
+	fake := useFakeTransport(t)
+
+	frames := []can.Frame{
+		{CanId: can.CANID_MASK_EXTENDED | 0x00123456, Dlc: 8, Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{CanId: can.CANID_MASK_EXTENDED | can.CANID_MASK_REMOTE | 0x00000042, Dlc: 0},
+	}
+	for i := range frames {
+		fake.Inject(&frames[i])
+	}
+
+	for _, expected := range frames {
+		frame, err := DriverRecvCanFrame()
+		if err != nil {
+			t.Fatalf("DriverRecvCanFrame failed: %s", err)
+		}
+		if *frame != expected {
+			t.Errorf("DriverRecvCanFrame returned %s, expected %s", frame, expected)
+		}
+	}
+
+	status, err := DriverStatus()
+	if err != nil {
+		t.Fatalf("DriverStatus failed: %s", err)
+	}
+	if (status & device.STATUS_RX_PENDING) != 0 {
+		t.Errorf("RX pending is still set after all frames were acknowledged: %s", status)
+	}
+
+	if frame, err := DriverRecvCanFrame(); err == nil {
+		t.Errorf("DriverRecvCanFrame returned %s, expected an error with no pending frame", frame)
+	}
+}
+
+func TestDriverSendCanFrame(t *testing.T) {
+	fake := useFakeTransport(t)
+
+	frames := []can.Frame{
+		{CanId: can.CANID_MASK_EXTENDED | 0x00ABCDEF, Dlc: 3, Data: [8]byte{'a', 'b', 'c'}},
+		{CanId: can.CANID_MASK_EXTENDED | 0x00000001, Dlc: 0},
+	}
+	for i := range frames {
+		if err := driverSendCanFrame(&frames[i]); err != nil {
+			t.Fatalf("driverSendCanFrame(%s) failed: %s", frames[i], err)
+		}
+	}
+
+	sent := fake.Sent()
+	if len(sent) != len(frames) {
+		t.Fatalf("PiMaster sent %d frames, expected %d", len(sent), len(frames))
+	}
+	for i := range frames {
+		if sent[i] != frames[i] {
+			t.Errorf("PiMaster sent %s, expected %s", sent[i], frames[i])
+		}
+	}
+
+	// A send request without stored data is rejected by the PiMaster.
+	if err := DriverSendReq(); err == nil {
+		t.Errorf("DriverSendReq succeeded without stored data")
+	}
+	if sent := fake.Sent(); len(sent) != 0 {
+		t.Errorf("PiMaster sent %d frames after a failed request", len(sent))
+	}
+}
+
+func TestDriverCheckSignature(t *testing.T) {
+	fake := useFakeTransport(t)
+	fake.VersionMajor = 2
+	fake.VersionMinor = 3
+	fake.ChipId = [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+	info, err := DriverCheckSignature()
+	if err != nil {
+		t.Fatalf("DriverCheckSignature failed: %s", err)
+	}
+	if info.Type != piMasterType || info.VersionMajor != 2 || info.VersionMinor != 3 || info.ChipId != fake.ChipId {
+		t.Errorf("Unexpected device information %s", info)
+	}
+
+	fake.Signature = [4]byte{'X', 'X', 'X', 'X'}
+	if _, err := DriverCheckSignature(); err == nil {
+		t.Errorf("DriverCheckSignature accepted signature %q", fake.Signature)
+	}
+}
+
+func TestDriverPowerControl(t *testing.T) {
+	fake := useFakeTransport(t)
+
+	if err := DriverSetPower(true); err != nil {
+		t.Fatalf("DriverSetPower failed: %s", err)
+	}
+	if err := DriverSetCanResistor(true); err != nil {
+		t.Fatalf("DriverSetCanResistor failed: %s", err)
+	}
+	if err := DriverSetCurrentLimit(0x1234); err != nil {
+		t.Fatalf("DriverSetCurrentLimit failed: %s", err)
+	}
+
+	status, err := DriverStatus()
+	if err != nil {
+		t.Fatalf("DriverStatus failed: %s", err)
+	}
+	if (status&device.STATUS_POWERED) == 0 || (status&device.STATUS_CAN_RES) == 0 {
+		t.Errorf("Unexpected status %s after enabling power and the resistor", status)
+	}
+	if fake.CurrentLimit != 0x1234 {
+		t.Errorf("Current limit is 0x%x, expected 0x1234", fake.CurrentLimit)
+	}
+
+	if err := DriverSetPower(false); err != nil {
+		t.Fatalf("DriverSetPower failed: %s", err)
+	}
+	if status, _ = DriverStatus(); (status & device.STATUS_POWERED) != 0 {
+		t.Errorf("Unexpected status %s after disabling power", status)
+	}
+}
+
+func TestSPITransferWithoutTransport(t *testing.T) {
+	SetTransport(nil)
+	if _, err := DriverStatus(); err == nil {
+		t.Errorf("DriverStatus succeeded without an SPI transport")
+	}
+}
@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package rpi
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// ioctl requests of <linux/spi/spidev.h>
+const (
+	SPI_IOC_WR_MODE          = 0x40016B01
+	SPI_IOC_WR_BITS_PER_WORD = 0x40016B03
+	SPI_IOC_WR_MAX_SPEED_HZ  = 0x40046B04
+	SPI_IOC_MESSAGE_1        = 0x40206B00
+)
+
+// Layout of struct spi_ioc_transfer in <linux/spi/spidev.h>
+type spiIocTransfer struct {
+	txBuf       uint64
+	rxBuf       uint64
+	length      uint32
+	speedHz     uint32
+	delayUsecs  uint16
+	bitsPerWord uint8
+	csChange    uint8
+	txNbits     uint8
+	rxNbits     uint8
+	wordDelay   uint8
+	pad         uint8
+}
+
+// SpiDev
+//
+// SpiDev implements Transport on top of the Linux spidev interface, such as
+// /dev/spidev0.0, in SPI mode 0 with 8 bits per word.
+type SpiDev struct {
+	fd    int
+	speed uint32
+}
+
+func OpenSpiDev(dev string, speed uint) (*SpiDev, error) {
+	fd, err := unix.Open(dev, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open SPI device %s: %s", dev, err)
+	}
+
+	mode := uint8(0)
+	bits := uint8(8)
+	max_speed := uint32(speed)
+	for _, opt := range []struct {
+		req uintptr
+		arg unsafe.Pointer
+	}{
+		{SPI_IOC_WR_MODE, unsafe.Pointer(&mode)},
+		{SPI_IOC_WR_BITS_PER_WORD, unsafe.Pointer(&bits)},
+		{SPI_IOC_WR_MAX_SPEED_HZ, unsafe.Pointer(&max_speed)},
+	} {
+		if err := ioctl(fd, opt.req, opt.arg); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("Could not configure SPI device %s: %s", dev, err)
+		}
+	}
+	return &SpiDev{fd: fd, speed: max_speed}, nil
+}
+
+func (s *SpiDev) Transfer(buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	tr := spiIocTransfer{
+		txBuf:       uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		rxBuf:       uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		length:      uint32(len(buf)),
+		speedHz:     s.speed,
+		bitsPerWord: 8,
+	}
+	return ioctl(s.fd, SPI_IOC_MESSAGE_1, unsafe.Pointer(&tr))
+}
+
+func (s *SpiDev) Close() error {
+	return unix.Close(s.fd)
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package simulator
+
+import (
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"github.com/omzlo/nocand/models/nocan"
+	"sync"
+)
+
+// Bus
+//
+// Bus is a software CAN bus shared by simulated nodes. It implements
+// device.Driver, so a NocanNetworkController can use it in place of a
+// PiMaster: frames sent by the controller reach every node, and frames sent
+// by nodes reach the controller.
+type Bus struct {
+	Mutex        sync.Mutex
+	Nodes        []*Node
+	rxChannel    chan *can.Frame
+	txMutex      sync.Mutex
+	powered      bool
+	resistor     bool
+	currentLimit uint16
+}
+
+func NewBus() *Bus {
+	return &Bus{rxChannel: make(chan *can.Frame, 1000), resistor: true}
+}
+
+// AddNode attaches a node to the bus. The node starts immediately if the bus
+// is powered.
+func (b *Bus) AddNode(node *Node) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	node.bus = b
+	b.Nodes = append(b.Nodes, node)
+	if b.powered {
+		node.start()
+	}
+}
+
+func (b *Bus) nodes() []*Node {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	nodes := make([]*Node, len(b.Nodes))
+	copy(nodes, b.Nodes)
+	return nodes
+}
+
+// transmit puts the frames of a message sent by a node on the bus.
+// Publish frames are also seen by the other nodes.
+func (b *Bus) transmit(sender *Node, frames []can.Frame) {
+	b.txMutex.Lock()
+	defer b.txMutex.Unlock()
+
+	for i := range frames {
+		frame := frames[i]
+		b.rxChannel <- &frame
+		if (frame.CanId & nocan.NOCANID_MASK_SYSTEM) == 0 {
+			for _, node := range b.nodes() {
+				if node != sender {
+					node.receiveFrame(&frame)
+				}
+			}
+		}
+	}
+}
+
+func (b *Bus) Initialize(reset bool) (*device.Information, error) {
+	clog.Info("Using simulated bus with %d node(s)", len(b.nodes()))
+	return b.DeviceInfo()
+}
+
+func (b *Bus) Reset() error {
+	return nil
+}
+
+func (b *Bus) DeviceInfo() (*device.Information, error) {
+	info := &device.Information{}
+	copy(info.Type[:], "SIMULATE")
+	copy(info.Signature[:], "CAN0")
+	return info, nil
+}
+
+func (b *Bus) SendFrame(frame *can.Frame) error {
+	f := *frame
+	clog.DebugXX("SEND FRAME %s", f)
+	for _, node := range b.nodes() {
+		node.receiveFrame(&f)
+	}
+	return nil
+}
+
+func (b *Bus) RecvFrame() (*can.Frame, error) {
+	return <-b.rxChannel, nil
+}
+
+func (b *Bus) SetPower(powered bool) error {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	if powered == b.powered {
+		return nil
+	}
+	b.powered = powered
+	for _, node := range b.Nodes {
+		if powered {
+			node.start()
+		} else {
+			node.stop()
+		}
+	}
+	return nil
+}
+
+func (b *Bus) SetCurrentLimit(limit uint16) error {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	b.currentLimit = limit
+	return nil
+}
+
+func (b *Bus) SetTerminationResistor(set bool) error {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	b.resistor = set
+	return nil
+}
+
+// PowerStatus reports plausible values: 12V and ~20mA per powered node.
+func (b *Bus) PowerStatus() (*device.PowerStatus, error) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	status := &device.PowerStatus{RefLevel: 1.2}
+	if b.powered {
+		status.Status |= device.STATUS_POWERED
+		status.Voltage = 12.0
+		status.CurrentSense = uint16(13 * len(b.Nodes))
+	}
+	if b.resistor {
+		status.Status |= device.STATUS_CAN_RES
+	}
+	return status, nil
+}
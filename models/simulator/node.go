@@ -0,0 +1,501 @@
+package simulator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/nocan"
+	"hash/crc32"
+	"sync"
+	"time"
+)
+
+/*
+ * Simulated nodes emulate a SAMD21G18 based NoCAN node, with the same
+ * constants as the ones used by controllers/firmware.go.
+ */
+const (
+	FLASH_LENGTH       uint32 = 0x40000
+	FLASH_APP_ORIGIN   uint32 = 0x2000
+	BOOTLOADER_TIMEOUT        = 2 * time.Second
+	RETRY_DELAY               = 1 * time.Second
+)
+
+var FLASH_DEVICE_SIGNATURE = [4]byte{0x10, 0x01, 0x00, 0x05}
+
+var (
+	errStopped = errors.New("Node stopped")
+	errReset   = errors.New("Node reset")
+	errTimeout = errors.New("Timeout")
+)
+
+// GenerateUdid returns a predictable udid for the i-th simulated node.
+func GenerateUdid(i uint) models.Udid8 {
+	return models.Udid8{'S', 'I', 'M', 0, 0, 0, byte(i >> 8), byte(i)}
+}
+
+// Node
+//
+// Node is a virtual NoCAN node. Once its bus is powered, it requests an
+// address, runs its bootloader, then registers Channels, looks up and
+// subscribes to Subscriptions, and publishes a counter on its first channel
+// every PublishInterval.
+type Node struct {
+	Udid            models.Udid8
+	FirmwareVersion uint8
+	Channels        []string
+	Subscriptions   []string
+	PublishInterval time.Duration
+	Flash           []byte
+	OnPublish       func(node *Node, channel string, value []byte)
+
+	Mutex    sync.Mutex
+	id       nocan.NodeId
+	channels map[string]nocan.ChannelId
+	names    map[nocan.ChannelId]string
+	pending  map[nocan.NodeId]*nocan.Message
+	bus      *Bus
+	input    chan *nocan.Message
+	quit     chan struct{}
+	running  bool
+}
+
+func NewNode(udid models.Udid8) *Node {
+	flash := make([]byte, FLASH_LENGTH)
+	for i := range flash {
+		flash[i] = 0xFF
+	}
+	return &Node{
+		Udid:            udid,
+		FirmwareVersion: 3,
+		Flash:           flash,
+		channels:        make(map[string]nocan.ChannelId),
+		names:           make(map[nocan.ChannelId]string),
+		pending:         make(map[nocan.NodeId]*nocan.Message),
+	}
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("simulated node %s", n.Udid)
+}
+
+// Id returns the node id assigned by the controller, or 0 if the node has
+// no address yet.
+func (n *Node) Id() nocan.NodeId {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	return n.id
+}
+
+// ChannelId returns the id of a channel registered or looked up by the node.
+func (n *Node) ChannelId(name string) (nocan.ChannelId, bool) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	cid, ok := n.channels[name]
+	return cid, ok
+}
+
+// Publish sends a value on a channel that the node registered or looked up.
+func (n *Node) Publish(name string, value []byte) error {
+	n.Mutex.Lock()
+	id := n.id
+	cid, ok := n.channels[name]
+	n.Mutex.Unlock()
+
+	if !ok || id == 0 {
+		return fmt.Errorf("Channel %s is not known by %s", name, n)
+	}
+	n.send(nocan.NewPublishMessage(id, cid, value))
+	return nil
+}
+
+func (n *Node) start() {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	if n.running {
+		return
+	}
+	n.running = true
+	n.input = make(chan *nocan.Message, 64)
+	n.quit = make(chan struct{})
+	go n.run(n.input, n.quit)
+}
+
+func (n *Node) stop() {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	if !n.running {
+		return
+	}
+	n.running = false
+	close(n.quit)
+}
+
+func (n *Node) reset() {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	n.id = 0
+	n.channels = make(map[string]nocan.ChannelId)
+	n.names = make(map[nocan.ChannelId]string)
+	n.pending = make(map[nocan.NodeId]*nocan.Message)
+}
+
+// receiveFrame is called by the bus for every frame the node can see. It
+// reassembles the messages that concern the node and queues them.
+func (n *Node) receiveFrame(frame *can.Frame) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	if !n.running || !frame.IsExtended() || frame.Dlc > 8 {
+		return
+	}
+
+	sender := nocan.NodeId((frame.CanId >> 21) & 0x7F)
+
+	if (frame.CanId & nocan.NOCANID_MASK_SYSTEM) != 0 {
+		fn := nocan.MessageType((frame.CanId >> 8) & 0xFF)
+		if sender != n.id && !(sender == 0 && fn == nocan.SYS_ADDRESS_CONFIGURE) {
+			return
+		}
+	} else {
+		if _, ok := n.names[nocan.ChannelId(frame.CanId&0xFFFF)]; !ok || sender == n.id {
+			return
+		}
+	}
+
+	if (frame.CanId & nocan.NOCANID_MASK_FIRST) != 0 {
+		n.pending[sender] = nocan.NewMessage(frame.CanId&nocan.NOCANID_MASK_MESSAGE&^can.CANID_MASK_CONTROL, frame.Data[:frame.Dlc])
+	} else {
+		if n.pending[sender] == nil {
+			return
+		}
+		n.pending[sender].AppendData(frame.Data[:frame.Dlc])
+	}
+
+	if (frame.CanId & nocan.NOCANID_MASK_LAST) != 0 {
+		msg := n.pending[sender]
+		delete(n.pending, sender)
+		select {
+		case n.input <- msg:
+		default:
+			clog.Warning("Input queue of %s is full, dropping %s", n, msg)
+		}
+	}
+}
+
+func (n *Node) send(msg *nocan.Message) {
+	var frames []can.Frame
+	var pos uint8
+
+	for {
+		var frame can.Frame
+
+		frame.CanId = msg.CanId | can.CANID_MASK_EXTENDED
+		if pos == 0 {
+			frame.CanId |= nocan.NOCANID_MASK_FIRST
+		}
+		if msg.Dlc-pos > 8 {
+			frame.Dlc = 8
+		} else {
+			frame.Dlc = msg.Dlc - pos
+			frame.CanId |= nocan.NOCANID_MASK_LAST
+		}
+		copy(frame.Data[:], msg.Data[pos:pos+frame.Dlc])
+		frames = append(frames, frame)
+		pos += frame.Dlc
+		if pos >= msg.Dlc {
+			break
+		}
+	}
+	n.bus.transmit(n, frames)
+}
+
+func (n *Node) sendSystemMessage(fn nocan.MessageType, param uint8, data []byte) {
+	n.send(nocan.NewSystemMessage(n.Id(), fn, param, data))
+}
+
+func (n *Node) run(input chan *nocan.Message, quit chan struct{}) {
+	for {
+		err := n.boot(input, quit)
+		if err == errStopped {
+			clog.Debug("Stopped %s", n)
+			return
+		}
+		if err != errReset {
+			clog.Warning("%s failed: %s, restarting.", n, err)
+			select {
+			case <-quit:
+				return
+			case <-time.After(RETRY_DELAY):
+			}
+		}
+	}
+}
+
+func (n *Node) boot(input chan *nocan.Message, quit chan struct{}) error {
+	n.reset()
+
+	if err := n.requestAddress(input, quit); err != nil {
+		return err
+	}
+	if err := n.bootloader(input, quit); err != nil {
+		return err
+	}
+	if err := n.requestAddress(input, quit); err != nil {
+		return err
+	}
+	return n.application(input, quit)
+}
+
+func (n *Node) receive(input chan *nocan.Message, quit chan struct{}, timeout time.Duration) (*nocan.Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-input:
+		return msg, nil
+	case <-quit:
+		return nil, errStopped
+	case <-timer.C:
+		return nil, errTimeout
+	}
+}
+
+// expect waits for a system message of type fn, while answering pings and
+// delivering publish messages.
+func (n *Node) expect(input chan *nocan.Message, quit chan struct{}, fn nocan.MessageType) (*nocan.Message, error) {
+	for {
+		msg, err := n.receive(input, quit, nocan.DEFAULT_TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		if !msg.IsSystemMessage() {
+			n.deliver(msg)
+			continue
+		}
+		rfn, _ := msg.SystemFunctionParam()
+		switch rfn {
+		case fn:
+			return msg, nil
+		case nocan.SYS_NODE_PING:
+			n.sendSystemMessage(nocan.SYS_NODE_PING_ACK, 0, nil)
+		case nocan.SYS_NODE_BOOT_REQUEST:
+			return nil, errReset
+		default:
+			clog.DebugX("%s ignored %s while waiting for %s", n, msg, fn)
+		}
+	}
+}
+
+func (n *Node) requestAddress(input chan *nocan.Message, quit chan struct{}) error {
+	n.Mutex.Lock()
+	n.id = 0
+	n.Mutex.Unlock()
+
+	for {
+		n.sendSystemMessage(nocan.SYS_ADDRESS_REQUEST, n.FirmwareVersion, n.Udid[:])
+		for {
+			msg, err := n.expect(input, quit, nocan.SYS_ADDRESS_CONFIGURE)
+			if err == errTimeout {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(msg.Bytes(), n.Udid[:]) {
+				n.Mutex.Lock()
+				n.id = nocan.NodeId(msg.SystemParam())
+				n.Mutex.Unlock()
+				n.sendSystemMessage(nocan.SYS_ADDRESS_CONFIGURE_ACK, 0, nil)
+				clog.Debug("%s got address N%d", n, msg.SystemParam())
+				return nil
+			}
+		}
+		clog.DebugX("%s did not get an address, retrying", n)
+	}
+}
+
+func (n *Node) bootloader(input chan *nocan.Message, quit chan struct{}) error {
+	var address uint32
+	var crc uint32
+
+	n.sendSystemMessage(nocan.SYS_NODE_BOOT_ACK, 0, nil)
+
+	for {
+		msg, err := n.receive(input, quit, BOOTLOADER_TIMEOUT)
+		if err == errTimeout {
+			clog.DebugX("%s bootloader timed out, starting application", n)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !msg.IsSystemMessage() {
+			continue
+		}
+
+		fn, param := msg.SystemFunctionParam()
+		switch fn {
+		case nocan.SYS_BOOTLOADER_GET_SIGNATURE:
+			n.sendSystemMessage(nocan.SYS_BOOTLOADER_GET_SIGNATURE_ACK, 0, FLASH_DEVICE_SIGNATURE[:])
+
+		case nocan.SYS_BOOTLOADER_SET_ADDRESS:
+			if msg.Dlc != 4 {
+				n.sendSystemMessage(nocan.SYS_BOOTLOADER_SET_ADDRESS_ACK, 0xFF, nil)
+				continue
+			}
+			address = (uint32(msg.Data[0]) << 24) | (uint32(msg.Data[1]) << 16) | (uint32(msg.Data[2]) << 8) | uint32(msg.Data[3])
+			crc = 0
+			n.sendSystemMessage(nocan.SYS_BOOTLOADER_SET_ADDRESS_ACK, 0, nil)
+
+		case nocan.SYS_BOOTLOADER_ERASE:
+			for i := FLASH_APP_ORIGIN; i < FLASH_LENGTH; i++ {
+				n.Flash[i] = 0xFF
+			}
+			n.sendSystemMessage(nocan.SYS_BOOTLOADER_ERASE_ACK, 0, nil)
+
+		case nocan.SYS_BOOTLOADER_WRITE:
+			if param == 0 {
+				if address < FLASH_APP_ORIGIN || address+uint32(msg.Dlc) > FLASH_LENGTH {
+					n.sendSystemMessage(nocan.SYS_BOOTLOADER_WRITE_ACK, 0xFF, nil)
+					continue
+				}
+				copy(n.Flash[address:], msg.Bytes())
+				crc = crc32.Update(crc, crc32.IEEETable, msg.Bytes())
+				address += uint32(msg.Dlc)
+				n.sendSystemMessage(nocan.SYS_BOOTLOADER_WRITE_ACK, 0, nil)
+			} else {
+				var expected uint32
+				if msg.Dlc == 4 {
+					expected = (uint32(msg.Data[0]) << 24) | (uint32(msg.Data[1]) << 16) | (uint32(msg.Data[2]) << 8) | uint32(msg.Data[3])
+				}
+				if msg.Dlc != 4 || expected != crc {
+					n.sendSystemMessage(nocan.SYS_BOOTLOADER_WRITE_ACK, 0xFF, []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)})
+				} else {
+					n.sendSystemMessage(nocan.SYS_BOOTLOADER_WRITE_ACK, 0, nil)
+				}
+				crc = 0
+			}
+
+		case nocan.SYS_BOOTLOADER_READ:
+			length := uint32(param)
+			if length > 64 {
+				length = 64
+			}
+			if address+length > FLASH_LENGTH {
+				n.sendSystemMessage(nocan.SYS_BOOTLOADER_READ_ACK, 0xFF, nil)
+				continue
+			}
+			n.sendSystemMessage(nocan.SYS_BOOTLOADER_READ_ACK, 0, n.Flash[address:address+length])
+			address += length
+
+		case nocan.SYS_BOOTLOADER_LEAVE:
+			n.sendSystemMessage(nocan.SYS_BOOTLOADER_LEAVE_ACK, 0, nil)
+			return nil
+
+		case nocan.SYS_NODE_PING:
+			n.sendSystemMessage(nocan.SYS_NODE_PING_ACK, 0, nil)
+
+		case nocan.SYS_NODE_BOOT_REQUEST:
+			return errReset
+
+		default:
+			clog.DebugX("%s bootloader ignored %s", n, msg)
+		}
+	}
+}
+
+func (n *Node) addChannel(name string, cid nocan.ChannelId) {
+	n.Mutex.Lock()
+	defer n.Mutex.Unlock()
+
+	n.channels[name] = cid
+	n.names[cid] = name
+}
+
+func (n *Node) channelRequest(input chan *nocan.Message, quit chan struct{}, name string, fn nocan.MessageType, ack nocan.MessageType) error {
+	n.sendSystemMessage(fn, 0, []byte(name))
+	msg, err := n.expect(input, quit, ack)
+	if err != nil {
+		return err
+	}
+	if msg.SystemParam() != 0 || msg.Dlc != 2 {
+		clog.Warning("%s: %s failed for channel %s", n, fn, name)
+		return nil
+	}
+	cid := (nocan.ChannelId(msg.Data[0]) << 8) | nocan.ChannelId(msg.Data[1])
+	n.addChannel(name, cid)
+	clog.Debug("%s: channel %s has id %d", n, name, cid)
+	return nil
+}
+
+func (n *Node) deliver(msg *nocan.Message) {
+	n.Mutex.Lock()
+	name := n.names[msg.ChannelId()]
+	n.Mutex.Unlock()
+
+	clog.DebugX("%s received %q on channel %s", n, msg.Bytes(), name)
+	if n.OnPublish != nil {
+		n.OnPublish(n, name, msg.Bytes())
+	}
+}
+
+func (n *Node) application(input chan *nocan.Message, quit chan struct{}) error {
+	var counter uint
+	var tick <-chan time.Time
+
+	for _, name := range n.Channels {
+		if err := n.channelRequest(input, quit, name, nocan.SYS_CHANNEL_REGISTER, nocan.SYS_CHANNEL_REGISTER_ACK); err != nil {
+			return err
+		}
+	}
+	for _, name := range n.Subscriptions {
+		if err := n.channelRequest(input, quit, name, nocan.SYS_CHANNEL_LOOKUP, nocan.SYS_CHANNEL_LOOKUP_ACK); err != nil {
+			return err
+		}
+		if cid, ok := n.ChannelId(name); ok {
+			n.sendSystemMessage(nocan.SYS_CHANNEL_SUBSCRIBE, 0, cid.ToBytes())
+		}
+	}
+
+	if n.PublishInterval > 0 && len(n.Channels) > 0 {
+		ticker := time.NewTicker(n.PublishInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-quit:
+			return errStopped
+		case <-tick:
+			counter++
+			if err := n.Publish(n.Channels[0], []byte(fmt.Sprintf("%d", counter))); err != nil {
+				clog.DebugX("%s", err)
+			}
+		case msg := <-input:
+			if !msg.IsSystemMessage() {
+				n.deliver(msg)
+				continue
+			}
+			fn, _ := msg.SystemFunctionParam()
+			switch fn {
+			case nocan.SYS_NODE_PING:
+				n.sendSystemMessage(nocan.SYS_NODE_PING_ACK, 0, nil)
+			case nocan.SYS_NODE_BOOT_REQUEST:
+				clog.Debug("%s is rebooting", n)
+				return errReset
+			default:
+				clog.DebugX("%s ignored %s", n, msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package slcan
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+var serialSpeeds = map[uint]uint32{
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	2000000: unix.B2000000,
+	3000000: unix.B3000000,
+}
+
+// openSerial opens a tty in raw mode (8N1, no flow control) at the given speed.
+func openSerial(dev string, speed uint) (*os.File, error) {
+	baud, ok := serialSpeeds[speed]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported serial speed %d", speed)
+	}
+
+	fd, err := unix.Open(dev, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// Equivalent of cfmakeraw()
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | baud
+	t.Ispeed = baud
+	t.Ospeed = baud
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// The descriptor is non-blocking, so os.File uses the runtime poller
+	// and read deadlines work.
+	return os.NewFile(uintptr(fd), dev), nil
+}
@@ -0,0 +1,164 @@
+//go:build linux
+// +build linux
+
+package slcan
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openPty returns the master side of a new pseudo-terminal, and the name of
+// its slave side.
+func openPty(t *testing.T) (*os.File, string) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("Pseudo-terminals are not available: %s", err)
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		unix.Close(fd)
+		t.Fatalf("Could not unlock pseudo-terminal: %s", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		unix.Close(fd)
+		t.Fatalf("Could not get pseudo-terminal number: %s", err)
+	}
+	return os.NewFile(uintptr(fd), "/dev/ptmx"), fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// fakeAdapter answers the slcan commands written on the master side of a
+// pseudo-terminal: commands listed in replies get the given answer, other
+// non-empty commands get CR. Empty commands get no answer. The commands are
+// sent on the returned channel.
+func fakeAdapter(master *os.File, replies map[string]string) <-chan string {
+	commands := make(chan string, 32)
+	go func() {
+		defer close(commands)
+		reader := bufio.NewReader(master)
+		for {
+			line, err := reader.ReadString('\r')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimSuffix(line, "\r")
+			if cmd == "" {
+				continue
+			}
+			commands <- cmd
+			reply, ok := replies[cmd]
+			if !ok {
+				reply = "\r"
+			}
+			if reply != "" {
+				master.Write([]byte(reply))
+			}
+		}
+	}()
+	return commands
+}
+
+func collect(commands <-chan string, n int) []string {
+	var received []string
+	for i := 0; i < n; i++ {
+		select {
+		case cmd := <-commands:
+			received = append(received, cmd)
+		case <-time.After(time.Second):
+			return received
+		}
+	}
+	return received
+}
+
+func TestInitialize(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	commands := fakeAdapter(master, nil)
+
+	d := NewDriver(slave, 500000, 115200)
+	if _, err := d.Initialize(false); err != nil {
+		t.Fatalf("Initialize failed: %s", err)
+	}
+	defer d.file.Close()
+
+	if received := collect(commands, 3); strings.Join(received, ",") != "C,S6,O" {
+		t.Errorf("Adapter received commands %q, expected C, S6 and O", received)
+	}
+}
+
+func TestInitializeUnsupportedBitrate(t *testing.T) {
+	d := NewDriver("/dev/null", 42, 115200)
+	if _, err := d.Initialize(false); err == nil {
+		t.Errorf("Initialize accepted an unsupported bitrate")
+	}
+}
+
+func TestInitializeRejected(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	fakeAdapter(master, map[string]string{"S6": "\a"})
+
+	d := NewDriver(slave, 500000, 115200)
+	if _, err := d.Initialize(false); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("Initialize returned %v, expected the S6 command to fail", err)
+	}
+	if d.file != nil {
+		t.Errorf("Initialize left %s open after a failure", slave)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+	// "V" is answered with a version number before the CR, "F" is not answered.
+	fakeAdapter(master, map[string]string{"V": "V1013\r", "X": "\a", "F": ""})
+
+	f, err := openSerial(slave, 115200)
+	if err != nil {
+		t.Fatalf("Could not open %s: %s", slave, err)
+	}
+	defer f.Close()
+	d := &SlcanDriver{Device: slave, file: f, reader: bufio.NewReader(f)}
+
+	if err := d.command("V"); err != nil {
+		t.Errorf("Command V failed: %s", err)
+	}
+	if err := d.command("X"); err == nil {
+		t.Errorf("Command X succeeded, expected BEL to be reported as a failure")
+	}
+	start := time.Now()
+	if err := d.command("F"); err == nil {
+		t.Errorf("Command F succeeded without an answer")
+	} else if elapsed := time.Since(start); elapsed < COMMAND_TIMEOUT {
+		t.Errorf("Command F failed after %s, before the timeout", elapsed)
+	}
+}
+
+func TestRecvFrame(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+
+	f, err := openSerial(slave, 115200)
+	if err != nil {
+		t.Fatalf("Could not open %s: %s", slave, err)
+	}
+	defer f.Close()
+	d := &SlcanDriver{Device: slave, file: f, reader: bufio.NewReader(f)}
+
+	// Acknowledgements and invalid lines are skipped.
+	master.Write([]byte("z\r\aZ\rq123\rt1232AABB\r"))
+	f.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := d.RecvFrame()
+	if err != nil {
+		t.Fatalf("RecvFrame failed: %s", err)
+	}
+	if frame.CanId != 0x123 || frame.Dlc != 2 || frame.Data[0] != 0xAA || frame.Data[1] != 0xBB {
+		t.Errorf("RecvFrame returned %s", frame)
+	}
+}
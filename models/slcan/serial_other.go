@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package slcan
+
+import (
+	"errors"
+	"os"
+)
+
+func openSerial(dev string, speed uint) (*os.File, error) {
+	return nil, errors.New("Serial slcan adapters are only supported on Linux")
+}
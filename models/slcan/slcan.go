@@ -0,0 +1,269 @@
+package slcan
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const COMMAND_TIMEOUT = 1 * time.Second
+
+// Bitrate codes for the slcan 'S' command.
+var bitrateCodes = map[uint]byte{
+	10000:   '0',
+	20000:   '1',
+	50000:   '2',
+	100000:  '3',
+	125000:  '4',
+	250000:  '5',
+	500000:  '6',
+	800000:  '7',
+	1000000: '8',
+}
+
+// SlcanDriver
+//
+// SlcanDriver implements device.Driver for CAN adapters that use the ASCII
+// slcan (Lawicel) protocol over a serial line.
+type SlcanDriver struct {
+	Device      string
+	Bitrate     uint
+	SerialSpeed uint
+	file        *os.File
+	reader      *bufio.Reader
+	writeMutex  sync.Mutex
+}
+
+func NewDriver(dev string, bitrate uint, serial_speed uint) *SlcanDriver {
+	return &SlcanDriver{Device: dev, Bitrate: bitrate, SerialSpeed: serial_speed}
+}
+
+func (d *SlcanDriver) write(s []byte) error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+
+	_, err := d.file.Write(s)
+	return err
+}
+
+// command sends a configuration command and waits for the adapter to answer
+// with CR (success) or BEL (failure).
+func (d *SlcanDriver) command(cmd string) error {
+	if err := d.write([]byte(cmd + "\r")); err != nil {
+		return err
+	}
+	d.file.SetReadDeadline(time.Now().Add(COMMAND_TIMEOUT))
+	defer d.file.SetReadDeadline(time.Time{})
+
+	for {
+		c, err := d.reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("No response to slcan command '%s': %s", cmd, err)
+		}
+		switch c {
+		case '\r':
+			return nil
+		case '\a':
+			return fmt.Errorf("slcan command '%s' failed", cmd)
+		}
+	}
+}
+
+func (d *SlcanDriver) Initialize(reset bool) (*device.Information, error) {
+	code, ok := bitrateCodes[d.Bitrate]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported slcan bitrate %d", d.Bitrate)
+	}
+
+	f, err := openSerial(d.Device, d.SerialSpeed)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open serial device %s: %s", d.Device, err)
+	}
+	d.file = f
+	d.reader = bufio.NewReader(f)
+
+	// Flush any partial command, then close the channel in case it was left
+	// open: the adapter rejects configuration changes on an open channel.
+	d.write([]byte("\r\r\r"))
+	d.file.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		if _, err := d.reader.ReadByte(); err != nil {
+			break
+		}
+	}
+	d.file.SetReadDeadline(time.Time{})
+	d.command("C")
+
+	for _, cmd := range []string{"S" + string(code), "O"} {
+		if err := d.command(cmd); err != nil {
+			d.file.Close()
+			d.file = nil
+			return nil, err
+		}
+	}
+	clog.Info("Connected to slcan adapter on %s at %d bps", d.Device, d.Bitrate)
+	return d.DeviceInfo()
+}
+
+func (d *SlcanDriver) Reset() error {
+	if err := d.command("C"); err != nil {
+		return err
+	}
+	return d.command("O")
+}
+
+func (d *SlcanDriver) DeviceInfo() (*device.Information, error) {
+	info := &device.Information{}
+	copy(info.Type[:], "SLCAN   ")
+	copy(info.Signature[:], "CAN0")
+	return info, nil
+}
+
+func (d *SlcanDriver) SendFrame(frame *can.Frame) error {
+	line, err := EncodeFrame(frame)
+	if err != nil {
+		return err
+	}
+	if d.file == nil {
+		return fmt.Errorf("slcan device %s is not open", d.Device)
+	}
+	if err := d.write(line); err != nil {
+		return err
+	}
+	clog.DebugXX("SEND FRAME %s", frame)
+	return nil
+}
+
+func (d *SlcanDriver) RecvFrame() (*can.Frame, error) {
+	if d.file == nil {
+		return nil, fmt.Errorf("slcan device %s is not open", d.Device)
+	}
+	for {
+		line, err := d.reader.ReadBytes('\r')
+		if err != nil {
+			return nil, err
+		}
+		// Drop acknowledgements of previous commands (BEL, 'z' and 'Z')
+		line = bytes.TrimLeft(line[:len(line)-1], "\a")
+		if len(line) == 0 || line[0] == 'z' || line[0] == 'Z' {
+			continue
+		}
+		frame, err := DecodeFrame(line)
+		if err != nil {
+			clog.Warning("Discarding slcan line %q: %s", line, err)
+			continue
+		}
+		return frame, nil
+	}
+}
+
+func (d *SlcanDriver) SetPower(powered bool) error {
+	return device.ErrNotSupported
+}
+
+func (d *SlcanDriver) SetCurrentLimit(limit uint16) error {
+	return device.ErrNotSupported
+}
+
+func (d *SlcanDriver) SetTerminationResistor(set bool) error {
+	return device.ErrNotSupported
+}
+
+func (d *SlcanDriver) PowerStatus() (*device.PowerStatus, error) {
+	return nil, device.ErrNotSupported
+}
+
+// EncodeFrame converts a frame to an slcan transmit command, including the
+// final CR.
+func EncodeFrame(frame *can.Frame) ([]byte, error) {
+	var line []byte
+
+	if frame.IsError() {
+		return nil, fmt.Errorf("slcan cannot transmit error frame %s", frame)
+	}
+	if frame.Dlc > 8 {
+		return nil, fmt.Errorf("Frame %s DLC is greater than 8", frame)
+	}
+
+	id := frame.CanId &^ can.CANID_MASK_CONTROL
+	switch {
+	case frame.IsExtended() && frame.IsRemote():
+		line = []byte(fmt.Sprintf("R%08X%d", id&0x1FFFFFFF, frame.Dlc))
+	case frame.IsExtended():
+		line = []byte(fmt.Sprintf("T%08X%d", id&0x1FFFFFFF, frame.Dlc))
+	case frame.IsRemote():
+		line = []byte(fmt.Sprintf("r%03X%d", id&0x7FF, frame.Dlc))
+	default:
+		line = []byte(fmt.Sprintf("t%03X%d", id&0x7FF, frame.Dlc))
+	}
+	if !frame.IsRemote() {
+		for i := uint8(0); i < frame.Dlc; i++ {
+			line = append(line, []byte(fmt.Sprintf("%02X", frame.Data[i]))...)
+		}
+	}
+	return append(line, '\r'), nil
+}
+
+// DecodeFrame parses a 't', 'T', 'r' or 'R' line received from the adapter,
+// without the final CR. Any trailing timestamp is ignored.
+func DecodeFrame(line []byte) (*can.Frame, error) {
+	var idlen int
+	var flags uint32
+
+	if len(line) == 0 {
+		return nil, fmt.Errorf("Empty slcan frame")
+	}
+
+	switch line[0] {
+	case 't':
+		idlen = 3
+	case 'T':
+		idlen = 8
+		flags = can.CANID_MASK_EXTENDED
+	case 'r':
+		idlen = 3
+		flags = can.CANID_MASK_REMOTE
+	case 'R':
+		idlen = 8
+		flags = can.CANID_MASK_EXTENDED | can.CANID_MASK_REMOTE
+	default:
+		return nil, fmt.Errorf("Unknown slcan frame type '%c'", line[0])
+	}
+
+	if len(line) < 2+idlen {
+		return nil, fmt.Errorf("slcan frame too short")
+	}
+	id, err := strconv.ParseUint(string(line[1:1+idlen]), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid slcan frame id: %s", err)
+	}
+	dlc := line[1+idlen] - '0'
+	if dlc > 8 {
+		return nil, fmt.Errorf("Invalid slcan frame DLC '%c'", line[1+idlen])
+	}
+
+	frame := &can.Frame{CanId: uint32(id) | flags, Dlc: dlc}
+	if (flags & can.CANID_MASK_REMOTE) != 0 {
+		return frame, nil
+	}
+
+	data := line[2+idlen:]
+	if len(data) < 2*int(dlc) {
+		return nil, fmt.Errorf("slcan frame has %d data characters, expected %d", len(data), 2*dlc)
+	}
+	for i := 0; i < int(dlc); i++ {
+		b, err := strconv.ParseUint(string(data[2*i:2*i+2]), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid slcan frame data: %s", err)
+		}
+		frame.Data[i] = byte(b)
+	}
+	return frame, nil
+}
@@ -0,0 +1,115 @@
+package slcan
+
+import (
+	"github.com/omzlo/nocand/models/can"
+	"testing"
+)
+
+func TestEncodeFrame(t *testing.T) {
+	tests := []struct {
+		frame can.Frame
+		line  string
+	}{
+		{can.Frame{CanId: 0x123, Dlc: 3, Data: [8]byte{0x11, 0x22, 0x33}}, "t1233112233\r"},
+		{can.Frame{CanId: 0x7FF, Dlc: 0}, "t7FF0\r"},
+		{can.Frame{CanId: can.CANID_MASK_EXTENDED | 0x1ABCDEF0, Dlc: 8, Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}, "T1ABCDEF080102030405060708\r"},
+		{can.Frame{CanId: can.CANID_MASK_REMOTE | 0x456, Dlc: 2, Data: [8]byte{0xFF}}, "r4562\r"},
+		{can.Frame{CanId: can.CANID_MASK_EXTENDED | can.CANID_MASK_REMOTE | 0x00000001, Dlc: 8}, "R000000018\r"},
+	}
+
+	for _, test := range tests {
+		line, err := EncodeFrame(&test.frame)
+		if err != nil {
+			t.Errorf("EncodeFrame(%s) failed: %s", test.frame, err)
+			continue
+		}
+		if string(line) != test.line {
+			t.Errorf("EncodeFrame(%s) = %q, expected %q", test.frame, line, test.line)
+		}
+	}
+}
+
+func TestEncodeFrameErrors(t *testing.T) {
+	frames := []can.Frame{
+		{CanId: can.CANID_MASK_ERROR | 0x40, Dlc: 8},
+		{CanId: 0x123, Dlc: 9},
+	}
+
+	for _, frame := range frames {
+		if line, err := EncodeFrame(&frame); err == nil {
+			t.Errorf("EncodeFrame(%s) = %q, expected an error", frame, line)
+		}
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	tests := []struct {
+		line  string
+		frame can.Frame
+	}{
+		{"t1233112233", can.Frame{CanId: 0x123, Dlc: 3, Data: [8]byte{0x11, 0x22, 0x33}}},
+		{"t7ff0", can.Frame{CanId: 0x7FF, Dlc: 0}},
+		{"T1ABCDEF080102030405060708", can.Frame{CanId: can.CANID_MASK_EXTENDED | 0x1ABCDEF0, Dlc: 8, Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{"r4562", can.Frame{CanId: can.CANID_MASK_REMOTE | 0x456, Dlc: 2}},
+		{"R000000018", can.Frame{CanId: can.CANID_MASK_EXTENDED | can.CANID_MASK_REMOTE | 0x00000001, Dlc: 8}},
+		// Adapters configured with 'Z1' add a 4 digit timestamp.
+		{"t12321122EA60", can.Frame{CanId: 0x123, Dlc: 2, Data: [8]byte{0x11, 0x22}}},
+		{"T0000000111F1A2", can.Frame{CanId: can.CANID_MASK_EXTENDED | 0x00000001, Dlc: 1, Data: [8]byte{0x1F}}},
+		{"r12301234", can.Frame{CanId: can.CANID_MASK_REMOTE | 0x123, Dlc: 0}},
+	}
+
+	for _, test := range tests {
+		frame, err := DecodeFrame([]byte(test.line))
+		if err != nil {
+			t.Errorf("DecodeFrame(%q) failed: %s", test.line, err)
+			continue
+		}
+		if *frame != test.frame {
+			t.Errorf("DecodeFrame(%q) = %s, expected %s", test.line, frame, test.frame)
+		}
+	}
+}
+
+func TestDecodeFrameErrors(t *testing.T) {
+	lines := []string{
+		"",
+		"x1230",
+		"t123",
+		"t12",
+		"T1234567",
+		"t1239",
+		"t123:",
+		"t12331122",
+		"T1ABCDEF0811",
+		"t12G1AA",
+		"t1231ZZ",
+	}
+
+	for _, line := range lines {
+		if frame, err := DecodeFrame([]byte(line)); err == nil {
+			t.Errorf("DecodeFrame(%q) = %s, expected an error", line, frame)
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []can.Frame{
+		{CanId: 0x000, Dlc: 1, Data: [8]byte{0x80}},
+		{CanId: can.CANID_MASK_EXTENDED | 0x1FFFFFFF, Dlc: 8, Data: [8]byte{0xDE, 0xAD, 0xBE, 0xEF, 0, 1, 2, 3}},
+		{CanId: can.CANID_MASK_REMOTE | 0x100, Dlc: 4},
+	}
+
+	for _, frame := range frames {
+		line, err := EncodeFrame(&frame)
+		if err != nil {
+			t.Fatalf("EncodeFrame(%s) failed: %s", frame, err)
+		}
+		decoded, err := DecodeFrame(line[:len(line)-1])
+		if err != nil {
+			t.Fatalf("DecodeFrame(%q) failed: %s", line, err)
+		}
+		if *decoded != frame {
+			t.Errorf("Round trip of %s gave %s", frame, decoded)
+		}
+	}
+}
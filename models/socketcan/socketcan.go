@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package socketcan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// Layout of struct can_frame in <linux/can.h>: can_id (4 bytes, host order),
+// can_dlc, __pad, __res0, __res1, data[8].
+const (
+	FRAME_SIZE = unix.CAN_MTU
+)
+
+// SEND_TIMEOUT bounds the time SendFrame waits for room in the transmit queue
+// of the interface, which never drains while the controller is bus-off.
+const SEND_TIMEOUT = 3 * time.Second
+
+var ErrTransmitTimeout = errors.New("Timeout waiting for the SocketCAN transmit queue")
+
+var hostOrder binary.ByteOrder
+
+// SocketCanDriver
+//
+// SocketCanDriver implements device.Driver on top of a raw Linux SocketCAN
+// socket, such as can0 or vcan0.
+type SocketCanDriver struct {
+	Interface string
+	file      *os.File
+}
+
+func NewDriver(iface string) *SocketCanDriver {
+	return &SocketCanDriver{Interface: iface}
+}
+
+func (d *SocketCanDriver) Initialize(reset bool) (*device.Information, error) {
+	iface, err := net.InterfaceByName(d.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("Could not find CAN interface %s: %s", d.Interface, err)
+	}
+
+	fd, err := unix.Socket(unix.AF_CAN, unix.SOCK_RAW, unix.CAN_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open CAN socket: %s", err)
+	}
+
+	// Receive error frames too, they are reported with can.CANID_MASK_ERROR
+	if err := unix.SetsockoptInt(fd, unix.SOL_CAN_RAW, unix.CAN_RAW_ERR_FILTER, unix.CAN_ERR_MASK); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Could not enable CAN error frames on %s: %s", d.Interface, err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrCAN{Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Could not bind CAN socket to %s: %s", d.Interface, err)
+	}
+
+	// A non-blocking descriptor lets os.File use the runtime poller.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	d.file = os.NewFile(uintptr(fd), d.Interface)
+
+	clog.Info("Connected to SocketCAN interface %s", d.Interface)
+	return d.DeviceInfo()
+}
+
+func (d *SocketCanDriver) Reset() error {
+	return device.ErrNotSupported
+}
+
+func (d *SocketCanDriver) DeviceInfo() (*device.Information, error) {
+	info := &device.Information{}
+	copy(info.Type[:], "SOCKCAN ")
+	copy(info.Signature[:], "CAN0")
+	return info, nil
+}
+
+func (d *SocketCanDriver) SendFrame(frame *can.Frame) error {
+	var buf [FRAME_SIZE]byte
+
+	if d.file == nil {
+		return fmt.Errorf("SocketCAN interface %s is not open", d.Interface)
+	}
+	EncodeFrame(frame, buf[:])
+	deadline := time.Now().Add(SEND_TIMEOUT)
+	for {
+		_, err := d.file.Write(buf[:])
+		if err == nil {
+			clog.DebugXX("SEND FRAME %s", frame)
+			return nil
+		}
+		// The kernel reports a full transmit queue with ENOBUFS, wait for it to drain.
+		if perr, ok := err.(*os.PathError); ok && perr.Err == unix.ENOBUFS {
+			if time.Now().After(deadline) {
+				clog.Warning("SocketCAN interface %s has not accepted frame %s for more than %s.", d.Interface, frame, SEND_TIMEOUT)
+				return ErrTransmitTimeout
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		return err
+	}
+}
+
+func (d *SocketCanDriver) RecvFrame() (*can.Frame, error) {
+	var buf [FRAME_SIZE]byte
+
+	if d.file == nil {
+		return nil, fmt.Errorf("SocketCAN interface %s is not open", d.Interface)
+	}
+	n, err := d.file.Read(buf[:])
+	if err != nil {
+		return nil, err
+	}
+	if n != FRAME_SIZE {
+		return nil, fmt.Errorf("Unexpected CAN frame size %d on %s, expected %d", n, d.Interface, FRAME_SIZE)
+	}
+	return DecodeFrame(buf[:]), nil
+}
+
+func (d *SocketCanDriver) SetPower(powered bool) error {
+	return device.ErrNotSupported
+}
+
+func (d *SocketCanDriver) SetCurrentLimit(limit uint16) error {
+	return device.ErrNotSupported
+}
+
+func (d *SocketCanDriver) SetTerminationResistor(set bool) error {
+	return device.ErrNotSupported
+}
+
+func (d *SocketCanDriver) PowerStatus() (*device.PowerStatus, error) {
+	return nil, device.ErrNotSupported
+}
+
+// EncodeFrame writes frame in struct can_frame format. The CAN id flags used
+// by can.Frame are the same as the ones used by SocketCAN.
+func EncodeFrame(frame *can.Frame, buf []byte) {
+	hostOrder.PutUint32(buf[0:4], frame.CanId)
+	buf[4] = frame.Dlc
+	buf[5] = 0
+	buf[6] = 0
+	buf[7] = 0
+	copy(buf[8:16], frame.Data[:])
+}
+
+func DecodeFrame(buf []byte) *can.Frame {
+	frame := new(can.Frame)
+	frame.CanId = hostOrder.Uint32(buf[0:4])
+	frame.Dlc = buf[4]
+	copy(frame.Data[:], buf[8:16])
+	return frame
+}
+
+func init() {
+	var probe uint16 = 1
+	if *(*byte)(unsafe.Pointer(&probe)) == 1 {
+		hostOrder = binary.LittleEndian
+	} else {
+		hostOrder = binary.BigEndian
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !linux
+// +build !linux
+
+package socketcan
+
+import (
+	"errors"
+	"github.com/omzlo/nocand/models/can"
+	"github.com/omzlo/nocand/models/device"
+)
+
+var errNotLinux = errors.New("SocketCAN is only available on Linux")
+
+// SocketCanDriver
+//
+// SocketCAN is a Linux interface: on other systems the driver always fails.
+type SocketCanDriver struct {
+	Interface string
+}
+
+func NewDriver(iface string) *SocketCanDriver {
+	return &SocketCanDriver{Interface: iface}
+}
+
+func (d *SocketCanDriver) Initialize(reset bool) (*device.Information, error) {
+	return nil, errNotLinux
+}
+
+func (d *SocketCanDriver) Reset() error {
+	return errNotLinux
+}
+
+func (d *SocketCanDriver) DeviceInfo() (*device.Information, error) {
+	return nil, errNotLinux
+}
+
+func (d *SocketCanDriver) SendFrame(frame *can.Frame) error {
+	return errNotLinux
+}
+
+func (d *SocketCanDriver) RecvFrame() (*can.Frame, error) {
+	return nil, errNotLinux
+}
+
+func (d *SocketCanDriver) SetPower(powered bool) error {
+	return errNotLinux
+}
+
+func (d *SocketCanDriver) SetCurrentLimit(limit uint16) error {
+	return errNotLinux
+}
+
+func (d *SocketCanDriver) SetTerminationResistor(set bool) error {
+	return errNotLinux
+}
+
+func (d *SocketCanDriver) PowerStatus() (*device.PowerStatus, error) {
+	return nil, errNotLinux
+}
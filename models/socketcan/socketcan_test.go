@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package socketcan
+
+import (
+	"github.com/omzlo/nocand/models/can"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []can.Frame{
+		{CanId: 0x123, Dlc: 3, Data: [8]byte{1, 2, 3}},
+		{CanId: can.CANID_MASK_EXTENDED | 0x1ABCDEF0, Dlc: 8, Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{CanId: can.CANID_MASK_REMOTE | 0x7FF, Dlc: 4},
+		{CanId: can.CANID_MASK_EXTENDED | can.CANID_MASK_REMOTE | 0x00000001, Dlc: 0},
+		{CanId: can.CANID_MASK_ERROR | 0x40, Dlc: 8, Data: [8]byte{0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, frame := range frames {
+		var buf [FRAME_SIZE]byte
+
+		EncodeFrame(&frame, buf[:])
+		if buf[5] != 0 || buf[6] != 0 || buf[7] != 0 {
+			t.Errorf("%s: padding bytes are not zero: % x", frame, buf[4:8])
+		}
+		decoded := DecodeFrame(buf[:])
+		if *decoded != frame {
+			t.Errorf("Round trip of %s gave %s", frame, decoded)
+		}
+		if decoded.IsExtended() != frame.IsExtended() || decoded.IsRemote() != frame.IsRemote() || decoded.IsError() != frame.IsError() {
+			t.Errorf("Round trip of %s changed the flags", frame)
+		}
+	}
+}
+
+func TestFrameLayout(t *testing.T) {
+	var buf [FRAME_SIZE]byte
+
+	frame := can.Frame{CanId: can.CANID_MASK_EXTENDED | 0x01020304, Dlc: 2, Data: [8]byte{0xAA, 0xBB}}
+	EncodeFrame(&frame, buf[:])
+	if hostOrder.Uint32(buf[0:4]) != 0x81020304 {
+		t.Errorf("Unexpected can_id % x", buf[0:4])
+	}
+	if buf[4] != 2 || buf[8] != 0xAA || buf[9] != 0xBB {
+		t.Errorf("Unexpected frame layout % x", buf[:])
+	}
+}
+
+// TestVcanLoopback sends a frame between two sockets bound to vcan0, which
+// can be created with "ip link add dev vcan0 type vcan && ip link set up vcan0".
+func TestVcanLoopback(t *testing.T) {
+	if _, err := net.InterfaceByName("vcan0"); err != nil {
+		t.Skip("vcan0 is not available")
+	}
+
+	sender := NewDriver("vcan0")
+	if _, err := sender.Initialize(false); err != nil {
+		t.Fatalf("Could not open vcan0: %s", err)
+	}
+	defer sender.file.Close()
+	receiver := NewDriver("vcan0")
+	if _, err := receiver.Initialize(false); err != nil {
+		t.Fatalf("Could not open vcan0: %s", err)
+	}
+	defer receiver.file.Close()
+
+	frame := can.Frame{CanId: can.CANID_MASK_EXTENDED | 0x00123456, Dlc: 5, Data: [8]byte{'h', 'e', 'l', 'l', 'o'}}
+	if err := sender.SendFrame(&frame); err != nil {
+		t.Fatalf("SendFrame failed: %s", err)
+	}
+
+	receiver.file.SetReadDeadline(time.Now().Add(time.Second))
+	received, err := receiver.RecvFrame()
+	if err != nil {
+		t.Fatalf("RecvFrame failed: %s", err)
+	}
+	if *received != frame {
+		t.Errorf("Sent %s but received %s", frame, received)
+	}
+}
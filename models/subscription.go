@@ -0,0 +1,179 @@
+package models
+
+import (
+	"github.com/omzlo/nocand/models/nocan"
+	"sort"
+	"sync"
+)
+
+// ChannelSubscriptions
+//
+// ChannelSubscriptions lists the nodes that subscribed to a channel, and the
+// nodes that published to it, in increasing order of node id.
+type ChannelSubscriptions struct {
+	ChannelId   nocan.ChannelId `json:"channel_id"`
+	Subscribers []nocan.NodeId  `json:"subscribers"`
+	Publishers  []nocan.NodeId  `json:"publishers"`
+}
+
+// Unconsumed tells if the channel has publishers but no subscribers.
+func (cs *ChannelSubscriptions) Unconsumed() bool {
+	return len(cs.Publishers) > 0 && len(cs.Subscribers) == 0
+}
+
+func (cs *ChannelSubscriptions) Involves(node_id nocan.NodeId) bool {
+	for _, id := range cs.Subscribers {
+		if id == node_id {
+			return true
+		}
+	}
+	for _, id := range cs.Publishers {
+		if id == node_id {
+			return true
+		}
+	}
+	return false
+}
+
+type nodeSet map[nocan.NodeId]bool
+
+func (ns nodeSet) sorted() []nocan.NodeId {
+	ids := make([]nocan.NodeId, 0, len(ns))
+	for id := range ns {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// SubscriptionTable
+//
+// SubscriptionTable records the channels each node subscribed to with
+// SYS_CHANNEL_SUBSCRIBE, and the channels each node published to.
+type SubscriptionTable struct {
+	Mutex       sync.RWMutex
+	subscribers map[nocan.ChannelId]nodeSet
+	publishers  map[nocan.ChannelId]nodeSet
+}
+
+func NewSubscriptionTable() *SubscriptionTable {
+	return &SubscriptionTable{subscribers: make(map[nocan.ChannelId]nodeSet), publishers: make(map[nocan.ChannelId]nodeSet)}
+}
+
+func addToSet(m map[nocan.ChannelId]nodeSet, channel_id nocan.ChannelId, node_id nocan.NodeId) bool {
+	set, ok := m[channel_id]
+	if !ok {
+		set = make(nodeSet)
+		m[channel_id] = set
+	}
+	if set[node_id] {
+		return false
+	}
+	set[node_id] = true
+	return true
+}
+
+// Subscribe records that a node subscribed to a channel. It returns false if
+// the subscription already existed.
+func (st *SubscriptionTable) Subscribe(node_id nocan.NodeId, channel_id nocan.ChannelId) bool {
+	st.Mutex.Lock()
+	defer st.Mutex.Unlock()
+
+	return addToSet(st.subscribers, channel_id, node_id)
+}
+
+// Unsubscribe removes the subscription of a node to a channel. It returns
+// false if the node was not subscribed.
+func (st *SubscriptionTable) Unsubscribe(node_id nocan.NodeId, channel_id nocan.ChannelId) bool {
+	st.Mutex.Lock()
+	defer st.Mutex.Unlock()
+
+	set, ok := st.subscribers[channel_id]
+	if !ok || !set[node_id] {
+		return false
+	}
+	delete(set, node_id)
+	if len(set) == 0 {
+		delete(st.subscribers, channel_id)
+	}
+	return true
+}
+
+// Publish records that a node published to a channel. It returns true the
+// first time a node publishes to that channel.
+func (st *SubscriptionTable) Publish(node_id nocan.NodeId, channel_id nocan.ChannelId) bool {
+	st.Mutex.RLock()
+	known := st.publishers[channel_id][node_id]
+	st.Mutex.RUnlock()
+	if known {
+		return false
+	}
+
+	st.Mutex.Lock()
+	defer st.Mutex.Unlock()
+
+	return addToSet(st.publishers, channel_id, node_id)
+}
+
+// ClearNode forgets the subscriptions and publications of a node, typically
+// after a reset.
+func (st *SubscriptionTable) ClearNode(node_id nocan.NodeId) {
+	st.Mutex.Lock()
+	defer st.Mutex.Unlock()
+
+	for _, m := range []map[nocan.ChannelId]nodeSet{st.subscribers, st.publishers} {
+		for channel_id, set := range m {
+			delete(set, node_id)
+			if len(set) == 0 {
+				delete(m, channel_id)
+			}
+		}
+	}
+}
+
+// ClearChannel forgets the subscribers and publishers of a channel.
+func (st *SubscriptionTable) ClearChannel(channel_id nocan.ChannelId) {
+	st.Mutex.Lock()
+	defer st.Mutex.Unlock()
+
+	delete(st.subscribers, channel_id)
+	delete(st.publishers, channel_id)
+}
+
+// Channel returns the subscribers and publishers of a channel.
+func (st *SubscriptionTable) Channel(channel_id nocan.ChannelId) *ChannelSubscriptions {
+	st.Mutex.RLock()
+	defer st.Mutex.RUnlock()
+
+	return &ChannelSubscriptions{
+		ChannelId:   channel_id,
+		Subscribers: st.subscribers[channel_id].sorted(),
+		Publishers:  st.publishers[channel_id].sorted(),
+	}
+}
+
+// List returns the subscribers and publishers of every channel that has at
+// least one of them, in increasing order of channel id.
+func (st *SubscriptionTable) List() []*ChannelSubscriptions {
+	st.Mutex.RLock()
+	channel_ids := make([]int, 0, len(st.subscribers)+len(st.publishers))
+	for channel_id := range st.subscribers {
+		channel_ids = append(channel_ids, int(channel_id))
+	}
+	for channel_id := range st.publishers {
+		if _, ok := st.subscribers[channel_id]; !ok {
+			channel_ids = append(channel_ids, int(channel_id))
+		}
+	}
+	st.Mutex.RUnlock()
+
+	sort.Ints(channel_ids)
+	list := make([]*ChannelSubscriptions, 0, len(channel_ids))
+	for _, channel_id := range channel_ids {
+		cs := st.Channel(nocan.ChannelId(channel_id))
+		if len(cs.Subscribers) > 0 || len(cs.Publishers) > 0 {
+			list = append(list, cs)
+		}
+	}
+	return list
+}
@@ -3,6 +3,8 @@ package socket
 import (
 	"fmt"
 	"github.com/omzlo/clog"
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
 	"io"
 )
 
@@ -205,6 +207,34 @@ func DecodeEvent(r io.Reader) (Eventer, error) {
 		x = NewSystemPropertiesRequestEvent()
 	case SystemPropertiesEventId:
 		x = NewSystemPropertiesEvent(nil)
+	case BusMonitorRequestEventId:
+		x = NewBusMonitorRequestEvent(0)
+	case BusTrafficEventId:
+		x = NewBusTrafficEvent()
+	case BusHealthRequestEventId:
+		x = NewBusHealthRequestEvent()
+	case BusHealthEventId:
+		x = NewBusHealthEvent(nil)
+	case NodeStatisticsRequestEventId:
+		x = NewNodeStatisticsRequestEvent(0)
+	case NodeStatisticsEventId:
+		x = NewNodeStatisticsEvent(0, nil)
+	case NodeQueueOverflowEventId:
+		x = NewNodeQueueOverflowEvent(0, 0, 0)
+	case SubscriptionListRequestEventId:
+		x = NewSubscriptionListRequestEvent(nocan.UNDEFINED_NODE, nocan.UNDEFINED_CHANNEL, false)
+	case SubscriptionListEventId:
+		x = NewSubscriptionListEvent()
+	case NodeDebugRequestEventId:
+		x = NewNodeDebugRequestEvent(nocan.UNDEFINED_NODE, 0)
+	case NodeDebugEventId:
+		x = NewNodeDebugEvent(0, models.DebugLine{})
+	case NodeLookupRequestEventId:
+		x = NewNodeLookupRequestEvent(0, models.NullUdid8)
+	case ChannelHistoryRequestEventId:
+		x = NewChannelHistoryRequestEvent("", 0)
+	case ChannelHistoryEventId:
+		x = NewChannelHistoryEvent("", 0, nil)
 	default:
 		return nil, fmt.Errorf("Unprocessable event %d with %d bytes of payload", eventId, rlen)
 	}
@@ -7,10 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/can"
 	"github.com/omzlo/nocand/models/device"
 	"github.com/omzlo/nocand/models/nocan"
 	"github.com/omzlo/nocand/models/properties"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -343,6 +345,11 @@ const (
 	CHANNEL_NOT_FOUND
 )
 
+// CHANNEL_STALE_FLAG is set in the packed status of a ChannelUpdateEvent
+// whose value was restored from a previous run of the server and has not been
+// updated since.
+const CHANNEL_STALE_FLAG = 0x80
+
 func (cs ChannelStatus) String() string {
 	switch cs {
 	case CHANNEL_CREATED:
@@ -365,6 +372,7 @@ type ChannelUpdateEvent struct {
 	Status      ChannelStatus
 	Value       []byte
 	UpdatedAt   time.Time
+	Stale       bool
 }
 
 func (cu *ChannelUpdateEvent) MarshalJSON() ([]byte, error) {
@@ -374,12 +382,14 @@ func (cu *ChannelUpdateEvent) MarshalJSON() ([]byte, error) {
 		Status    string          `json:"status"`
 		Value     string          `json:"value"`
 		UpdatedAt time.Time       `json:"updated_at"`
+		Stale     bool            `json:"stale,omitempty"`
 	}{
 		Id:        cu.ChannelId,
 		Name:      cu.ChannelName,
 		Status:    cu.Status.String(),
 		Value:     string(cu.Value),
 		UpdatedAt: cu.UpdatedAt,
+		Stale:     cu.Stale,
 	})
 }
 
@@ -409,6 +419,9 @@ func (cu *ChannelUpdateEvent) Pack() ([]byte, error) {
 
 	buf := make([]byte, cu.PackedLength())
 	buf[0] = byte(cu.Status)
+	if cu.Stale {
+		buf[0] |= CHANNEL_STALE_FLAG
+	}
 	EncodeUint16(buf[1:3], uint16(cu.ChannelId))
 	buf[3] = byte(l_name)
 	copy(buf[4:], []byte(cu.ChannelName))
@@ -424,7 +437,8 @@ func (cu *ChannelUpdateEvent) Unpack(value []byte) error {
 	if len(value) < 3 {
 		return ErrorMissingData
 	}
-	cu.Status = ChannelStatus(value[0])
+	cu.Status = ChannelStatus(value[0] &^ CHANNEL_STALE_FLAG)
+	cu.Stale = (value[0] & CHANNEL_STALE_FLAG) != 0
 
 	cu.ChannelId = (nocan.ChannelId(value[1]) << 8) | nocan.ChannelId(value[2])
 
@@ -463,6 +477,9 @@ func (cu ChannelUpdateEvent) String() string {
 	case CHANNEL_DESTROYED:
 		return fmt.Sprintf("DESTROYED\t#%d\t%s\t%s", cu.ChannelId, cu.ChannelName, cu.UpdatedAt.Format(time.RFC3339Nano))
 	case CHANNEL_UPDATED:
+		if cu.Stale {
+			return fmt.Sprintf("UPDATED\t#%d\t%s\t%q\t%s\tstale", cu.ChannelId, cu.ChannelName, cu.Value, cu.UpdatedAt.Format(time.RFC3339Nano))
+		}
 		return fmt.Sprintf("UPDATED\t#%d\t%s\t%q\t%s", cu.ChannelId, cu.ChannelName, cu.Value, cu.UpdatedAt.Format(time.RFC3339Nano))
 	case CHANNEL_NOT_FOUND:
 		return fmt.Sprintf("NOT_FOUND\t#%d\t%s", cu.ChannelId, cu.ChannelName)
@@ -574,14 +591,19 @@ func (nu NodeUpdateRequestEvent) String() string {
 
 // NodeUpdateEvent
 //
-//
+// When Statistics is set, they follow the node update. Clients that do not
+// know about statistics ignore these additional bytes. In a NodeListEvent,
+// statistics are packed as described below instead.
+
+const NODE_UPDATE_SIZE = 18
 
 type NodeUpdateEvent struct {
-	BaseEvent `json:"-"`
-	NodeId    nocan.NodeId     `json:"id"`
-	State     models.NodeState `json:"state"`
-	Udid      models.Udid8     `json:"udid"`
-	LastSeen  time.Time        `json:"last_seen"`
+	BaseEvent  `json:"-"`
+	NodeId     nocan.NodeId           `json:"id"`
+	State      models.NodeState       `json:"state"`
+	Udid       models.Udid8           `json:"udid"`
+	LastSeen   time.Time              `json:"last_seen"`
+	Statistics *models.NodeStatistics `json:"statistics,omitempty"`
 }
 
 func NewNodeUpdateEvent() *NodeUpdateEvent {
@@ -594,17 +616,17 @@ func NewNodeUpdateEventWithParams(id nocan.NodeId, state models.NodeState, udid
 	return nu
 }
 
-func (nu *NodeUpdateEvent) Pack() ([]byte, error) {
-	b := make([]byte, 18)
+func (nu *NodeUpdateEvent) packUpdate() []byte {
+	b := make([]byte, NODE_UPDATE_SIZE)
 	b[0] = byte(nu.NodeId)
 	b[1] = byte(nu.State)
 	copy(b[2:10], nu.Udid[:])
 	EncodeUint64(b[10:18], uint64(nu.LastSeen.UnixNano()))
-	return b, nil
+	return b
 }
 
-func (nu *NodeUpdateEvent) Unpack(b []byte) error {
-	if len(b) < 18 {
+func (nu *NodeUpdateEvent) unpackUpdate(b []byte) error {
+	if len(b) < NODE_UPDATE_SIZE {
 		return ErrorMissingData
 	}
 	nu.NodeId = nocan.NodeId(b[0])
@@ -615,7 +637,30 @@ func (nu *NodeUpdateEvent) Unpack(b []byte) error {
 	return nil
 }
 
+func (nu *NodeUpdateEvent) Pack() ([]byte, error) {
+	b := nu.packUpdate()
+	if nu.Statistics != nil {
+		b = append(b, packNodeStatistics(nu.Statistics)...)
+	}
+	return b, nil
+}
+
+func (nu *NodeUpdateEvent) Unpack(b []byte) error {
+	if err := nu.unpackUpdate(b); err != nil {
+		return err
+	}
+	nu.Statistics = nil
+	if len(b) >= NODE_UPDATE_SIZE+NODE_STATISTICS_SIZE {
+		nu.Statistics = new(models.NodeStatistics)
+		return unpackNodeStatistics(nu.Statistics, b[NODE_UPDATE_SIZE:])
+	}
+	return nil
+}
+
 func (nu NodeUpdateEvent) String() string {
+	if nu.Statistics != nil {
+		return fmt.Sprintf("#%d\t%s\t%s\t%s\t%s", nu.NodeId, nu.Udid, nu.State, nu.LastSeen.Format(time.RFC3339Nano), nu.Statistics)
+	}
 	return fmt.Sprintf("#%d\t%s\t%s\t%s", nu.NodeId, nu.Udid, nu.State, nu.LastSeen.Format(time.RFC3339Nano))
 }
 
@@ -623,6 +668,12 @@ func (nu NodeUpdateEvent) String() string {
 //
 //
 
+// When statistics are requested, the list starts with NODE_LIST_WITH_STATISTICS
+// and each node is followed by its statistics. Node ids are always below
+// 0x80, so older lists are not ambiguous.
+
+const NODE_LIST_WITH_STATISTICS = 0xFF
+
 type NodeListEvent struct {
 	BaseEvent
 	Nodes []*NodeUpdateEvent `json:"nodes"`
@@ -650,27 +701,59 @@ func (nl *NodeListEvent) Exclude(id nocan.NodeId) bool {
 	return retval
 }
 
+func (nl *NodeListEvent) withStatistics() bool {
+	for _, nu := range nl.Nodes {
+		if nu.Statistics != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (nl *NodeListEvent) Pack() ([]byte, error) {
-	b := make([]byte, 0, len(nl.Nodes)*18)
+	with_statistics := nl.withStatistics()
+
+	b := make([]byte, 0, 1+len(nl.Nodes)*(NODE_UPDATE_SIZE+NODE_STATISTICS_SIZE))
+	if with_statistics {
+		b = append(b, NODE_LIST_WITH_STATISTICS)
+	}
 	for _, nu := range nl.Nodes {
-		sb, _ := nu.Pack()
-		b = append(b, sb...)
+		b = append(b, nu.packUpdate()...)
+		if with_statistics {
+			var stats models.NodeStatistics
+			if nu.Statistics != nil {
+				stats = *nu.Statistics
+			}
+			b = append(b, packNodeStatistics(&stats)...)
+		}
 	}
 	return b, nil
 }
 
 func (nl *NodeListEvent) Unpack(b []byte) error {
+	with_statistics := len(b) > 0 && b[0] == NODE_LIST_WITH_STATISTICS
+	if with_statistics {
+		b = b[1:]
+	}
+
 	nl.Nodes = make([]*NodeUpdateEvent, 0, 8)
 	for {
 		if len(b) == 0 {
 			break
 		}
 		nu := NewNodeUpdateEvent()
-		if err := nu.Unpack(b); err != nil {
+		if err := nu.unpackUpdate(b); err != nil {
 			return err
 		}
+		b = b[NODE_UPDATE_SIZE:]
+		if with_statistics {
+			nu.Statistics = new(models.NodeStatistics)
+			if err := unpackNodeStatistics(nu.Statistics, b); err != nil {
+				return err
+			}
+			b = b[NODE_STATISTICS_SIZE:]
+		}
 		nl.Append(nu)
-		b = b[18:]
 	}
 	return nil
 }
@@ -688,11 +771,140 @@ func (nl NodeListEvent) String() string {
 //
 
 type NodeListRequestEvent struct {
-	EmptyEvent
+	BaseEvent
+	WithStatistics bool
 }
 
 func NewNodeListRequestEvent() *NodeListRequestEvent {
-	return &NodeListRequestEvent{EmptyEvent{BaseEvent{0, NodeListRequestEventId}}}
+	return &NodeListRequestEvent{BaseEvent: BaseEvent{0, NodeListRequestEventId}}
+}
+
+// NewNodeListWithStatisticsRequestEvent requests a node list that includes
+// the statistics of each node.
+func NewNodeListWithStatisticsRequestEvent() *NodeListRequestEvent {
+	return &NodeListRequestEvent{BaseEvent: BaseEvent{0, NodeListRequestEventId}, WithStatistics: true}
+}
+
+func (nlr NodeListRequestEvent) Pack() ([]byte, error) {
+	if nlr.WithStatistics {
+		return []byte{1}, nil
+	}
+	return make([]byte, 0), nil
+}
+
+func (nlr *NodeListRequestEvent) Unpack(b []byte) error {
+	nlr.WithStatistics = len(b) > 0 && b[0] != 0
+	return nil
+}
+
+func (nlr NodeListRequestEvent) String() string {
+	if nlr.WithStatistics {
+		return "with statistics"
+	}
+	return ""
+}
+
+// NodeStatisticsRequestEvent
+//
+//
+
+type NodeStatisticsRequestEvent struct {
+	BaseEvent
+	NodeId nocan.NodeId
+}
+
+func NewNodeStatisticsRequestEvent(node_id nocan.NodeId) *NodeStatisticsRequestEvent {
+	return &NodeStatisticsRequestEvent{BaseEvent: BaseEvent{0, NodeStatisticsRequestEventId}, NodeId: node_id}
+}
+
+func (nsr NodeStatisticsRequestEvent) Pack() ([]byte, error) {
+	return []byte{byte(nsr.NodeId)}, nil
+}
+
+func (nsr *NodeStatisticsRequestEvent) Unpack(b []byte) error {
+	if len(b) < 1 {
+		return ErrorMissingData
+	}
+	nsr.NodeId = nocan.NodeId(b[0])
+	return nil
+}
+
+func (nsr NodeStatisticsRequestEvent) String() string {
+	return fmt.Sprintf("#%d", nsr.NodeId)
+}
+
+// NodeStatisticsEvent
+//
+// NodeStatisticsEvent is sent in response to a NodeStatisticsRequestEvent.
+
+const NODE_STATISTICS_SIZE = 48
+
+type NodeStatisticsEvent struct {
+	BaseEvent
+	NodeId     nocan.NodeId
+	Statistics models.NodeStatistics
+}
+
+func NewNodeStatisticsEvent(node_id nocan.NodeId, stats *models.NodeStatistics) *NodeStatisticsEvent {
+	ns := &NodeStatisticsEvent{BaseEvent: BaseEvent{0, NodeStatisticsEventId}, NodeId: node_id}
+	if stats != nil {
+		ns.Statistics = *stats
+	}
+	return ns
+}
+
+func packNodeStatistics(stats *models.NodeStatistics) []byte {
+	b := make([]byte, NODE_STATISTICS_SIZE)
+	EncodeUint32(b[0:], stats.DroppedFrames)
+	EncodeUint32(b[4:], stats.OrphanFragments)
+	EncodeUint32(b[8:], stats.ReassemblyTimeouts)
+	EncodeUint32(b[12:], stats.OverflowedMessages)
+	EncodeUint32(b[16:], stats.UnknownNodeFrames)
+	EncodeUint32(b[20:], stats.QueueOverflows)
+	EncodeUint32(b[24:], stats.PingsSent)
+	EncodeUint32(b[28:], stats.PingsAnswered)
+	EncodeUint32(b[32:], stats.RttMin)
+	EncodeUint32(b[36:], stats.RttAvg)
+	EncodeUint32(b[40:], stats.RttMax)
+	EncodeUint32(b[44:], stats.RttJitter)
+	return b
+}
+
+func unpackNodeStatistics(stats *models.NodeStatistics, b []byte) error {
+	if len(b) < NODE_STATISTICS_SIZE {
+		return ErrorMissingData
+	}
+	stats.DroppedFrames = DecodeUint32(b[0:])
+	stats.OrphanFragments = DecodeUint32(b[4:])
+	stats.ReassemblyTimeouts = DecodeUint32(b[8:])
+	stats.OverflowedMessages = DecodeUint32(b[12:])
+	stats.UnknownNodeFrames = DecodeUint32(b[16:])
+	stats.QueueOverflows = DecodeUint32(b[20:])
+	stats.PingsSent = DecodeUint32(b[24:])
+	stats.PingsAnswered = DecodeUint32(b[28:])
+	stats.RttMin = DecodeUint32(b[32:])
+	stats.RttAvg = DecodeUint32(b[36:])
+	stats.RttMax = DecodeUint32(b[40:])
+	stats.RttJitter = DecodeUint32(b[44:])
+	return nil
+}
+
+func (ns *NodeStatisticsEvent) Pack() ([]byte, error) {
+	b := make([]byte, 1, 1+NODE_STATISTICS_SIZE)
+	b[0] = byte(ns.NodeId)
+	return append(b, packNodeStatistics(&ns.Statistics)...), nil
+}
+
+func (ns *NodeStatisticsEvent) Unpack(b []byte) error {
+	if len(b) < 1 {
+		return ErrorMissingData
+	}
+	ns.NodeId = nocan.NodeId(b[0])
+	return unpackNodeStatistics(&ns.Statistics, b[1:])
+}
+
+func (ns NodeStatisticsEvent) String() string {
+	return fmt.Sprintf("#%d\t%s", ns.NodeId, ns.Statistics)
 }
 
 // NodeFirmwareDownloadRequestEvent
@@ -852,10 +1064,14 @@ func NewNodeFirmwareProgressEvent(id nocan.NodeId) *NodeFirmwareProgressEvent {
 	return &NodeFirmwareProgressEvent{BaseEvent: BaseEvent{0, NodeFirmwareProgressEventId}, NodeId: id, Progress: 0, BytesTransferred: 0}
 }
 
+// Update records the progress of a firmware operation and returns a copy of
+// the event, which can be queued for sending while the operation continues
+// to update the original.
 func (nfp *NodeFirmwareProgressEvent) Update(progress ProgressReport, transferred uint32) *NodeFirmwareProgressEvent {
 	nfp.Progress = progress
 	nfp.BytesTransferred = transferred
-	return nfp
+	snapshot := *nfp
+	return &snapshot
 }
 
 func (nfp *NodeFirmwareProgressEvent) MarkAsFailed() *NodeFirmwareProgressEvent {
@@ -1143,6 +1359,246 @@ func (sp SystemPropertiesEvent) String() string {
 	return fmt.Sprintf("[%d properties]", len(sp.Properties.Map))
 }
 
+// BusMonitorRequestEvent
+//
+// BusMonitorRequestEvent subscribes a client to bus-traffic-event updates.
+// Monitor is a combination of MONITOR_FRAMES and MONITOR_MESSAGES, 0 ends the
+// subscription.
+
+const (
+	MONITOR_FRAMES   = 1
+	MONITOR_MESSAGES = 2
+)
+
+type BusMonitorRequestEvent struct {
+	BaseEvent
+	Monitor byte
+}
+
+func NewBusMonitorRequestEvent(monitor byte) *BusMonitorRequestEvent {
+	return &BusMonitorRequestEvent{BaseEvent: BaseEvent{0, BusMonitorRequestEventId}, Monitor: monitor}
+}
+
+func (bm BusMonitorRequestEvent) Pack() ([]byte, error) {
+	b := make([]byte, 1)
+	b[0] = bm.Monitor
+	return b, nil
+}
+
+func (bm *BusMonitorRequestEvent) Unpack(b []byte) error {
+	if len(b) < 1 {
+		return ErrorMissingData
+	}
+	bm.Monitor = b[0]
+	return nil
+}
+
+func (bm BusMonitorRequestEvent) String() string {
+	var s []string
+
+	if (bm.Monitor & MONITOR_FRAMES) != 0 {
+		s = append(s, "frames")
+	}
+	if (bm.Monitor & MONITOR_MESSAGES) != 0 {
+		s = append(s, "messages")
+	}
+	if s == nil {
+		return "off"
+	}
+	return strings.Join(s, ",")
+}
+
+// BusTrafficEvent
+//
+// BusTrafficEvent describes a CAN frame or a complete NoCAN message seen by
+// the server. It is only sent to clients that asked for it with a
+// BusMonitorRequestEvent. Udid and ChannelName are resolved by the server
+// when the node or the channel is known.
+
+type TrafficType byte
+
+const (
+	TRAFFIC_FRAME TrafficType = iota
+	TRAFFIC_MESSAGE
+)
+
+type BusTrafficEvent struct {
+	BaseEvent
+	Type        TrafficType
+	Direction   can.Direction
+	Timestamp   time.Time
+	CanId       uint32
+	Data        []byte
+	Udid        models.Udid8
+	ChannelName string
+}
+
+func NewBusTrafficEvent() *BusTrafficEvent {
+	return &BusTrafficEvent{BaseEvent: BaseEvent{0, BusTrafficEventId}}
+}
+
+func NewBusFrameTrafficEvent(dir can.Direction, timestamp time.Time, frame *can.Frame) *BusTrafficEvent {
+	dlc := frame.Dlc
+	if dlc > 8 {
+		dlc = 8
+	}
+	bt := &BusTrafficEvent{BaseEvent: BaseEvent{0, BusTrafficEventId}, Type: TRAFFIC_FRAME, Direction: dir, Timestamp: timestamp, CanId: frame.CanId}
+	bt.Data = make([]byte, dlc)
+	copy(bt.Data, frame.Data[:dlc])
+	return bt
+}
+
+func NewBusMessageTrafficEvent(dir can.Direction, timestamp time.Time, msg *nocan.Message) *BusTrafficEvent {
+	bt := &BusTrafficEvent{BaseEvent: BaseEvent{0, BusTrafficEventId}, Type: TRAFFIC_MESSAGE, Direction: dir, Timestamp: timestamp, CanId: msg.CanId}
+	bt.Data = make([]byte, msg.Dlc)
+	copy(bt.Data, msg.Bytes())
+	return bt
+}
+
+func (bt *BusTrafficEvent) Pack() ([]byte, error) {
+	b := make([]byte, 23, 24+len(bt.Data)+len(bt.ChannelName))
+	b[0] = byte(bt.Type)
+	b[1] = byte(bt.Direction)
+	EncodeTime(b[2:], bt.Timestamp)
+	EncodeUint32(b[10:], bt.CanId)
+	copy(b[14:22], bt.Udid[:])
+	b[22] = byte(len(bt.Data))
+	b = append(b, bt.Data...)
+	b = append(b, byte(len(bt.ChannelName)))
+	b = append(b, []byte(bt.ChannelName)...)
+	return b, nil
+}
+
+func (bt *BusTrafficEvent) Unpack(b []byte) error {
+	if len(b) < 23 {
+		return ErrorMissingData
+	}
+	bt.Type = TrafficType(b[0])
+	bt.Direction = can.Direction(b[1])
+	bt.Timestamp = DecodeTime(b[2:])
+	bt.CanId = DecodeUint32(b[10:])
+	copy(bt.Udid[:], b[14:22])
+	l_data := int(b[22])
+	if l_data > 64 {
+		return errors.New("Traffic data exceeds 64 bytes")
+	}
+	b = b[23:]
+	if len(b) < l_data+1 {
+		return ErrorMissingData
+	}
+	bt.Data = make([]byte, l_data)
+	copy(bt.Data, b[:l_data])
+	b = b[l_data:]
+	l_name := int(b[0])
+	b = b[1:]
+	if len(b) < l_name {
+		return ErrorMissingData
+	}
+	bt.ChannelName = string(b[:l_name])
+	return nil
+}
+
+// Frame returns the CAN frame carried by a TRAFFIC_FRAME event.
+func (bt *BusTrafficEvent) Frame() *can.Frame {
+	frame := &can.Frame{CanId: bt.CanId, Dlc: uint8(len(bt.Data))}
+	copy(frame.Data[:], bt.Data)
+	return frame
+}
+
+// Message returns the NoCAN message carried by a TRAFFIC_MESSAGE event.
+func (bt *BusTrafficEvent) Message() *nocan.Message {
+	return nocan.NewMessage(bt.CanId, bt.Data)
+}
+
+func (bt BusTrafficEvent) String() string {
+	var s string
+
+	ts := bt.Timestamp.Format("15:04:05.000000")
+	if bt.Type == TRAFFIC_FRAME {
+		frame := bt.Frame()
+		s = fmt.Sprintf("%s %s frame %s\t%s", ts, bt.Direction, frame, nocan.FrameAnnotation(frame))
+	} else {
+		s = fmt.Sprintf("%s %s %s", ts, bt.Direction, bt.Message())
+	}
+	if bt.ChannelName != "" {
+		s += fmt.Sprintf(" channel=%q", bt.ChannelName)
+	}
+	if bt.Udid != models.NullUdid8 {
+		s += fmt.Sprintf(" udid=%s", bt.Udid)
+	}
+	return s
+}
+
+// BusHealthRequestEvent
+//
+//
+
+type BusHealthRequestEvent struct {
+	EmptyEvent
+}
+
+func NewBusHealthRequestEvent() *BusHealthRequestEvent {
+	return &BusHealthRequestEvent{EmptyEvent{BaseEvent{0, BusHealthRequestEventId}}}
+}
+
+// BusHealthEvent
+//
+// BusHealthEvent is broadcast when the bus health state changes, and sent in
+// response to a BusHealthRequestEvent.
+
+type BusHealthEvent struct {
+	BaseEvent
+	Health device.BusHealth
+}
+
+func NewBusHealthEvent(health *device.BusHealth) *BusHealthEvent {
+	bh := &BusHealthEvent{BaseEvent: BaseEvent{0, BusHealthEventId}}
+	if health != nil {
+		bh.Health = *health
+	}
+	return bh
+}
+
+func (bh *BusHealthEvent) Pack() ([]byte, error) {
+	b := make([]byte, 39)
+	b[0] = byte(bh.Health.State)
+	EncodeUint32(b[1:], bh.Health.ErrorFrames)
+	EncodeUint32(b[5:], bh.Health.ErrorPassive)
+	EncodeUint32(b[9:], bh.Health.BusOff)
+	EncodeUint32(b[13:], bh.Health.DriverErrors)
+	EncodeUint32(b[17:], bh.Health.Faults)
+	EncodeUint32(b[21:], bh.Health.Resets)
+	EncodeUint32(b[25:], bh.Health.PowerCycles)
+	b[29] = bh.Health.TxErrors
+	b[30] = bh.Health.RxErrors
+	EncodeTime(b[31:], bh.Health.ChangedAt)
+	return b, nil
+}
+
+func (bh *BusHealthEvent) Unpack(b []byte) error {
+	if len(b) < 39 {
+		return ErrorMissingData
+	}
+	bh.Health.State = device.BusHealthState(b[0])
+	bh.Health.ErrorFrames = DecodeUint32(b[1:])
+	bh.Health.ErrorPassive = DecodeUint32(b[5:])
+	bh.Health.BusOff = DecodeUint32(b[9:])
+	bh.Health.DriverErrors = DecodeUint32(b[13:])
+	bh.Health.Faults = DecodeUint32(b[17:])
+	bh.Health.Resets = DecodeUint32(b[21:])
+	bh.Health.PowerCycles = DecodeUint32(b[25:])
+	bh.Health.TxErrors = b[29]
+	bh.Health.RxErrors = b[30]
+	bh.Health.ChangedAt = DecodeTime(b[31:])
+	return nil
+}
+
+func (bh BusHealthEvent) String() string {
+	h := bh.Health
+	return fmt.Sprintf("%s since %s, error frames=%d, error passive=%d, bus off=%d, driver errors=%d, faults=%d, resets=%d, power cycles=%d, tx errors=%d, rx errors=%d",
+		h.State, h.ChangedAt.Format(time.RFC3339), h.ErrorFrames, h.ErrorPassive, h.BusOff, h.DriverErrors, h.Faults, h.Resets, h.PowerCycles, h.TxErrors, h.RxErrors)
+}
+
 //
 //
 //
@@ -1184,6 +1640,500 @@ func (bps BusPowerStatusUpdateEvent) String() string {
 		byte(bps.Status.Status), bps.Status.Status)
 }
 
+// NodeQueueOverflowEvent
+//
+// NodeQueueOverflowEvent is broadcast when messages from a node start being
+// dropped because its input queue is full.
+
+type NodeQueueOverflowEvent struct {
+	BaseEvent
+	NodeId    nocan.NodeId
+	Policy    byte
+	Overflows uint32
+}
+
+func NewNodeQueueOverflowEvent(node_id nocan.NodeId, policy byte, overflows uint32) *NodeQueueOverflowEvent {
+	return &NodeQueueOverflowEvent{BaseEvent: BaseEvent{0, NodeQueueOverflowEventId}, NodeId: node_id, Policy: policy, Overflows: overflows}
+}
+
+func (nqo *NodeQueueOverflowEvent) Pack() ([]byte, error) {
+	b := make([]byte, 6)
+	b[0] = byte(nqo.NodeId)
+	b[1] = nqo.Policy
+	EncodeUint32(b[2:], nqo.Overflows)
+	return b, nil
+}
+
+func (nqo *NodeQueueOverflowEvent) Unpack(b []byte) error {
+	if len(b) < 6 {
+		return ErrorMissingData
+	}
+	nqo.NodeId = nocan.NodeId(b[0])
+	nqo.Policy = b[1]
+	nqo.Overflows = DecodeUint32(b[2:])
+	return nil
+}
+
+func (nqo NodeQueueOverflowEvent) String() string {
+	policy := "drop-oldest"
+	if nqo.Policy != 0 {
+		policy = "drop-newest"
+	}
+	return fmt.Sprintf("#%d input queue is full (%s), %d messages dropped so far", nqo.NodeId, policy, nqo.Overflows)
+}
+
+// SubscriptionListRequestEvent
+//
+// SubscriptionListRequestEvent asks for the subscribers and publishers of
+// channels, optionally restricted to one node (NodeId is UNDEFINED_NODE
+// otherwise), to one channel (ChannelId is UNDEFINED_CHANNEL otherwise) and to
+// channels that have publishers but no subscribers.
+
+type SubscriptionListRequestEvent struct {
+	BaseEvent
+	NodeId         nocan.NodeId
+	ChannelId      nocan.ChannelId
+	UnconsumedOnly bool
+}
+
+func NewSubscriptionListRequestEvent(node_id nocan.NodeId, channel_id nocan.ChannelId, unconsumed_only bool) *SubscriptionListRequestEvent {
+	return &SubscriptionListRequestEvent{BaseEvent: BaseEvent{0, SubscriptionListRequestEventId}, NodeId: node_id, ChannelId: channel_id, UnconsumedOnly: unconsumed_only}
+}
+
+// Matches tells if a channel is selected by the request.
+func (slr *SubscriptionListRequestEvent) Matches(cs *models.ChannelSubscriptions) bool {
+	if slr.ChannelId != nocan.UNDEFINED_CHANNEL && cs.ChannelId != slr.ChannelId {
+		return false
+	}
+	if slr.NodeId != nocan.UNDEFINED_NODE && !cs.Involves(slr.NodeId) {
+		return false
+	}
+	return !slr.UnconsumedOnly || cs.Unconsumed()
+}
+
+func (slr *SubscriptionListRequestEvent) Pack() ([]byte, error) {
+	b := make([]byte, 4)
+	b[0] = byte(slr.NodeId)
+	b[1] = byte(slr.ChannelId >> 8)
+	b[2] = byte(slr.ChannelId)
+	if slr.UnconsumedOnly {
+		b[3] = 1
+	}
+	return b, nil
+}
+
+func (slr *SubscriptionListRequestEvent) Unpack(b []byte) error {
+	if len(b) < 4 {
+		return ErrorMissingData
+	}
+	slr.NodeId = nocan.NodeId(b[0])
+	slr.ChannelId = (nocan.ChannelId(b[1]) << 8) | nocan.ChannelId(b[2])
+	slr.UnconsumedOnly = b[3] != 0
+	return nil
+}
+
+func (slr SubscriptionListRequestEvent) String() string {
+	var filter []string
+	if slr.NodeId != nocan.UNDEFINED_NODE {
+		filter = append(filter, fmt.Sprintf("node #%d", slr.NodeId))
+	}
+	if slr.ChannelId != nocan.UNDEFINED_CHANNEL {
+		filter = append(filter, fmt.Sprintf("channel %d", slr.ChannelId))
+	}
+	if slr.UnconsumedOnly {
+		filter = append(filter, "unconsumed")
+	}
+	return strings.Join(filter, ", ")
+}
+
+// SubscriptionListEvent
+//
+// SubscriptionListEvent is sent in response to a SubscriptionListRequestEvent.
+// Each channel is packed as its id on 2 bytes, followed by the number of
+// subscribers and their node ids, and the number of publishers and their node
+// ids.
+
+type SubscriptionListEvent struct {
+	BaseEvent
+	Channels []*models.ChannelSubscriptions
+}
+
+func NewSubscriptionListEvent() *SubscriptionListEvent {
+	return &SubscriptionListEvent{BaseEvent: BaseEvent{0, SubscriptionListEventId}}
+}
+
+func (sl *SubscriptionListEvent) Append(cs *models.ChannelSubscriptions) *SubscriptionListEvent {
+	sl.Channels = append(sl.Channels, cs)
+	return sl
+}
+
+func packNodeIds(b []byte, ids []nocan.NodeId) []byte {
+	b = append(b, byte(len(ids)))
+	for _, id := range ids {
+		b = append(b, byte(id))
+	}
+	return b
+}
+
+func unpackNodeIds(b []byte) ([]nocan.NodeId, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, nil, ErrorMissingData
+	}
+	ids := make([]nocan.NodeId, b[0])
+	for i := range ids {
+		ids[i] = nocan.NodeId(b[1+i])
+	}
+	return ids, b[1+len(ids):], nil
+}
+
+func (sl *SubscriptionListEvent) Pack() ([]byte, error) {
+	b := make([]byte, 0, len(sl.Channels)*8)
+	for _, cs := range sl.Channels {
+		b = append(b, cs.ChannelId.ToBytes()...)
+		b = packNodeIds(b, cs.Subscribers)
+		b = packNodeIds(b, cs.Publishers)
+	}
+	return b, nil
+}
+
+func (sl *SubscriptionListEvent) Unpack(b []byte) error {
+	var err error
+
+	sl.Channels = nil
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return ErrorMissingData
+		}
+		cs := &models.ChannelSubscriptions{ChannelId: (nocan.ChannelId(b[0]) << 8) | nocan.ChannelId(b[1])}
+		if cs.Subscribers, b, err = unpackNodeIds(b[2:]); err != nil {
+			return err
+		}
+		if cs.Publishers, b, err = unpackNodeIds(b); err != nil {
+			return err
+		}
+		sl.Append(cs)
+	}
+	return nil
+}
+
+func (sl SubscriptionListEvent) String() string {
+	var resp string
+	for _, cs := range sl.Channels {
+		resp += fmt.Sprintf("%d\tsubscribers=%v\tpublishers=%v", cs.ChannelId, cs.Subscribers, cs.Publishers)
+		if cs.Unconsumed() {
+			resp += "\tunconsumed"
+		}
+		resp += "\n"
+	}
+	return resp
+}
+
+// NodeDebugRequestEvent
+//
+// NodeDebugRequestEvent asks for the debug lines printed by a node, or by all
+// nodes if NodeId is UNDEFINED_NODE. Debug is a combination of
+// NODE_DEBUG_HISTORY, to receive the lines kept by the server, and
+// NODE_DEBUG_STREAM, to receive new lines as node-debug-event updates. A
+// request replaces the previous one, and 0 ends the subscription.
+
+const (
+	NODE_DEBUG_HISTORY = 1
+	NODE_DEBUG_STREAM  = 2
+)
+
+type NodeDebugRequestEvent struct {
+	BaseEvent
+	NodeId nocan.NodeId
+	Debug  byte
+}
+
+func NewNodeDebugRequestEvent(node_id nocan.NodeId, debug byte) *NodeDebugRequestEvent {
+	return &NodeDebugRequestEvent{BaseEvent: BaseEvent{0, NodeDebugRequestEventId}, NodeId: node_id, Debug: debug}
+}
+
+// Includes tells if the request selects the debug lines of a node.
+func (ndr *NodeDebugRequestEvent) Includes(node_id nocan.NodeId) bool {
+	return ndr.NodeId == nocan.UNDEFINED_NODE || ndr.NodeId == node_id
+}
+
+func (ndr *NodeDebugRequestEvent) Pack() ([]byte, error) {
+	return []byte{byte(ndr.NodeId), ndr.Debug}, nil
+}
+
+func (ndr *NodeDebugRequestEvent) Unpack(b []byte) error {
+	if len(b) < 2 {
+		return ErrorMissingData
+	}
+	ndr.NodeId = nocan.NodeId(b[0])
+	ndr.Debug = b[1]
+	return nil
+}
+
+func (ndr NodeDebugRequestEvent) String() string {
+	var s []string
+
+	if (ndr.Debug & NODE_DEBUG_HISTORY) != 0 {
+		s = append(s, "history")
+	}
+	if (ndr.Debug & NODE_DEBUG_STREAM) != 0 {
+		s = append(s, "stream")
+	}
+	if s == nil {
+		return "off"
+	}
+	if ndr.NodeId == nocan.UNDEFINED_NODE {
+		return "all nodes: " + strings.Join(s, ",")
+	}
+	return fmt.Sprintf("node #%d: %s", ndr.NodeId, strings.Join(s, ","))
+}
+
+// NodeDebugEvent
+//
+// NodeDebugEvent carries a line printed by a node with SYS_DEBUG_MESSAGE. It
+// is only sent to clients that asked for it with a NodeDebugRequestEvent.
+
+type NodeDebugEvent struct {
+	BaseEvent
+	NodeId nocan.NodeId
+	Line   models.DebugLine
+}
+
+func NewNodeDebugEvent(node_id nocan.NodeId, line models.DebugLine) *NodeDebugEvent {
+	return &NodeDebugEvent{BaseEvent: BaseEvent{0, NodeDebugEventId}, NodeId: node_id, Line: line}
+}
+
+func (nd *NodeDebugEvent) Pack() ([]byte, error) {
+	b := make([]byte, 14, 14+len(nd.Line.Text))
+	b[0] = byte(nd.NodeId)
+	b[1] = nd.Line.Sequence
+	EncodeUint32(b[2:], nd.Line.Lost)
+	EncodeTime(b[6:], nd.Line.Time)
+	return append(b, []byte(nd.Line.Text)...), nil
+}
+
+func (nd *NodeDebugEvent) Unpack(b []byte) error {
+	if len(b) < 14 {
+		return ErrorMissingData
+	}
+	nd.NodeId = nocan.NodeId(b[0])
+	nd.Line.Sequence = b[1]
+	nd.Line.Lost = DecodeUint32(b[2:])
+	nd.Line.Time = DecodeTime(b[6:])
+	nd.Line.Text = string(b[14:])
+	return nil
+}
+
+func (nd NodeDebugEvent) String() string {
+	s := fmt.Sprintf("%s N%d [%d] %s", nd.Line.Time.Format("15:04:05.000000"), nd.NodeId, nd.Line.Sequence, nd.Line.Text)
+	if nd.Line.Lost > 0 {
+		s += fmt.Sprintf(" (%d messages lost before this line)", nd.Line.Lost)
+	}
+	return s
+}
+
+// NodeLookupRequestEvent
+//
+// NodeLookupRequestEvent finds a registered node by its udid or, if Udid is
+// NullUdid8, by its node id. The server answers with a node-update-event, or
+// with ServerAckNotFound if no registered node matches.
+
+type NodeLookupRequestEvent struct {
+	BaseEvent
+	NodeId nocan.NodeId
+	Udid   models.Udid8
+}
+
+func NewNodeLookupRequestEvent(node_id nocan.NodeId, udid models.Udid8) *NodeLookupRequestEvent {
+	return &NodeLookupRequestEvent{BaseEvent: BaseEvent{0, NodeLookupRequestEventId}, NodeId: node_id, Udid: udid}
+}
+
+func (nl *NodeLookupRequestEvent) Pack() ([]byte, error) {
+	b := make([]byte, 9)
+	b[0] = byte(nl.NodeId)
+	copy(b[1:], nl.Udid[:])
+	return b, nil
+}
+
+func (nl *NodeLookupRequestEvent) Unpack(b []byte) error {
+	if len(b) < 9 {
+		return ErrorMissingData
+	}
+	nl.NodeId = nocan.NodeId(b[0])
+	copy(nl.Udid[:], b[1:9])
+	return nil
+}
+
+func (nl NodeLookupRequestEvent) String() string {
+	if nl.Udid != models.NullUdid8 {
+		return fmt.Sprintf("udid %s", nl.Udid)
+	}
+	return fmt.Sprintf("node #%d", nl.NodeId)
+}
+
+// ChannelHistoryRequestEvent
+//
+// ChannelHistoryRequestEvent asks for the past values of a channel, selected
+// by name or, if ChannelName is empty, by id. From and To bound the time
+// range, a zero time leaving that end open. Limit caps the number of values
+// returned, keeping the most recent ones, and Step, if not 0, keeps only the
+// last value of each interval of that duration. Time stamps are packed as
+// nanoseconds, with 0 for a zero time, and Step as milliseconds.
+
+type ChannelHistoryRequestEvent struct {
+	BaseEvent
+	ChannelId   nocan.ChannelId
+	ChannelName string
+	From        time.Time
+	To          time.Time
+	Limit       uint16
+	Step        time.Duration
+}
+
+func NewChannelHistoryRequestEvent(chan_name string, chan_id nocan.ChannelId) *ChannelHistoryRequestEvent {
+	return &ChannelHistoryRequestEvent{BaseEvent: BaseEvent{0, ChannelHistoryRequestEventId}, ChannelId: chan_id, ChannelName: chan_name}
+}
+
+func encodeOptionalTime(dest []byte, t time.Time) {
+	if t.IsZero() {
+		EncodeUint64(dest, 0)
+	} else {
+		EncodeTime(dest, t)
+	}
+}
+
+func decodeOptionalTime(src []byte) time.Time {
+	if DecodeUint64(src) == 0 {
+		return time.Time{}
+	}
+	return DecodeTime(src)
+}
+
+func (chr *ChannelHistoryRequestEvent) Pack() ([]byte, error) {
+	b := make([]byte, 25, 25+len(chr.ChannelName))
+	EncodeUint16(b[0:], uint16(chr.ChannelId))
+	encodeOptionalTime(b[2:], chr.From)
+	encodeOptionalTime(b[10:], chr.To)
+	EncodeUint16(b[18:], chr.Limit)
+	EncodeUint32(b[20:], uint32(chr.Step/time.Millisecond))
+	b[24] = byte(len(chr.ChannelName))
+	return append(b, []byte(chr.ChannelName)...), nil
+}
+
+func (chr *ChannelHistoryRequestEvent) Unpack(b []byte) error {
+	if len(b) < 25 {
+		return ErrorMissingData
+	}
+	chr.ChannelId = nocan.ChannelId(DecodeUint16(b[0:]))
+	chr.From = decodeOptionalTime(b[2:])
+	chr.To = decodeOptionalTime(b[10:])
+	chr.Limit = DecodeUint16(b[18:])
+	chr.Step = time.Duration(DecodeUint32(b[20:])) * time.Millisecond
+	l_name := int(b[24])
+	if l_name > 64 {
+		return errors.New("Channel name exceeds 64 bytes")
+	}
+	if len(b) < 25+l_name {
+		return ErrorMissingData
+	}
+	chr.ChannelName = string(b[25 : 25+l_name])
+	return nil
+}
+
+func (chr ChannelHistoryRequestEvent) String() string {
+	var s string
+
+	if chr.ChannelName == "" {
+		s = fmt.Sprintf("#%d", chr.ChannelId)
+	} else {
+		s = chr.ChannelName
+	}
+	if !chr.From.IsZero() {
+		s += " from " + chr.From.Format(time.RFC3339)
+	}
+	if !chr.To.IsZero() {
+		s += " to " + chr.To.Format(time.RFC3339)
+	}
+	if chr.Limit > 0 {
+		s += fmt.Sprintf(" limit %d", chr.Limit)
+	}
+	if chr.Step > 0 {
+		s += fmt.Sprintf(" step %s", chr.Step)
+	}
+	return s
+}
+
+// ChannelHistoryEvent
+//
+// ChannelHistoryEvent is sent in response to a ChannelHistoryRequestEvent,
+// with the values in chronological order. Each value is packed as its time
+// stamp, followed by its length on 1 byte and its content.
+
+type ChannelHistoryEvent struct {
+	BaseEvent   `json:"-"`
+	ChannelId   nocan.ChannelId       `json:"id"`
+	ChannelName string                `json:"name"`
+	Entries     []models.HistoryEntry `json:"entries"`
+}
+
+func NewChannelHistoryEvent(chan_name string, chan_id nocan.ChannelId, entries []models.HistoryEntry) *ChannelHistoryEvent {
+	return &ChannelHistoryEvent{BaseEvent: BaseEvent{0, ChannelHistoryEventId}, ChannelId: chan_id, ChannelName: chan_name, Entries: entries}
+}
+
+func (ch *ChannelHistoryEvent) Pack() ([]byte, error) {
+	b := make([]byte, 3, 3+len(ch.ChannelName)+len(ch.Entries)*16)
+	EncodeUint16(b[0:], uint16(ch.ChannelId))
+	b[2] = byte(len(ch.ChannelName))
+	b = append(b, []byte(ch.ChannelName)...)
+	for _, entry := range ch.Entries {
+		var ts [8]byte
+		if len(entry.Value) > 64 {
+			return nil, errors.New("Channel history value exceeds 64 bytes")
+		}
+		EncodeTime(ts[:], entry.Time)
+		b = append(b, ts[:]...)
+		b = append(b, byte(len(entry.Value)))
+		b = append(b, entry.Value...)
+	}
+	return b, nil
+}
+
+func (ch *ChannelHistoryEvent) Unpack(b []byte) error {
+	if len(b) < 3 {
+		return ErrorMissingData
+	}
+	ch.ChannelId = nocan.ChannelId(DecodeUint16(b[0:]))
+	l_name := int(b[2])
+	if len(b) < 3+l_name {
+		return ErrorMissingData
+	}
+	ch.ChannelName = string(b[3 : 3+l_name])
+	b = b[3+l_name:]
+
+	ch.Entries = nil
+	for len(b) > 0 {
+		if len(b) < 9 {
+			return ErrorMissingData
+		}
+		l_value := int(b[8])
+		if len(b) < 9+l_value {
+			return ErrorMissingData
+		}
+		value := make([]byte, l_value)
+		copy(value, b[9:9+l_value])
+		ch.Entries = append(ch.Entries, models.HistoryEntry{Time: DecodeTime(b), Value: value})
+		b = b[9+l_value:]
+	}
+	return nil
+}
+
+func (ch ChannelHistoryEvent) String() string {
+	s := fmt.Sprintf("#%d\t%s\t%d values\n", ch.ChannelId, ch.ChannelName, len(ch.Entries))
+	for _, entry := range ch.Entries {
+		s += fmt.Sprintf("%s\t%q\n", entry.Time.Format(time.RFC3339Nano), entry.Value)
+	}
+	return s
+}
+
 /****** *******/
 
 const (
@@ -1213,7 +2163,21 @@ const (
 	DeviceInformationEventId                   = 23
 	SystemPropertiesRequestEventId             = 24
 	SystemPropertiesEventId                    = 25
-	EventIdCount                               = 26
+	BusMonitorRequestEventId                   = 26
+	BusTrafficEventId                          = 27
+	BusHealthRequestEventId                    = 28
+	BusHealthEventId                           = 29
+	NodeStatisticsRequestEventId               = 30
+	NodeStatisticsEventId                      = 31
+	NodeQueueOverflowEventId                   = 32
+	SubscriptionListRequestEventId             = 33
+	SubscriptionListEventId                    = 34
+	NodeDebugRequestEventId                    = 35
+	NodeDebugEventId                           = 36
+	NodeLookupRequestEventId                   = 37
+	ChannelHistoryRequestEventId               = 38
+	ChannelHistoryEventId                      = 39
+	EventIdCount                               = 40
 )
 
 var EventNames = [EventIdCount]string{
@@ -1243,6 +2207,20 @@ var EventNames = [EventIdCount]string{
 	"device-information-event",
 	"system-properties-request-event",
 	"system-properties-event",
+	"bus-monitor-request-event",
+	"bus-traffic-event",
+	"bus-health-request-event",
+	"bus-health-event",
+	"node-statistics-request-event",
+	"node-statistics-event",
+	"node-queue-overflow-event",
+	"subscription-list-request-event",
+	"subscription-list-event",
+	"node-debug-request-event",
+	"node-debug-event",
+	"node-lookup-request-event",
+	"channel-history-request-event",
+	"channel-history-event",
 }
 
 var EventNameMap map[string]EventId
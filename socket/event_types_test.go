@@ -0,0 +1,73 @@
+package socket
+
+import (
+	"github.com/omzlo/nocand/models"
+	"github.com/omzlo/nocand/models/nocan"
+	"testing"
+	"time"
+)
+
+func testNodeUpdate(id byte, with_statistics bool) *NodeUpdateEvent {
+	nu := NewNodeUpdateEventWithParams(nocan.NodeId(id), models.NodeStateRunning, models.Udid8{1, 2, 3, 4, 5, 6, 7, id}, time.Unix(1600000000, 0))
+	if with_statistics {
+		nu.Statistics = &models.NodeStatistics{DroppedFrames: uint32(id), PingsSent: 10, PingsAnswered: 9, RttMin: 100, RttAvg: 150, RttMax: 300, RttJitter: 20}
+	}
+	return nu
+}
+
+func TestNodeUpdateEventStatistics(t *testing.T) {
+	for _, with_statistics := range []bool{false, true} {
+		nu := testNodeUpdate(3, with_statistics)
+		b, _ := nu.Pack()
+
+		decoded := NewNodeUpdateEvent()
+		if err := decoded.Unpack(b); err != nil {
+			t.Fatalf("Unpack failed: %s", err)
+		}
+		if decoded.NodeId != nu.NodeId || decoded.Udid != nu.Udid || decoded.State != nu.State || !decoded.LastSeen.Equal(nu.LastSeen) {
+			t.Errorf("Round trip of %s gave %s", nu, decoded)
+		}
+		if (decoded.Statistics != nil) != with_statistics {
+			t.Fatalf("Round trip of %s gave statistics %v", nu, decoded.Statistics)
+		}
+		if with_statistics && *decoded.Statistics != *nu.Statistics {
+			t.Errorf("Round trip of statistics %s gave %s", nu.Statistics, decoded.Statistics)
+		}
+	}
+
+	// Older clients only read the first NODE_UPDATE_SIZE bytes.
+	b, _ := testNodeUpdate(3, true).Pack()
+	decoded := NewNodeUpdateEvent()
+	if err := decoded.unpackUpdate(b); err != nil || decoded.NodeId != 3 {
+		t.Errorf("Node update header is not readable on its own: %s", err)
+	}
+}
+
+func TestNodeListEventStatistics(t *testing.T) {
+	for _, with_statistics := range []bool{false, true} {
+		nl := NewNodeListEvent()
+		nl.Append(testNodeUpdate(1, with_statistics))
+		nl.Append(testNodeUpdate(2, with_statistics))
+		nl.Append(testNodeUpdate(3, false))
+		b, _ := nl.Pack()
+
+		decoded := NewNodeListEvent()
+		if err := decoded.Unpack(b); err != nil {
+			t.Fatalf("Unpack failed: %s", err)
+		}
+		if len(decoded.Nodes) != 3 {
+			t.Fatalf("Round trip of a list of 3 nodes gave %d nodes", len(decoded.Nodes))
+		}
+		for i, nu := range decoded.Nodes {
+			if nu.NodeId != nl.Nodes[i].NodeId || nu.Udid != nl.Nodes[i].Udid {
+				t.Errorf("Node %d of the list is %s, expected %s", i, nu, nl.Nodes[i])
+			}
+			if (nu.Statistics != nil) != with_statistics {
+				t.Errorf("Node %d of the list has statistics %v", i, nu.Statistics)
+			}
+		}
+		if with_statistics && decoded.Nodes[1].Statistics.DroppedFrames != 2 {
+			t.Errorf("Node 1 of the list has statistics %s", decoded.Nodes[1].Statistics)
+		}
+	}
+}
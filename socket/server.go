@@ -5,6 +5,7 @@ import (
 	"github.com/omzlo/clog"
 	"github.com/omzlo/go-sscp"
 	"io"
+	"net"
 	"sync"
 	"time"
 )
@@ -12,8 +13,6 @@ import (
 /****************************************************************************/
 
 // ClientDescriptor represents a single connection from an external client through TCP/IP
-//
-//
 type ClientDescriptor struct {
 	Id              uint
 	Server          *Server
@@ -21,21 +20,49 @@ type ClientDescriptor struct {
 	OutputChan      chan Eventer
 	TerminationChan chan struct{}
 	ChannelFilter   *ChannelFilterEvent
+	Monitor         byte
+	DebugFilter     *NodeDebugRequestEvent
 	Connected       bool
 	Next            *ClientDescriptor
 	LastMsgId       uint16
+	closed          chan struct{}
+	closeOnce       sync.Once
 }
 
 func (c *ClientDescriptor) Name() string {
 	return fmt.Sprintf("%d (%s)", c.Id, c.Conn.RemoteAddr())
 }
 
+// SendEvent queues an event for the client. It can be called from any
+// goroutine, and fails once the client has been deleted.
 func (c *ClientDescriptor) SendEvent(event Eventer) error {
-	if !c.Connected {
+	select {
+	case <-c.closed:
 		return fmt.Errorf("SendEvent failed, client %d is not connected", c.Id)
+	default:
+	}
+	select {
+	case c.OutputChan <- event:
+		return nil
+	case <-c.closed:
+		return fmt.Errorf("SendEvent failed, client %d is not connected", c.Id)
+	}
+}
+
+// TrySendEvent is like SendEvent, but drops the event and returns false if
+// the output queue of the client is full.
+func (c *ClientDescriptor) TrySendEvent(event Eventer) bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	select {
+	case c.OutputChan <- event:
+		return true
+	default:
+		return false
 	}
-	c.OutputChan <- event
-	return nil
 }
 
 func (c *ClientDescriptor) SendAck(ack byte) error {
@@ -47,11 +74,32 @@ func (c *ClientDescriptor) SendAck(ack byte) error {
 func clientChannelFilterHandler(c *ClientDescriptor, event Eventer) error {
 	sl := event.(*ChannelFilterEvent)
 
+	c.Server.Mutex.Lock()
 	c.ChannelFilter = sl
+	c.Server.Mutex.Unlock()
 
 	return c.SendAck(ServerAckSuccess)
 }
 
+func clientBusMonitorHandler(c *ClientDescriptor, event Eventer) error {
+	bm := event.(*BusMonitorRequestEvent)
+
+	c.Server.Mutex.Lock()
+	c.Monitor = bm.Monitor
+	c.Server.Mutex.Unlock()
+	clog.Debug("Client %s bus monitoring set to %s", c.Name(), bm)
+
+	return c.SendAck(ServerAckSuccess)
+}
+
+// SetDebugFilter selects the node-debug-event updates sent to the client,
+// nil ends the subscription.
+func (c *ClientDescriptor) SetDebugFilter(ndr *NodeDebugRequestEvent) {
+	c.Server.Mutex.Lock()
+	c.DebugFilter = ndr
+	c.Server.Mutex.Unlock()
+}
+
 /****************************************************************************/
 
 // Server
@@ -67,11 +115,16 @@ type Server struct {
 	ls        *sscp.Listener
 	clients   *ClientDescriptor
 	handlers  map[EventId]EventHandler
+
+	// broadcastMutex keeps the events of concurrent broadcasts in the same
+	// order for every client.
+	broadcastMutex sync.Mutex
 }
 
 func NewServer() *Server {
 	s := &Server{handlers: make(map[EventId]EventHandler)}
 	s.RegisterHandler(ChannelFilterEventId, clientChannelFilterHandler)
+	s.RegisterHandler(BusMonitorRequestEventId, clientBusMonitorHandler)
 	return s
 }
 
@@ -86,6 +139,7 @@ func (s *Server) NewClient(conn *sscp.Conn) *ClientDescriptor {
 	c.Next = s.clients
 	c.OutputChan = make(chan Eventer, 16)
 	c.TerminationChan = make(chan struct{})
+	c.closed = make(chan struct{})
 	c.Connected = true
 
 	c.Id = s.topId
@@ -95,13 +149,16 @@ func (s *Server) NewClient(conn *sscp.Conn) *ClientDescriptor {
 }
 
 func (s *Server) DeleteClient(c *ClientDescriptor) bool {
+	// OutputChan is left open: other goroutines may still be sending events,
+	// they are released by closed instead. This is done before taking the
+	// server mutex, which may be held by a goroutine blocked in SendEvent.
+	c.closeOnce.Do(func() { close(c.closed) })
+
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
 	c.Connected = false
 	c.Conn.Close()
-
-	close(c.OutputChan)
 	close(c.TerminationChan)
 
 	ptr := &s.clients
@@ -117,23 +174,72 @@ func (s *Server) DeleteClient(c *ClientDescriptor) bool {
 	return false
 }
 
+// Broadcast sends an event to all clients that accept it, except
+// exclude_client. The events are queued after releasing the server mutex,
+// so that a client with a full queue does not prevent other clients from
+// connecting or leaving, and is released when it is deleted.
 func (s *Server) Broadcast(event Eventer, exclude_client *ClientDescriptor) {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+	var blocking []*ClientDescriptor
+	var dropping []*ClientDescriptor
 
+	s.broadcastMutex.Lock()
+	defer s.broadcastMutex.Unlock()
+
+	s.Mutex.Lock()
 	for c := s.clients; c != nil; c = c.Next {
 		if c == exclude_client {
 			continue
 		}
-		if event.Id() == ChannelUpdateEventId {
+		switch event.Id() {
+		case ChannelUpdateEventId:
 			channel_update := event.(*ChannelUpdateEvent)
 			if c.ChannelFilter == nil || c.ChannelFilter.Includes(channel_update.ChannelId) {
-				c.SendEvent(event)
+				blocking = append(blocking, c)
 			}
-		} else {
-			c.SendEvent(event)
+		case BusTrafficEventId:
+			// Bus traffic only goes to monitoring clients, and is dropped
+			// rather than slowing down the bus if a client lags behind.
+			if (c.Monitor & trafficMonitorFlag(event.(*BusTrafficEvent))) != 0 {
+				dropping = append(dropping, c)
+			}
+		case NodeDebugEventId:
+			// Like bus traffic, debug lines are dropped for a lagging client.
+			if c.DebugFilter != nil && c.DebugFilter.Includes(event.(*NodeDebugEvent).NodeId) {
+				dropping = append(dropping, c)
+			}
+		default:
+			blocking = append(blocking, c)
+		}
+	}
+	s.Mutex.Unlock()
+
+	for _, c := range dropping {
+		c.TrySendEvent(event)
+	}
+	for _, c := range blocking {
+		c.SendEvent(event)
+	}
+}
+
+func trafficMonitorFlag(bt *BusTrafficEvent) byte {
+	if bt.Type == TRAFFIC_FRAME {
+		return MONITOR_FRAMES
+	}
+	return MONITOR_MESSAGES
+}
+
+// Monitoring tells if at least one client subscribed to the bus traffic
+// selected by monitor (MONITOR_FRAMES and/or MONITOR_MESSAGES).
+func (s *Server) Monitoring(monitor byte) bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for c := s.clients; c != nil; c = c.Next {
+		if (c.Monitor & monitor) != 0 {
+			return true
 		}
 	}
+	return false
 }
 
 func (s *Server) RegisterHandler(eid EventId, fn EventHandler) {
@@ -276,3 +382,12 @@ func (s *Server) ListenAndServe(addr string, auth_token string) error {
 	}()
 	return nil
 }
+
+// Addr returns the address the server listens on, once ListenAndServe
+// succeeded.
+func (s *Server) Addr() net.Addr {
+	if s.ls == nil {
+		return nil
+	}
+	return s.ls.Addr()
+}
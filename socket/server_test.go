@@ -0,0 +1,79 @@
+package socket
+
+import (
+	"github.com/omzlo/go-sscp"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeClient returns a client of s, connected through an in-memory pipe.
+// No goroutine reads its output queue.
+func pipeClient(t *testing.T, s *Server) *ClientDescriptor {
+	client_side, server_side := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := sscp.ClientWrapper(client_side, []byte("test"), []byte("secret"))
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+		done <- err
+	}()
+	conn, err := sscp.ServerWrapper(server_side, []byte("nocand"), []byte("secret"))
+	if err != nil {
+		t.Fatalf("Server handshake failed: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Client handshake failed: %s", err)
+	}
+	return s.NewClient(conn)
+}
+
+// TestDeleteClientReleasesBroadcast checks that deleting a client with a full
+// output queue releases a broadcast blocked on that client, and does not
+// block on the server itself.
+func TestDeleteClientReleasesBroadcast(t *testing.T) {
+	s := NewServer()
+	c := pipeClient(t, s)
+	for c.TrySendEvent(NewBusPowerEvent(true)) {
+	}
+
+	broadcast_done := make(chan struct{})
+	go func() {
+		s.Broadcast(NewBusPowerEvent(false), nil)
+		close(broadcast_done)
+	}()
+
+	// Let the broadcast block on the full queue.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-broadcast_done:
+		t.Fatalf("Broadcast returned while the output queue of the client was full")
+	default:
+	}
+
+	delete_done := make(chan struct{})
+	go func() {
+		s.DeleteClient(c)
+		close(delete_done)
+	}()
+
+	for _, done := range []chan struct{}{delete_done, broadcast_done} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("DeleteClient and Broadcast are deadlocked")
+		}
+	}
+
+	// The server can still accept new clients and broadcast to them.
+	other := pipeClient(t, s)
+	s.Broadcast(NewBusPowerEvent(true), nil)
+	if len(other.OutputChan) != 1 {
+		t.Errorf("New client has %d queued events, expected 1", len(other.OutputChan))
+	}
+	if err := c.SendEvent(NewBusPowerEvent(true)); err == nil {
+		t.Errorf("SendEvent succeeded on a deleted client")
+	}
+}